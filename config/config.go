@@ -5,9 +5,16 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"math"
 	"os"
 	"os/user"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -19,6 +26,29 @@ var (
 	GoldImgsPath string
 	// Where all the raw images are downloaded to
 	ImagesPath string
+	// Directory images on the local filesystem must be within, i.e.: an NFS
+	// mount. Local images are refused if it is not set.
+	LocalImagesPath string
+	// Hypervisor driver used to manage virtual machines
+	Driver string
+	// Where the state of asynchronous operations is kept
+	OperationsPath string
+	// Maximum number of bytes used by gold images and downloaded images
+	// before evicting the least recently used ones. Zero means no limit.
+	ImagesQuota int64
+	// Ed25519 public keys trusted to sign image manifests. If any is set,
+	// virtual machines can only be created from images with signed manifests.
+	ImageSigningKeys []ed25519.PublicKey
+	// Whether to unpack images while downloading them, instead of once they
+	// are downloaded
+	StreamUnpack bool
+	// Limits on what unpacking an image may produce, guarding against
+	// images crafted to fill up the disk: bytes unpacked, files in the
+	// package and ratio between unpacked and compressed bytes. Zero means no
+	// limit.
+	UnpackMaxBytes   int64 = 512 << 30
+	UnpackMaxEntries int64 = 100000
+	UnpackMaxRatio   int64 = 10000
 )
 
 // Initializes service's configuration
@@ -28,6 +58,55 @@ func init() {
 		Port = "12345"
 	}
 
+	Driver = os.Getenv("VMWARE_DRIVER")
+	if Driver == "" {
+		Driver = "fusion7"
+		if runtime.GOOS == "linux" {
+			Driver = "workstation"
+		}
+	}
+
+	LocalImagesPath = os.Getenv("LOCAL_IMAGES_PATH")
+
+	var err error
+	ImagesQuota, err = parseBytes(os.Getenv("IMAGES_QUOTA"))
+	if err != nil {
+		panic(fmt.Errorf("Invalid IMAGES_QUOTA: %s", err))
+	}
+
+	ImageSigningKeys, err = parsePublicKeys(os.Getenv("IMAGE_SIGNING_KEYS"))
+	if err != nil {
+		panic(fmt.Errorf("Invalid IMAGE_SIGNING_KEYS: %s", err))
+	}
+
+	if value := os.Getenv("STREAM_UNPACK"); value != "" {
+		StreamUnpack, err = strconv.ParseBool(value)
+		if err != nil {
+			panic(fmt.Errorf("Invalid STREAM_UNPACK: %s", err))
+		}
+	}
+
+	if value := os.Getenv("UNPACK_MAX_BYTES"); value != "" {
+		UnpackMaxBytes, err = parseBytes(value)
+		if err != nil {
+			panic(fmt.Errorf("Invalid UNPACK_MAX_BYTES: %s", err))
+		}
+	}
+
+	if value := os.Getenv("UNPACK_MAX_ENTRIES"); value != "" {
+		UnpackMaxEntries, err = parseCount(value)
+		if err != nil {
+			panic(fmt.Errorf("Invalid UNPACK_MAX_ENTRIES: %s", err))
+		}
+	}
+
+	if value := os.Getenv("UNPACK_MAX_RATIO"); value != "" {
+		UnpackMaxRatio, err = parseCount(value)
+		if err != nil {
+			panic(fmt.Errorf("Invalid UNPACK_MAX_RATIO: %s", err))
+		}
+	}
+
 	usr, err := user.Current()
 	if err != nil {
 		panic(err)
@@ -37,4 +116,71 @@ func init() {
 	VMSPath = filepath.Join(basePath, "vms")
 	GoldImgsPath = filepath.Join(basePath, "gold")
 	ImagesPath = filepath.Join(basePath, "images")
+	OperationsPath = filepath.Join(basePath, "operations")
+}
+
+// parseBytes parses a size in bytes, optionally followed by a K, M, G or T
+// unit suffix. An empty string means zero.
+func parseBytes(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i >= 0 && i == len(value)-1 {
+		multiplier = 1 << (10 * uint(strings.IndexByte("KMGT", value[i])+1))
+		value = value[:i]
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("size must not be negative: %d", n)
+	}
+
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size is too big: %s", value)
+	}
+
+	return n * multiplier, nil
+}
+
+// parseCount parses a number that must not be negative.
+func parseCount(value string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		return 0, fmt.Errorf("must not be negative: %d", n)
+	}
+	return n, nil
+}
+
+// parsePublicKeys parses a comma separated list of base64 encoded Ed25519
+// public keys.
+func parsePublicKeys(value string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, encoded := range strings.Split(value, ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("public key must be %d bytes long, got %d", ed25519.PublicKeySize, len(key))
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
 }
@@ -0,0 +1,32 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	var tests = []struct {
+		value string
+		bytes int64
+		valid bool
+	}{
+		{"", 0, true},
+		{"1024", 1024, true},
+		{" 2k ", 2 << 10, true},
+		{"512G", 512 << 30, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false},
+		{"9223372036854775807", 9223372036854775807, true},
+		{"9223372036854775807K", 0, false},
+		{"-1", 0, false},
+		{"1P", 0, false},
+	}
+
+	for _, test := range tests {
+		n, err := parseBytes(test.value)
+		assert(t, test.valid == (err == nil), "%q: unexpected error: %v", test.value, err)
+		equals(t, test.bytes, n)
+	}
+}
@@ -0,0 +1,41 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package operations
+
+import (
+	"net/http"
+
+	"github.com/c4milo/osx-builder/apperror"
+)
+
+var ErrInternal = apperror.Error{
+	Code:       "internal-error",
+	Message:    "Whops! Our team is currently looking into this. Apologies for the inconvenience",
+	HTTPStatus: http.StatusInternalServerError,
+}
+
+var ErrOperationNotFound = apperror.Error{
+	Code:       "operation-not-found",
+	Message:    "The requested operation ID was not found",
+	HTTPStatus: http.StatusNotFound,
+}
+
+var ErrInterrupted = apperror.Error{
+	Code:       "operation-interrupted",
+	Message:    "The operation was interrupted by a restart of the service. Please try again.",
+	HTTPStatus: http.StatusServiceUnavailable,
+}
+
+var ErrOperationFinished = apperror.Error{
+	Code:       "operation-finished",
+	Message:    "The operation finished already and can no longer be canceled",
+	HTTPStatus: http.StatusConflict,
+}
+
+var ErrCanceled = apperror.Error{
+	Code:       "operation-canceled",
+	Message:    "The operation was canceled",
+	HTTPStatus: http.StatusConflict,
+}
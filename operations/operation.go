@@ -0,0 +1,428 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package operations
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+)
+
+// Type represents the kind of work an operation carries out.
+type Type string
+
+const (
+	TypeCreateVM      Type = "create-vm"
+	TypeDestroyVM     Type = "destroy-vm"
+	TypeReconfigureVM Type = "reconfigure-vm"
+	TypePrepareImage  Type = "prepare-image"
+)
+
+// Status represents whether an operation is still running or how it finished.
+type Status string
+
+const (
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+// Phase represents the step an operation is currently at.
+type Phase string
+
+const (
+	PhasePending      Phase = "pending"
+	PhaseDownloading  Phase = "downloading"
+	PhaseUnpacking    Phase = "unpacking"
+	PhaseCloning      Phase = "cloning"
+	PhaseStopping     Phase = "stopping"
+	PhaseConfiguring  Phase = "configuring"
+	PhaseBooting      Phase = "booting"
+	PhaseWaitingForIP Phase = "waiting-for-ip"
+	PhaseDeleting     Phase = "deleting"
+	PhaseDone         Phase = "done"
+)
+
+// How often progress updates are persisted to disk. Phase and status changes
+// are always persisted right away.
+const progressSaveInterval = time.Second
+
+// How long finished operations are kept around.
+const maxAge = 7 * 24 * time.Hour
+
+// Operation tracks the progress of a long running task, such as creating a
+// virtual machine. Its methods are safe to use from multiple goroutines and
+// can be called on a nil Operation, in which case they do nothing.
+type Operation struct {
+	// Operation ID
+	ID string `json:"id"`
+	// Kind of operation
+	Type Type `json:"type"`
+	// ID of the resource the operation works on, i.e.: a virtual machine ID
+	ResourceID string `json:"resource_id"`
+	// Whether the operation is running, succeeded or failed
+	Status Status `json:"status"`
+	// Step the operation is currently at
+	Phase Phase `json:"phase"`
+	// Percentage of completion of the current phase, if known
+	Progress int `json:"progress"`
+	// Transfer rate of the current phase, if it involves transferring data
+	BytesPerSecond int64 `json:"bytes_per_second,omitempty"`
+	// When the operation was created
+	CreatedAt time.Time `json:"created_at"`
+	// Last time the operation changed
+	UpdatedAt time.Time `json:"updated_at"`
+	// When the operation finished
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Reason why the operation failed
+	Error *apperror.Error `json:"error,omitempty"`
+
+	mu      sync.Mutex
+	store   *Store
+	savedAt time.Time
+	// Done once the operation is canceled or finishes. Operations loaded
+	// from disk have none, since they finished already.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// SetPhase moves the operation to the given phase, resetting its progress.
+func (o *Operation) SetPhase(phase Phase) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	log.Printf("[DEBUG] Operation %s: %s", o.ID, phase)
+	o.Phase = phase
+	o.Progress = 0
+	o.BytesPerSecond = 0
+	o.save(true)
+}
+
+// SetProgress updates the percentage of completion of the current phase.
+func (o *Operation) SetProgress(progress int) {
+	o.SetProgressRate(progress, 0)
+}
+
+// SetProgressRate updates the percentage of completion of the current phase
+// along with the rate at which data is being transferred.
+func (o *Operation) SetProgressRate(progress int, bytesPerSecond int64) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if progress > 100 {
+		progress = 100
+	}
+	o.Progress = progress
+	o.BytesPerSecond = bytesPerSecond
+	o.save(false)
+}
+
+// Finish marks the operation as succeeded or, if appErr is not nil, as failed.
+func (o *Operation) Finish(appErr *apperror.Error) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now().UTC()
+	o.FinishedAt = &now
+	o.Error = appErr
+
+	if appErr != nil {
+		o.Status = StatusFailed
+	} else {
+		o.Status = StatusSucceeded
+		o.Phase = PhaseDone
+		o.Progress = 100
+		o.BytesPerSecond = 0
+	}
+
+	log.Printf("[DEBUG] Operation %s: %s", o.ID, o.Status)
+	o.save(true)
+
+	if o.cancel != nil {
+		o.cancel()
+	}
+}
+
+// Context returns a context that is done as soon as the operation is
+// canceled, for whatever carries it out to stop.
+func (o *Operation) Context() context.Context {
+	if o == nil || o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// Cancel asks whatever carries out the operation to stop. The operation
+// finishes, as failed, once it actually stops. It returns false if the
+// operation finished already.
+func (o *Operation) Cancel() bool {
+	if o == nil {
+		return false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.FinishedAt != nil || o.cancel == nil {
+		return false
+	}
+
+	log.Printf("[DEBUG] Operation %s: canceling", o.ID)
+	o.cancel()
+	return true
+}
+
+// Snapshot returns a copy of the operation, safe to read while the original
+// keeps changing.
+func (o *Operation) Snapshot() *Operation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return &Operation{
+		ID:             o.ID,
+		Type:           o.Type,
+		ResourceID:     o.ResourceID,
+		Status:         o.Status,
+		Phase:          o.Phase,
+		Progress:       o.Progress,
+		BytesPerSecond: o.BytesPerSecond,
+		CreatedAt:      o.CreatedAt,
+		UpdatedAt:      o.UpdatedAt,
+		FinishedAt:     o.FinishedAt,
+		Error:          o.Error,
+	}
+}
+
+// save persists the operation. Unless force is true, it is skipped if the
+// operation was saved less than progressSaveInterval ago. It must be called
+// holding o.mu.
+func (o *Operation) save(force bool) {
+	now := time.Now().UTC()
+	o.UpdatedAt = now
+
+	if !force && now.Sub(o.savedAt) < progressSaveInterval {
+		return
+	}
+	o.savedAt = now
+
+	if err := o.store.write(o); err != nil {
+		log.Printf("[ERROR] Unable to save operation %s: %s", o.ID, err)
+	}
+}
+
+// Store keeps operations on disk, one JSON file per operation, so that they
+// survive restarts of the service.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+	ops map[string]*Operation
+}
+
+// NewStore loads the operations kept in the given directory. Operations that
+// were still running are marked as failed, since whatever was carrying them
+// out is gone. Operations finished more than a week ago are discarded.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return nil, err
+	}
+
+	store := &Store{
+		dir: dir,
+		ops: make(map[string]*Operation),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		op := &Operation{store: store}
+		if err := json.Unmarshal(data, op); err != nil {
+			log.Printf("[WARN] Ignoring corrupt operation file %s: %s", file, err)
+			continue
+		}
+
+		if op.FinishedAt != nil && time.Since(*op.FinishedAt) > maxAge {
+			os.Remove(file)
+			continue
+		}
+
+		if op.Status == StatusRunning {
+			log.Printf("[WARN] Operation %s was interrupted", op.ID)
+			op.Finish(&ErrInterrupted)
+		}
+
+		store.ops[op.ID] = op
+	}
+
+	return store, nil
+}
+
+// Create starts tracking a new operation. Operations finished more than
+// maxAge ago are discarded along the way, so that long running services do
+// not accumulate them.
+func (s *Store) Create(t Type, resourceID string) (*Operation, error) {
+	s.prune()
+
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	now := time.Now().UTC()
+	op := &Operation{
+		ID:         fmt.Sprintf("%x", b),
+		Type:       t,
+		ResourceID: resourceID,
+		Status:     StatusRunning,
+		Phase:      PhasePending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		store:      s,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if err := s.write(op); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.ops[op.ID] = op
+	s.mu.Unlock()
+
+	return op, nil
+}
+
+// prune discards the operations finished more than maxAge ago, from memory
+// and from disk.
+func (s *Store) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, op := range s.ops {
+		op.mu.Lock()
+		expired := op.FinishedAt != nil && time.Since(*op.FinishedAt) > maxAge
+		op.mu.Unlock()
+
+		if !expired {
+			continue
+		}
+
+		delete(s.ops, id)
+		file := filepath.Join(s.dir, id+".json")
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Printf("[WARN] Unable to remove operation file %s: %s", file, err)
+		}
+	}
+}
+
+// Get returns an operation by its ID, or nil if it does not exist.
+func (s *Store) Get(id string) *Operation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ops[id]
+}
+
+// write atomically persists an operation. It must be called holding op.mu.
+func (s *Store) write(op *Operation) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	// IDs are generated by Create but loaded ones come from disk.
+	if op.ID == "" || strings.ContainsAny(op.ID, `/\.`) {
+		return fmt.Errorf("Invalid operation ID: %q", op.ID)
+	}
+
+	file := filepath.Join(s.dir, op.ID+".json")
+	if err := ioutil.WriteFile(file+".tmp", data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+var (
+	defaultMu    sync.Mutex
+	defaultStore *Store
+)
+
+// Open loads the operations kept in dir and uses it as the default store
+// from then on.
+func Open(dir string) error {
+	store, err := NewStore(dir)
+	if err != nil {
+		return err
+	}
+
+	defaultMu.Lock()
+	defaultStore = store
+	defaultMu.Unlock()
+
+	return nil
+}
+
+// Default returns the default store, opening config.OperationsPath if no
+// store was opened yet.
+func Default() (*Store, error) {
+	defaultMu.Lock()
+	store := defaultStore
+	defaultMu.Unlock()
+
+	if store != nil {
+		return store, nil
+	}
+
+	if err := Open(config.OperationsPath); err != nil {
+		return nil, err
+	}
+	return Default()
+}
+
+// New starts tracking a new operation in the default store.
+func New(t Type, resourceID string) (*Operation, error) {
+	store, err := Default()
+	if err != nil {
+		return nil, err
+	}
+	return store.Create(t, resourceID)
+}
@@ -0,0 +1,141 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package operations
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-operations")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStore(dir)
+	ok(t, err)
+
+	done, err := store.Create(TypeCreateVM, "vm1")
+	ok(t, err)
+	equals(t, StatusRunning, done.Status)
+	equals(t, PhasePending, done.Phase)
+
+	done.SetPhase(PhaseDownloading)
+	done.SetProgress(150)
+	equals(t, 100, done.Progress)
+	done.SetPhase(PhaseUnpacking)
+	equals(t, 0, done.Progress)
+	done.Finish(nil)
+
+	failed, err := store.Create(TypeDestroyVM, "vm2")
+	ok(t, err)
+	failed.SetPhase(PhaseStopping)
+	failed.Finish(&ErrInternal)
+
+	running, err := store.Create(TypeReconfigureVM, "vm3")
+	ok(t, err)
+	running.SetPhase(PhaseConfiguring)
+
+	assert(t, store.Get("non-existent") == nil, "non-existent operation should not be found")
+
+	// A new store over the same directory behaves as if the service was
+	// restarted.
+	store, err = NewStore(dir)
+	ok(t, err)
+
+	op := store.Get(done.ID)
+	assert(t, op != nil, "operation %s should have been loaded", done.ID)
+	equals(t, StatusSucceeded, op.Status)
+	equals(t, PhaseDone, op.Phase)
+	equals(t, "vm1", op.ResourceID)
+	assert(t, op.Error == nil, "unexpected error: %+v", op.Error)
+
+	op = store.Get(failed.ID)
+	assert(t, op != nil, "operation %s should have been loaded", failed.ID)
+	equals(t, StatusFailed, op.Status)
+	equals(t, PhaseStopping, op.Phase)
+	equals(t, ErrInternal.Code, op.Error.Code)
+
+	op = store.Get(running.ID)
+	assert(t, op != nil, "operation %s should have been loaded", running.ID)
+	equals(t, StatusFailed, op.Status)
+	equals(t, PhaseConfiguring, op.Phase)
+	equals(t, ErrInterrupted.Code, op.Error.Code)
+	assert(t, op.FinishedAt != nil, "interrupted operation should be finished")
+}
+
+func TestStorePrune(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-operations")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStore(dir)
+	ok(t, err)
+
+	old, err := store.Create(TypeCreateVM, "vm1")
+	ok(t, err)
+	old.Finish(nil)
+
+	recent, err := store.Create(TypeCreateVM, "vm2")
+	ok(t, err)
+	recent.Finish(nil)
+
+	running, err := store.Create(TypeCreateVM, "vm3")
+	ok(t, err)
+
+	// Operations are not expected to change once finished.
+	finishedAt := time.Now().Add(-maxAge - time.Hour)
+	old.FinishedAt = &finishedAt
+
+	_, err = store.Create(TypeDestroyVM, "vm1")
+	ok(t, err)
+
+	assert(t, store.Get(old.ID) == nil, "expired operation should have been discarded")
+	_, err = os.Stat(filepath.Join(dir, old.ID+".json"))
+	assert(t, os.IsNotExist(err), "expired operation file should have been removed")
+
+	assert(t, store.Get(recent.ID) != nil, "recent operation should be kept")
+	assert(t, store.Get(running.ID) != nil, "running operation should be kept")
+}
+
+func TestCancel(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-operations")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewStore(dir)
+	ok(t, err)
+
+	op, err := store.Create(TypeCreateVM, "vm1")
+	ok(t, err)
+	ok(t, op.Context().Err())
+
+	assert(t, op.Cancel(), "running operation should be canceled")
+	equals(t, context.Canceled, op.Context().Err())
+	equals(t, StatusRunning, op.Status)
+
+	op.Finish(&ErrCanceled)
+	equals(t, StatusFailed, op.Status)
+	assert(t, !op.Cancel(), "finished operation should not be canceled")
+
+	// Operations loaded from disk can't be canceled either.
+	store, err = NewStore(dir)
+	ok(t, err)
+	assert(t, !store.Get(op.ID).Cancel(), "loaded operation should not be canceled")
+	ok(t, store.Get(op.ID).Context().Err())
+}
+
+func TestNilOperation(t *testing.T) {
+	var op *Operation
+	op.SetPhase(PhaseBooting)
+	op.SetProgress(50)
+	op.Finish(nil)
+	assert(t, !op.Cancel(), "nil operation should not be canceled")
+	ok(t, op.Context().Err())
+}
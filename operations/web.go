@@ -0,0 +1,113 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package operations
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/pkg/render"
+)
+
+// Handlers is a map to functions where each function is in charge of handling
+// a HTTP verb or method.
+var Handlers map[string]func(http.ResponseWriter, *http.Request) = map[string]func(http.ResponseWriter, *http.Request){
+	"GET":    GetOperation,
+	"DELETE": CancelOperation,
+}
+
+// GetOperationParams defines parameters supported by the GetOperation service.
+type GetOperationParams struct {
+	ID string
+}
+
+// GetOperation returns the status of an operation given its ID.
+func GetOperation(w http.ResponseWriter, req *http.Request) {
+	params := GetOperationParams{
+		ID: operationID(req.URL.Path),
+	}
+
+	op := findOperation(w, params.ID)
+	if op == nil {
+		return
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   op.Snapshot(),
+	})
+}
+
+// CancelOperationParams defines parameters supported by the CancelOperation
+// service.
+type CancelOperationParams struct {
+	ID string
+}
+
+// CancelOperation asks a running operation to stop. The operation keeps
+// running until whatever it was doing is interrupted, it then fails with
+// the operation-canceled error.
+func CancelOperation(w http.ResponseWriter, req *http.Request) {
+	params := CancelOperationParams{
+		ID: operationID(req.URL.Path),
+	}
+
+	op := findOperation(w, params.ID)
+	if op == nil {
+		return
+	}
+
+	if !op.Cancel() {
+		log.Printf(`[ERROR] msg="%s" code=%s id=%s\n`,
+			ErrOperationFinished.Message, ErrOperationFinished.Code, params.ID)
+
+		render.JSON(w, render.Options{
+			Status: ErrOperationFinished.HTTPStatus,
+			Data:   ErrOperationFinished,
+		})
+		return
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusAccepted,
+		Data:   op.Snapshot(),
+	})
+}
+
+// operationID returns the operation ID in the given URL path.
+func operationID(urlPath string) string {
+	return strings.Trim(strings.TrimPrefix(urlPath, "/operations"), "/")
+}
+
+// findOperation returns the operation with the given ID, rendering an error
+// and returning nil if it can't be found.
+func findOperation(w http.ResponseWriter, id string) *Operation {
+	store, err := Default()
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return nil
+	}
+
+	op := store.Get(id)
+	if op == nil {
+		log.Printf(`[ERROR] msg="%s" code=%s id=%s\n`,
+			ErrOperationNotFound.Message, ErrOperationNotFound.Code, id)
+
+		render.JSON(w, render.Options{
+			Status: ErrOperationNotFound.HTTPStatus,
+			Data:   ErrOperationNotFound,
+		})
+		return nil
+	}
+	return op
+}
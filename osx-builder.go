@@ -10,6 +10,8 @@ import (
 	"strings"
 
 	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/vmware"
 	"github.com/c4milo/osx-builder/vms"
 )
 
@@ -17,9 +19,22 @@ import (
 var Version string
 
 func main() {
+	driver, err := vmware.Lookup(config.Driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("[INFO] Using %s driver with capabilities %+v", config.Driver, driver.Capabilities())
+
+	// Loads operations from previous runs, so that they can still be queried.
+	if err := operations.Open(config.OperationsPath); err != nil {
+		log.Fatal(err)
+	}
+
 	// Keeps a registry of path function handlers.
 	registry := map[string]map[string]func(http.ResponseWriter, *http.Request){
-		"/vms": vms.Handlers,
+		"/vms":        vms.Handlers,
+		"/images":     vms.ImageHandlers,
+		"/operations": operations.Handlers,
 	}
 
 	// Main entry point to handle requests. Based on a URL path, this piece of code
@@ -0,0 +1,65 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package lockfile provides exclusive advisory locks on files, to coordinate
+// work among processes sharing the same files.
+package lockfile
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrLocked is returned by TryAcquire if the lock is held by someone else.
+var ErrLocked = errors.New("lockfile: file is locked")
+
+// Lock is an exclusive lock held on a file.
+type Lock struct {
+	file *os.File
+}
+
+// Acquire blocks until an exclusive lock is obtained on the file at the given
+// path, creating the file if it does not exist. Locks are advisory, they only
+// exclude other processes also using this package, and are released by the
+// operating system if the process dies.
+func Acquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// TryAcquire is like Acquire, except that it returns ErrLocked right away
+// instead of waiting if the lock is held by someone else.
+func TryAcquire(path string) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tryLock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// Release releases the lock. The file is left in place, removing it would
+// allow another process to lock a new file while a third one still waits on
+// the old one.
+func (l *Lock) Release() error {
+	if err := unlock(l.file); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
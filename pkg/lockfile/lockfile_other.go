@@ -0,0 +1,27 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lockfile
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("lockfile: file locks are not supported on this platform")
+
+func lock(file *os.File) error {
+	return errUnsupported
+}
+
+func tryLock(file *os.File) error {
+	return errUnsupported
+}
+
+func unlock(file *os.File) error {
+	return errUnsupported
+}
@@ -0,0 +1,69 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package lockfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-lockfile")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.lock")
+	first, err := Acquire(path)
+	ok(t, err)
+
+	acquired := make(chan error)
+	go func() {
+		second, err := Acquire(path)
+		if err == nil {
+			err = second.Release()
+		}
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock was acquired twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ok(t, first.Release())
+
+	select {
+	case err := <-acquired:
+		ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not acquired after being released")
+	}
+
+	_, err = os.Stat(path)
+	ok(t, err)
+}
+
+func TestTryAcquire(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-lockfile")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.lock")
+	first, err := TryAcquire(path)
+	ok(t, err)
+
+	_, err = TryAcquire(path)
+	equals(t, ErrLocked, err)
+
+	ok(t, first.Release())
+
+	second, err := TryAcquire(path)
+	ok(t, err)
+	ok(t, second.Release())
+}
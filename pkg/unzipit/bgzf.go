@@ -0,0 +1,227 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// BGZF is a gzip variant made of independent gzip members, each of them
+// recording its compressed size in an extra field. Members can then be found
+// without decompressing them, and decompressed in parallel. See
+// https://samtools.github.io/hts-specs/SAMv1.pdf, section 4.1.
+const (
+	gzipHeaderSize = 12
+	gzipFlagExtra  = 1 << 2
+)
+
+// isBGZF tells whether the stream starts with a BGZF member.
+func isBGZF(r *bufio.Reader) bool {
+	_, err := bgzfMemberSize(r)
+	return err == nil
+}
+
+// errNotBGZF is returned by bgzfMemberSize if the next gzip member has no
+// BGZF block size.
+var errNotBGZF = errors.New("Not a BGZF member")
+
+// bgzfMemberSize returns the size of the next BGZF member, without consuming
+// it.
+func bgzfMemberSize(r *bufio.Reader) (int, error) {
+	header, err := r.Peek(gzipHeaderSize)
+	if err != nil {
+		if err == io.EOF && len(header) == 0 {
+			return 0, io.EOF
+		}
+		return 0, errNotBGZF
+	}
+
+	if header[0] != 0x1f || header[1] != 0x8b || header[2] != 8 || header[3]&gzipFlagExtra == 0 {
+		return 0, errNotBGZF
+	}
+
+	xlen := int(binary.LittleEndian.Uint16(header[10:]))
+	header, err = r.Peek(gzipHeaderSize + xlen)
+	if err != nil {
+		return 0, errNotBGZF
+	}
+
+	// Looks for the BC subfield holding the member size minus one.
+	extra := header[gzipHeaderSize:]
+	for len(extra) >= 4 {
+		slen := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+slen {
+			break
+		}
+
+		if extra[0] == 'B' && extra[1] == 'C' && slen == 2 {
+			return int(binary.LittleEndian.Uint16(extra[4:])) + 1, nil
+		}
+		extra = extra[4+slen:]
+	}
+
+	return 0, errNotBGZF
+}
+
+// bgzfResult is a BGZF member once decompressed.
+type bgzfResult struct {
+	data []byte
+	err  error
+}
+
+// bgzfReader decompresses BGZF members in parallel, returning their data in
+// order. If a gzip member with no BGZF block size shows up, the rest of the
+// stream is decompressed sequentially.
+type bgzfReader struct {
+	r       *bufio.Reader
+	workers int
+
+	// Members being decompressed, in order
+	pending []chan bgzfResult
+	// Data of the current member not read yet
+	out []byte
+	// Set once there are no more BGZF members to decompress
+	done bool
+	// Sequential reader for whatever follows the BGZF members
+	rest io.Reader
+	err  error
+}
+
+// newBGZFReader returns a reader decompressing BGZF members read from r.
+func newBGZFReader(r *bufio.Reader) *bgzfReader {
+	return &bgzfReader{
+		r:       r,
+		workers: runtime.NumCPU(),
+	}
+}
+
+// Implements io.Reader interface.
+func (z *bgzfReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+
+		z.fill()
+
+		if len(z.pending) == 0 {
+			if z.rest != nil {
+				return z.rest.Read(p)
+			}
+			return 0, io.EOF
+		}
+
+		result := <-z.pending[0]
+		z.pending = z.pending[1:]
+		if result.err != nil {
+			z.err = result.err
+			return 0, z.err
+		}
+		z.out = result.data
+	}
+
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// fill starts decompressing members until as many as twice the number of
+// workers are in flight, so that workers are kept busy while the data of
+// earlier members is read.
+func (z *bgzfReader) fill() {
+	for !z.done && len(z.pending) < 2*z.workers {
+		size, err := bgzfMemberSize(z.r)
+		if err == io.EOF {
+			z.done = true
+			return
+		}
+
+		if err == errNotBGZF {
+			z.done = true
+			z.rest = z.sequential()
+			return
+		}
+
+		member := make([]byte, size)
+		if _, err := io.ReadFull(z.r, member); err != nil {
+			z.done = true
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			z.pending = append(z.pending, failed(err))
+			return
+		}
+
+		result := make(chan bgzfResult, 1)
+		z.pending = append(z.pending, result)
+		go func() {
+			data, err := gunzipMember(member)
+			result <- bgzfResult{data, err}
+		}()
+	}
+}
+
+// sequential returns a reader decompressing the rest of the stream, which is
+// not made of BGZF members.
+func (z *bgzfReader) sequential() io.Reader {
+	gr, err := gzip.NewReader(z.r)
+	if err != nil {
+		return &errReader{err}
+	}
+	return gr
+}
+
+// maxBGZFMemberData is the most data a BGZF member can hold, as the
+// specification caps it at 64KiB, guarding against members crafted to
+// decompress into large amounts of memory.
+const maxBGZFMemberData = 64 << 10
+
+// errBGZFMemberTooBig is returned when a BGZF member decompresses into more
+// than maxBGZFMemberData bytes.
+var errBGZFMemberTooBig = errors.New("BGZF member decompresses into more than 64KiB")
+
+// gunzipMember decompresses a single gzip member, checking its CRC.
+func gunzipMember(member []byte) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(member))
+	if err != nil {
+		return nil, err
+	}
+	gr.Multistream(false)
+
+	data, err := ioutil.ReadAll(io.LimitReader(gr, maxBGZFMemberData+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxBGZFMemberData {
+		return nil, errBGZFMemberTooBig
+	}
+	return data, nil
+}
+
+// failed returns a result channel holding an error.
+func failed(err error) chan bgzfResult {
+	result := make(chan bgzfResult, 1)
+	result <- bgzfResult{err: err}
+	return result
+}
+
+// errReader is a reader that always fails.
+type errReader struct {
+	err error
+}
+
+// Implements io.Reader interface.
+func (r *errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,191 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// bgzfBlockSize is the amount of data per member used by bgzip.
+const bgzfBlockSize = 0xff00
+
+// writeBGZF compresses data as BGZF, like bgzip does, including the empty
+// member marking the end of the stream.
+func writeBGZF(tb testing.TB, w io.Writer, data []byte) {
+	for {
+		n := bgzfBlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+
+		buf := new(bytes.Buffer)
+		gw, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		ok(tb, err)
+		gw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		_, err = gw.Write(data[:n])
+		ok(tb, err)
+		ok(tb, gw.Close())
+
+		member := buf.Bytes()
+		binary.LittleEndian.PutUint16(member[16:], uint16(len(member)-1))
+		_, err = w.Write(member)
+		ok(tb, err)
+
+		if n == 0 {
+			return
+		}
+		data = data[n:]
+	}
+}
+
+func TestGunzipStreamBGZF(t *testing.T) {
+	tarball, err := ioutil.ReadFile("./fixtures/test.tar")
+	ok(t, err)
+
+	file, err := os.Open("./fixtures/test.tar.bgzf.gz")
+	ok(t, err)
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	assert(t, isBGZF(r), "fixture should be detected as BGZF")
+
+	gr, err := GunzipStream(r)
+	ok(t, err)
+	data, err := ioutil.ReadAll(gr)
+	ok(t, err)
+	assert(t, bytes.Equal(tarball, data), "decompressed data does not match")
+
+	// Regular gzip members following BGZF ones are decompressed as well.
+	buf := new(bytes.Buffer)
+	writeBGZF(t, buf, tarball[:100000])
+	gw := gzip.NewWriter(buf)
+	_, err = gw.Write(tarball[100000:])
+	ok(t, err)
+	ok(t, gw.Close())
+
+	gr, err = GunzipStream(bytes.NewReader(buf.Bytes()))
+	ok(t, err)
+	data, err = ioutil.ReadAll(gr)
+	ok(t, err)
+	assert(t, bytes.Equal(tarball, data), "decompressed data does not match")
+
+	// Corrupt members are caught by their CRC.
+	buf.Reset()
+	writeBGZF(t, buf, tarball)
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	gr, err = GunzipStream(bytes.NewReader(corrupt))
+	ok(t, err)
+	_, err = ioutil.ReadAll(gr)
+	assert(t, err != nil, "corrupt member should fail")
+
+	// So are truncated streams.
+	gr, err = GunzipStream(bytes.NewReader(buf.Bytes()[:buf.Len()-100]))
+	ok(t, err)
+	_, err = ioutil.ReadAll(gr)
+	equals(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestGunzipStreamBGZFMemberTooBig(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gw, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	ok(t, err)
+	gw.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	_, err = gw.Write(make([]byte, 16<<20))
+	ok(t, err)
+	ok(t, gw.Close())
+
+	member := buf.Bytes()
+	binary.LittleEndian.PutUint16(member[16:], uint16(len(member)-1))
+
+	gr, err := GunzipStream(bytes.NewReader(member))
+	ok(t, err)
+	_, err = ioutil.ReadAll(gr)
+	equals(t, errBGZFMemberTooBig, err)
+}
+
+// benchmarkData returns size bytes of somewhat compressible data.
+func benchmarkData(size int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"osx", "builder", "vmware", "gold", "image", "disk", "vmdk", "snapshot", "clone"}
+
+	buf := new(bytes.Buffer)
+	for buf.Len() < size {
+		fmt.Fprintf(buf, "%s %d\n", words[rnd.Intn(len(words))], rnd.Intn(1000))
+	}
+	return buf.Bytes()[:size]
+}
+
+// BenchmarkGunzip compares the standard library gzip reader with
+// GunzipStream, for the existing fixtures as well as for a bigger BGZF
+// stream that is decompressed in parallel.
+func BenchmarkGunzip(b *testing.B) {
+	bigData := benchmarkData(64 << 20)
+
+	big := new(bytes.Buffer)
+	gw := gzip.NewWriter(big)
+	_, err := gw.Write(bigData)
+	ok(b, err)
+	ok(b, gw.Close())
+
+	bigBGZF := new(bytes.Buffer)
+	writeBGZF(b, bigBGZF, bigData)
+
+	inputs := []struct {
+		name string
+		data []byte
+	}{
+		{"test.tar.gz", nil},
+		{"test2.tar.gz", nil},
+		{"test.tar.bgzf.gz", nil},
+		{"big.gz", big.Bytes()},
+		{"big.bgzf.gz", bigBGZF.Bytes()},
+	}
+
+	readers := []struct {
+		name string
+		open func(io.Reader) (io.Reader, error)
+	}{
+		{"stdlib", func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}},
+		{"unzipit", func(r io.Reader) (io.Reader, error) {
+			return GunzipStream(r)
+		}},
+	}
+
+	for _, input := range inputs {
+		data := input.data
+		if data == nil {
+			var err error
+			data, err = ioutil.ReadFile("./fixtures/" + input.name)
+			ok(b, err)
+		}
+
+		for _, reader := range readers {
+			b.Run(input.name+"/"+reader.name, func(b *testing.B) {
+				var size int64
+				for i := 0; i < b.N; i++ {
+					r, err := reader.open(bytes.NewReader(data))
+					ok(b, err)
+
+					size, err = io.Copy(ioutil.Discard, r)
+					ok(b, err)
+				}
+				b.SetBytes(size)
+			})
+		}
+	}
+}
@@ -0,0 +1,445 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Limits bounds what unpacking an archive may produce, so that archives
+// crafted to fill up the disk, i.e.: zip bombs, are stopped early. Zero
+// values mean no limit.
+type Limits struct {
+	// Maximum number of bytes extracted
+	MaxBytes int64
+	// Maximum number of entries extracted
+	MaxEntries int64
+	// Maximum ratio between the number of bytes extracted and the number of
+	// compressed bytes read
+	MaxRatio int64
+}
+
+// DefaultLimits are the limits used by the functions not taking any. They are
+// generous enough for virtual machine images, whose disks often compress
+// extremely well.
+var DefaultLimits = Limits{
+	MaxBytes:   512 << 30,
+	MaxEntries: 100000,
+	MaxRatio:   10000,
+}
+
+// Options tunes how an archive is unpacked. The zero value extracts
+// everything with no limits at all, DefaultLimits is usually what is wanted.
+type Options struct {
+	// Limits bounds what unpacking the archive may produce
+	Limits Limits
+	// Filter tells whether to extract an entry. Entries filtered out are not
+	// passed to OnEntry and do not count towards the limits.
+	Filter func(Entry) bool
+	// OnEntry is called for each entry right before extracting it
+	OnEntry func(Entry)
+	// OnProgress is called as entries and data are extracted, which may be
+	// very often. Callers report it as often as they see fit.
+	OnProgress func(Progress)
+}
+
+// Entry describes an archive entry, as passed to the callbacks in Options.
+type Entry struct {
+	// Name of the entry in the archive
+	Name string
+	// Slash separated path the entry is extracted to, relative to the
+	// destination directory
+	Path string
+	// Size of the entry data, zero if unknown or for anything but regular
+	// files
+	Size int64
+	// File mode and type bits, i.e.: os.ModeDir or os.ModeSymlink. Hard
+	// links have no type bits, like regular files, but have a Linkname.
+	Mode os.FileMode
+	// Target of symlinks and hard links, if known before extracting them
+	Linkname string
+	// Modification time, zero if unknown
+	ModTime time.Time
+}
+
+// Result describes what extracting an archive produced.
+type Result struct {
+	// The only top level directory extracted, if everything else was
+	// extracted into it, or the destination directory otherwise
+	RootDir string
+	// Entries extracted, in the order they were found in the archive
+	Entries []Entry
+	// Bytes extracted, over all entries
+	TotalBytes int64
+}
+
+// Progress is how far unpacking an archive got.
+type Progress struct {
+	// Bytes read from the archive so far, compressed. For zip archives and
+	// ISO images, which are not read sequentially, bytes of the entries
+	// extracted so far.
+	BytesRead int64
+	// Bytes extracted so far
+	BytesWritten int64
+	// Entries extracted so far
+	Entries int64
+}
+
+// The compression ratio is only checked once this many bytes are extracted,
+// as archive headers alone make small archives look much bigger than they
+// are compressed.
+const minRatioBytes = 1 << 20
+
+// Kinds of limits, as reported by LimitError.
+const (
+	LimitBytes   = "bytes"
+	LimitEntries = "entries"
+	LimitRatio   = "ratio"
+)
+
+// LimitError is returned when unpacking an archive goes over one of its
+// Limits.
+type LimitError struct {
+	// Limit exceeded, one of LimitBytes, LimitEntries or LimitRatio
+	Limit string
+	// Value of the limit
+	Max int64
+}
+
+// Implements Error interface.
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case LimitBytes:
+		return fmt.Sprintf("unzipit: archive unpacks to more than %d bytes", e.Max)
+	case LimitEntries:
+		return fmt.Sprintf("unzipit: archive has more than %d entries", e.Max)
+	default:
+		return fmt.Sprintf("unzipit: archive has a compression ratio bigger than %d", e.Max)
+	}
+}
+
+// UnsafePathError is returned when an archive entry would end up outside of
+// the destination directory, either because of its name or because of the
+// symlinks in the archive.
+type UnsafePathError struct {
+	// Name of the entry in the archive
+	Name string
+}
+
+// Implements Error interface.
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("unzipit: %s resolves outside of the destination directory", e.Name)
+}
+
+// Symlinks followed when resolving a path before giving up, like Linux does.
+const maxLinks = 40
+
+// extractor keeps archive entries within destPath and enforces limits while
+// unpacking an archive, stopping as soon as ctx is done.
+type extractor struct {
+	ctx      context.Context
+	destPath string
+	opts     Options
+
+	// Compressed input, to compute the compression ratio. If nil,
+	// compressed holds the number of compressed bytes instead, and read
+	// the number of bytes read so far.
+	input      *countingReader
+	compressed int64
+	read       int64
+
+	entries   int64
+	written   int64
+	extracted []Entry
+	// Symlinks extracted so far, relative to destPath
+	links []string
+}
+
+// newExtractor returns an extractor unpacking into destPath.
+func newExtractor(ctx context.Context, destPath string, opts Options, input *countingReader) *extractor {
+	return &extractor{
+		ctx:      ctx,
+		destPath: filepath.Clean(destPath),
+		opts:     opts,
+		input:    input,
+	}
+}
+
+// entry accounts for a new archive entry, returning the path to extract it
+// to, or an empty path if the entry is filtered out.
+func (x *extractor) entry(e Entry) (string, error) {
+	if err := x.ctx.Err(); err != nil {
+		return "", err
+	}
+
+	path, err := x.resolve(e.Name)
+	if err != nil {
+		return "", err
+	}
+	e.Path = sanitize(e.Name)
+
+	if x.opts.Filter != nil && !x.opts.Filter(e) {
+		return "", nil
+	}
+
+	x.entries++
+	if max := x.opts.Limits.MaxEntries; max > 0 && x.entries > max {
+		return "", &LimitError{LimitEntries, max}
+	}
+
+	if x.opts.OnEntry != nil {
+		x.opts.OnEntry(e)
+	}
+
+	// Entries without name stand for destPath itself.
+	if path != x.destPath {
+		x.extracted = append(x.extracted, e)
+	}
+	x.progress()
+	return path, nil
+}
+
+// result returns what was extracted so far.
+func (x *extractor) result() *Result {
+	return &Result{
+		RootDir:    x.rootDir(),
+		Entries:    x.extracted,
+		TotalBytes: x.written,
+	}
+}
+
+// rootDir returns the only top level directory extracted, if everything
+// else was extracted into it, or destPath otherwise.
+func (x *extractor) rootDir() string {
+	root := ""
+	for _, e := range x.extracted {
+		parts := strings.SplitN(e.Path, "/", 2)
+		if len(parts) == 1 && !e.Mode.IsDir() {
+			return x.destPath
+		}
+
+		if root != "" && root != parts[0] {
+			return x.destPath
+		}
+		root = parts[0]
+	}
+
+	if root == "" {
+		return x.destPath
+	}
+	return filepath.Join(x.destPath, filepath.FromSlash(root))
+}
+
+// Implements io.Writer interface, accounting for extracted bytes. The data is
+// not written anywhere.
+func (x *extractor) Write(p []byte) (int, error) {
+	if err := x.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	limits := x.opts.Limits
+	x.written += int64(len(p))
+	if limits.MaxBytes > 0 && x.written > limits.MaxBytes {
+		return 0, &LimitError{LimitBytes, limits.MaxBytes}
+	}
+
+	compressed := x.compressed
+	if x.input != nil {
+		compressed = x.input.n
+	}
+
+	if limits.MaxRatio > 0 && x.written > minRatioBytes && x.written/limits.MaxRatio > compressed {
+		return 0, &LimitError{LimitRatio, limits.MaxRatio}
+	}
+
+	x.progress()
+	return len(p), nil
+}
+
+// progress reports how far unpacking got, if asked to.
+func (x *extractor) progress() {
+	if x.opts.OnProgress == nil {
+		return
+	}
+
+	read := x.read
+	if x.input != nil {
+		read = x.input.n
+	}
+
+	x.opts.OnProgress(Progress{
+		BytesRead:    read,
+		BytesWritten: x.written,
+		Entries:      x.entries,
+	})
+}
+
+// copy copies r into w, within the limits.
+func (x *extractor) copy(w io.Writer, r io.Reader) error {
+	_, err := io.Copy(io.MultiWriter(x, w), r)
+	return err
+}
+
+// resolve returns the path where an entry named name is extracted to. It
+// fails if the name is absolute or goes up out of destPath, or if the
+// directory holding the entry is not within destPath once the symlinks
+// extracted so far are followed. The entry itself is not followed, as it is
+// replaced when extracted.
+func (x *extractor) resolve(name string) (string, error) {
+	if escapes(name) {
+		return "", &UnsafePathError{name}
+	}
+
+	rel := sanitize(name)
+	if _, err := x.follow(path.Dir(rel)); err != nil {
+		return "", &UnsafePathError{name}
+	}
+	return filepath.Join(x.destPath, filepath.FromSlash(rel)), nil
+}
+
+// linkTarget returns the file a hard link entry named name links to, which
+// must have been extracted already.
+func (x *extractor) linkTarget(name, linkname string) (string, error) {
+	if escapes(linkname) {
+		return "", &UnsafePathError{name}
+	}
+
+	rel, err := x.follow(sanitize(linkname))
+	if err != nil {
+		return "", &UnsafePathError{name}
+	}
+	return filepath.Join(x.destPath, rel), nil
+}
+
+// escapes tells whether an archive entry name is absolute or goes up out of
+// the directory it is extracted into. Backslashes are taken as separators
+// too, as they are on Windows.
+func escapes(name string) bool {
+	clean := path.Clean(strings.Replace(name, "\\", "/", -1))
+	return path.IsAbs(clean) || filepath.VolumeName(name) != "" ||
+		clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// follow resolves rel, a slash separated path relative to destPath, the way
+// the OS would, failing if it ever goes out of destPath. Parts of the path
+// that do not exist yet are resolved lexically. It returns the resolved
+// path, relative to destPath.
+func (x *extractor) follow(rel string) (string, error) {
+	var resolved []string
+	pending := strings.Split(filepath.ToSlash(rel), "/")
+	links := 0
+
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", errEscapes
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := filepath.Join(x.destPath, filepath.Join(resolved...), name)
+		finfo, err := os.Lstat(current)
+		if err != nil || finfo.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+
+		links++
+		if links > maxLinks {
+			return "", errEscapes
+		}
+
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+
+		// Absolute targets would break once the image is moved anyway.
+		if filepath.IsAbs(target) || strings.HasPrefix(target, "/") {
+			return "", errEscapes
+		}
+		pending = append(strings.Split(filepath.ToSlash(target), "/"), pending...)
+	}
+
+	return filepath.Join(resolved...), nil
+}
+
+// errEscapes is returned by follow when a path goes out of destPath.
+var errEscapes = errors.New("path escapes the destination directory")
+
+// symlink creates a symlink for the entry name at path, removing it again if
+// it points outside destPath.
+func (x *extractor) symlink(name, target, path string) error {
+	if err := os.Symlink(target, path); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(x.destPath, path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := x.follow(rel); err != nil {
+		os.Remove(path)
+		return &UnsafePathError{name}
+	}
+
+	x.links = append(x.links, rel)
+	return nil
+}
+
+// checkLinks makes sure all symlinks extracted still point within destPath.
+// A symlink found safe when extracted may not be once symlinks it goes
+// through are replaced by later entries.
+func (x *extractor) checkLinks() error {
+	for _, rel := range x.links {
+		if _, err := x.follow(rel); err != nil {
+			return &UnsafePathError{filepath.ToSlash(rel)}
+		}
+	}
+	return nil
+}
+
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Implements io.Reader interface.
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Implements io.Reader interface.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
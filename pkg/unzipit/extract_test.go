@@ -0,0 +1,436 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEntry is an entry of the archives made by makeTar and makeZip.
+type testEntry struct {
+	typeflag byte
+	name     string
+	linkname string
+	body     string
+}
+
+// makeTar returns a tar archive with the given entries.
+func makeTar(t *testing.T, entries []testEntry) []byte {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Typeflag: entry.typeflag,
+			Name:     entry.name,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		}
+		ok(t, tw.WriteHeader(hdr))
+
+		_, err := tw.Write([]byte(entry.body))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+	return buf.Bytes()
+}
+
+// makeZip returns a zip archive with the given entries, symlinks included.
+func makeZip(t *testing.T, entries []testEntry) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, entry := range entries {
+		fh := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		fh.SetMode(0644)
+
+		body := entry.body
+		if entry.typeflag == tar.TypeSymlink {
+			fh.SetMode(os.ModeSymlink | 0777)
+			body = entry.linkname
+		}
+
+		w, err := zw.CreateHeader(fh)
+		ok(t, err)
+		_, err = w.Write([]byte(body))
+		ok(t, err)
+	}
+	ok(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestUnsafeArchives(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		entries []testEntry
+		zip     bool
+	}{
+		{"parent directory", []testEntry{
+			{tar.TypeReg, "a/../../etc/passwd", "", "root"},
+		}, true},
+		{"absolute path", []testEntry{
+			{tar.TypeReg, "/etc/passwd", "", "root"},
+		}, true},
+		{"absolute symlink", []testEntry{
+			{tar.TypeSymlink, "etc", "/etc", ""},
+		}, true},
+		{"relative symlink", []testEntry{
+			{tar.TypeDir, "box/", "", ""},
+			{tar.TypeSymlink, "box/etc", "../../etc", ""},
+		}, true},
+		{"file through symlink", []testEntry{
+			{tar.TypeSymlink, "up", "here/..", ""},
+			{tar.TypeSymlink, "here", ".", ""},
+			{tar.TypeReg, "up/passwd", "", "root"},
+		}, true},
+		{"symlink through symlink", []testEntry{
+			{tar.TypeSymlink, "here", ".", ""},
+			{tar.TypeSymlink, "up", "here/..", ""},
+		}, true},
+		{"symlink made unsafe later", []testEntry{
+			{tar.TypeSymlink, "up", "here/..", ""},
+			{tar.TypeSymlink, "here", ".", ""},
+		}, true},
+		{"hard link", []testEntry{
+			{tar.TypeLink, "passwd", "../etc/passwd", ""},
+		}, false},
+		{"hard link through symlink", []testEntry{
+			{tar.TypeSymlink, "up", "here/..", ""},
+			{tar.TypeSymlink, "here", ".", ""},
+			{tar.TypeLink, "passwd", "up/passwd", ""},
+		}, false},
+	}
+
+	for _, test := range tests {
+		parent, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-unsafe-")
+		ok(t, err)
+		defer os.RemoveAll(parent)
+
+		destDir := filepath.Join(parent, "dest")
+
+		_, err = Untar(bytes.NewReader(makeTar(t, test.entries)), destDir)
+		_, unsafe := err.(*UnsafePathError)
+		assert(t, unsafe, "%s: tar should be refused, got %v", test.desc, err)
+
+		if test.zip {
+			destDir = filepath.Join(parent, "zip")
+
+			_, err = UnzipStream(bytes.NewReader(makeZip(t, test.entries)), destDir)
+			_, unsafe := err.(*UnsafePathError)
+			assert(t, unsafe, "%s: zip should be refused, got %v", test.desc, err)
+		}
+
+		files, err := ioutil.ReadDir(parent)
+		ok(t, err)
+		for _, finfo := range files {
+			assert(t, finfo.Name() == "dest" || finfo.Name() == "zip",
+				"%s: %s was extracted outside the destination directory", test.desc, finfo.Name())
+		}
+	}
+}
+
+func TestSafeSymlinks(t *testing.T) {
+	entries := []testEntry{
+		{tar.TypeDir, "box/", "", ""},
+		{tar.TypeReg, "box/disk.vmdk", "", "disk"},
+		{tar.TypeSymlink, "box/current.vmdk", "disk.vmdk", ""},
+		{tar.TypeSymlink, "latest", "box/../box/current.vmdk", ""},
+		{tar.TypeSymlink, "dangling", "box/missing/../disk.vmdk", ""},
+		{tar.TypeLink, "backup.vmdk", "latest", ""},
+	}
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-safe-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	_, err = Untar(bytes.NewReader(makeTar(t, entries)), destDir)
+	ok(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "backup.vmdk"))
+	ok(t, err)
+	equals(t, "disk", string(data))
+}
+
+func TestLimits(t *testing.T) {
+	zeros := make([]byte, 4<<20)
+
+	compressed := new(bytes.Buffer)
+	gw := gzip.NewWriter(compressed)
+	_, err := gw.Write(makeTar(t, []testEntry{{tar.TypeReg, "zeros", "", string(zeros)}}))
+	ok(t, err)
+	ok(t, gw.Close())
+
+	many := makeTar(t, []testEntry{
+		{tar.TypeReg, "a", "", "a"},
+		{tar.TypeReg, "b", "", "b"},
+		{tar.TypeReg, "c", "", "c"},
+	})
+
+	var tests = []struct {
+		data   []byte
+		limits Limits
+		limit  string
+	}{
+		{compressed.Bytes(), Limits{MaxBytes: 1 << 20}, LimitBytes},
+		{compressed.Bytes(), Limits{MaxRatio: 100}, LimitRatio},
+		{compressed.Bytes(), DefaultLimits, ""},
+		{many, Limits{MaxEntries: 2}, LimitEntries},
+		{many, Limits{MaxEntries: 3}, ""},
+		{makeZip(t, []testEntry{{tar.TypeReg, "zeros", "", string(zeros)}}), Limits{MaxRatio: 100}, LimitRatio},
+	}
+
+	for _, test := range tests {
+		destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-limits-")
+		ok(t, err)
+		defer os.RemoveAll(destDir)
+
+		_, err = UnpackStreamWithLimits(bytes.NewReader(test.data), destDir, test.limits)
+		if test.limit == "" {
+			ok(t, err)
+			continue
+		}
+
+		lerr, isLimit := err.(*LimitError)
+		assert(t, isLimit, "expected a %s limit error, got %v", test.limit, err)
+		equals(t, test.limit, lerr.Limit)
+	}
+}
+
+func TestUnpackOptions(t *testing.T) {
+	entries := []testEntry{
+		{tar.TypeReg, "box/box.vmx", "", "numvcpus = 2"},
+		{tar.TypeReg, "box/disk.vmdk", "", "disk"},
+		{tar.TypeReg, "box/box.vmx.lck", "", "lock"},
+	}
+
+	var tests = []struct {
+		desc string
+		data []byte
+	}{
+		{"tar", makeTar(t, entries)},
+		{"zip", makeZip(t, entries)},
+	}
+
+	for _, test := range tests {
+		destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-options-")
+		ok(t, err)
+		defer os.RemoveAll(destDir)
+
+		var seen []Entry
+		var last Progress
+		opts := Options{
+			Filter: func(e Entry) bool {
+				return !strings.HasSuffix(e.Name, ".lck")
+			},
+			OnEntry: func(e Entry) {
+				seen = append(seen, e)
+			},
+			OnProgress: func(p Progress) {
+				assert(t, p.BytesWritten >= last.BytesWritten, "%s: progress went backwards", test.desc)
+				last = p
+			},
+		}
+
+		_, err = UnpackStreamContext(context.Background(), bytes.NewReader(test.data), destDir, opts)
+		ok(t, err)
+
+		equals(t, 2, len(seen))
+		equals(t, "box/box.vmx", seen[0].Name)
+		equals(t, int64(len("numvcpus = 2")), seen[0].Size)
+		equals(t, "box/disk.vmdk", seen[1].Name)
+		assert(t, seen[1].Mode.IsRegular(), "%s: unexpected mode %s", test.desc, seen[1].Mode)
+
+		equals(t, int64(2), last.Entries)
+		equals(t, int64(len("numvcpus = 2")+len("disk")), last.BytesWritten)
+		assert(t, last.BytesRead > 0, "%s: no bytes read reported", test.desc)
+
+		_, err = os.Stat(filepath.Join(destDir, "box", "box.vmx.lck"))
+		assert(t, os.IsNotExist(err), "%s: filtered entry was extracted", test.desc)
+	}
+}
+
+func TestUnpackCanceled(t *testing.T) {
+	data := makeTar(t, []testEntry{
+		{tar.TypeReg, "a", "", "a"},
+		{tar.TypeReg, "b", "", "b"},
+		{tar.TypeReg, "c", "", "c"},
+	})
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-canceled-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	opts := Options{
+		OnEntry: func(e Entry) {
+			if e.Name == "b" {
+				cancel()
+			}
+		},
+	}
+
+	_, err = UntarContext(ctx, bytes.NewReader(data), destDir, opts)
+	equals(t, context.Canceled, err)
+
+	_, err = os.Stat(filepath.Join(destDir, "a"))
+	ok(t, err)
+	_, err = os.Stat(filepath.Join(destDir, "c"))
+	assert(t, os.IsNotExist(err), "entries after cancellation were extracted")
+
+	// Streams stop being read as soon as the context is done.
+	_, err = UnpackStreamContext(ctx, bytes.NewReader(data), destDir, Options{})
+	equals(t, context.Canceled, err)
+}
+
+func TestExtract(t *testing.T) {
+	entries := []testEntry{
+		{tar.TypeDir, "box.vmwarevm/", "", ""},
+		{tar.TypeReg, "box.vmwarevm/box.vmx", "", "numvcpus = 2"},
+		{tar.TypeReg, "box.vmwarevm/disk.vmdk", "", "disk"},
+		{tar.TypeSymlink, "box.vmwarevm/current.vmx", "box.vmx", ""},
+	}
+
+	var tests = []struct {
+		desc    string
+		data    []byte
+		entries []testEntry
+		root    string
+	}{
+		{"tar", makeTar(t, entries), entries, "box.vmwarevm"},
+		{"zip", makeZip(t, entries[1:]), entries[1:], "box.vmwarevm"},
+		{"no root directory", makeTar(t, append(entries, testEntry{tar.TypeReg, "README", "", "readme"})), nil, ""},
+	}
+
+	for _, test := range tests {
+		destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-extract-")
+		ok(t, err)
+		defer os.RemoveAll(destDir)
+
+		result, err := ExtractStream(context.Background(), bytes.NewReader(test.data), destDir, Options{})
+		ok(t, err)
+		equals(t, filepath.Join(destDir, filepath.FromSlash(test.root)), result.RootDir)
+
+		if test.entries == nil {
+			continue
+		}
+
+		equals(t, len(test.entries), len(result.Entries))
+		var total int64
+		for i, entry := range test.entries {
+			extracted := result.Entries[i]
+			equals(t, strings.TrimSuffix(entry.name, "/"), extracted.Path)
+			equals(t, int64(len(entry.body)), extracted.Size)
+			total += extracted.Size
+
+			switch entry.typeflag {
+			case tar.TypeDir:
+				assert(t, extracted.Mode.IsDir(), "%s: %s should be a directory", test.desc, entry.name)
+			case tar.TypeSymlink:
+				assert(t, extracted.Mode&os.ModeSymlink != 0, "%s: %s should be a symlink", test.desc, entry.name)
+			default:
+				assert(t, extracted.Mode.IsRegular(), "%s: %s should be a regular file", test.desc, entry.name)
+			}
+		}
+		equals(t, total, result.TotalBytes)
+	}
+}
+
+func TestExtractFile(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-extract-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	for _, fixture := range []string{"./fixtures/test.tar.gz", "./fixtures/cfgdrv.iso"} {
+		file, err := os.Open(fixture)
+		ok(t, err)
+		defer file.Close()
+
+		dest := filepath.Join(destDir, filepath.Base(fixture))
+		result, err := Extract(context.Background(), file, dest, Options{})
+		ok(t, err)
+		assert(t, len(result.Entries) > 0, "%s: no entries extracted", fixture)
+
+		for _, entry := range result.Entries {
+			finfo, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(entry.Path)))
+			ok(t, err)
+			equals(t, entry.Mode.IsDir(), finfo.IsDir())
+			if entry.Mode.IsRegular() {
+				equals(t, entry.Size, finfo.Size())
+			}
+		}
+	}
+}
+
+func TestExtractZipFile(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-extract-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// ZIP archives on disk are not copied to a temporary file.
+	tmpDir := filepath.Join(destDir, "tmp")
+	ok(t, os.Mkdir(tmpDir, 0700))
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	ok(t, os.Setenv("TMPDIR", tmpDir))
+
+	file, err := os.Open("./fixtures/test.zip")
+	ok(t, err)
+	defer file.Close()
+
+	opts := Options{
+		OnEntry: func(e Entry) {
+			files, err := ioutil.ReadDir(tmpDir)
+			ok(t, err)
+			equals(t, 0, len(files))
+		},
+	}
+
+	result, err := Extract(context.Background(), file, filepath.Join(destDir, "dest"), opts)
+	ok(t, err)
+	assert(t, len(result.Entries) > 0, "no entries extracted")
+}
+
+func TestExtractClosesFiles(t *testing.T) {
+	if _, err := os.Stat("/proc/self/fd"); err != nil {
+		t.Skip("open files can't be counted in this system")
+	}
+
+	var entries []testEntry
+	for i := 0; i < 500; i++ {
+		entries = append(entries, testEntry{tar.TypeReg, fmt.Sprintf("file%d", i), "", "data"})
+	}
+
+	for _, data := range [][]byte{makeTar(t, entries), makeZip(t, entries)} {
+		destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-files-")
+		ok(t, err)
+		defer os.RemoveAll(destDir)
+
+		var maxOpen int
+		opts := Options{
+			OnEntry: func(e Entry) {
+				fds, err := ioutil.ReadDir("/proc/self/fd")
+				ok(t, err)
+				if len(fds) > maxOpen {
+					maxOpen = len(fds)
+				}
+			},
+		}
+
+		result, err := ExtractStream(context.Background(), bytes.NewReader(data), destDir, opts)
+		ok(t, err)
+		equals(t, len(entries), len(result.Entries))
+		assert(t, maxOpen < 50, "files were left open while extracting: %d", maxOpen)
+	}
+}
@@ -0,0 +1,206 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnpackISOFixture(t *testing.T) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-iso-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	file, err := os.Open("./fixtures/cfgdrv.iso")
+	ok(t, err)
+	defer file.Close()
+
+	_, err = UnpackISO(file, destDir)
+	ok(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "openstack", "latest", "user_data"))
+	ok(t, err)
+	assert(t, strings.HasPrefix(string(data), "#cloud-config"), "unexpected user_data: %q", data)
+}
+
+// makeISOTree creates the files going into the ISO images of the tests.
+func makeISOTree(t *testing.T, srcDir string, mtime time.Time) {
+	files := []struct {
+		name string
+		mode os.FileMode
+		body string
+	}{
+		{"openstack/latest/meta_data.json", 0644, `{"uuid": "box"}`},
+		{"openstack/latest/user_data", 0600, "#cloud-config"},
+		{"scripts/provision.sh", 0755, "#!/bin/sh"},
+		{"a very long name that does not fit in 8.3.txt", 0644, "long"},
+		{"a very long name that does not fit in 8.3.TXT", 0644, "LONG"},
+		{"réglages.plist", 0644, "<plist/>"},
+	}
+
+	for _, file := range files {
+		path := filepath.Join(srcDir, filepath.FromSlash(file.name))
+		ok(t, os.MkdirAll(filepath.Dir(path), 0755))
+		ok(t, ioutil.WriteFile(path, []byte(file.body), file.mode))
+		ok(t, os.Chmod(path, file.mode))
+		ok(t, os.Chtimes(path, mtime, mtime))
+	}
+
+	ok(t, os.Symlink("latest", filepath.Join(srcDir, "openstack", "current")))
+	for _, dir := range []string{"openstack/latest", "openstack", "scripts", "."} {
+		ok(t, os.Chtimes(filepath.Join(srcDir, dir), mtime, mtime))
+	}
+}
+
+func TestWriteISO(t *testing.T) {
+	mtime := time.Date(2016, 2, 14, 8, 45, 12, 0, time.UTC)
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-iso-")
+	ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	makeISOTree(t, srcDir, mtime)
+
+	var tests = []struct {
+		desc      string
+		rockRidge bool
+		joliet    bool
+	}{
+		{"rock ridge and joliet", true, true},
+		{"rock ridge", true, false},
+		{"joliet", false, true},
+		{"plain", false, false},
+	}
+
+	for _, test := range tests {
+		iw := &isoWriter{volumeID: "config-2", rockRidge: test.rockRidge, joliet: test.joliet}
+		buf := new(bytes.Buffer)
+		ok(t, iw.write(buf, srcDir))
+		equals(t, 0, buf.Len()%isoSectorSize)
+		assert(t, isISO(bytes.NewReader(buf.Bytes())), "%s: not recognized as an ISO image", test.desc)
+
+		destDir := filepath.Join(tmpDir, strings.Replace(test.desc, " ", "-", -1))
+		_, err := UnpackISOStream(bytes.NewReader(buf.Bytes()), destDir)
+		ok(t, err)
+
+		if !test.rockRidge && !test.joliet {
+			// Only mangled names are left.
+			data, err := ioutil.ReadFile(filepath.Join(destDir, "OPENSTAC", "LATEST", "USER_DAT"))
+			ok(t, err)
+			equals(t, "#cloud-config", string(data))
+			continue
+		}
+
+		for name, body := range map[string]string{
+			"openstack/latest/user_data":                    "#cloud-config",
+			"scripts/provision.sh":                          "#!/bin/sh",
+			"a very long name that does not fit in 8.3.txt": "long",
+			"a very long name that does not fit in 8.3.TXT": "LONG",
+			"réglages.plist":                                "<plist/>",
+		} {
+			data, err := ioutil.ReadFile(filepath.Join(destDir, filepath.FromSlash(name)))
+			ok(t, err)
+			equals(t, body, string(data))
+		}
+
+		if !test.rockRidge {
+			continue
+		}
+
+		for name, mode := range map[string]os.FileMode{
+			"openstack/latest/user_data": 0600,
+			"scripts/provision.sh":       0755,
+			"openstack":                  os.ModeDir | 0755,
+		} {
+			finfo, err := os.Lstat(filepath.Join(destDir, filepath.FromSlash(name)))
+			ok(t, err)
+			equals(t, mode, finfo.Mode())
+			assert(t, finfo.ModTime().Equal(mtime), "%s: %s modification time not restored: %s", test.desc, name, finfo.ModTime())
+		}
+
+		target, err := os.Readlink(filepath.Join(destDir, "openstack", "current"))
+		ok(t, err)
+		equals(t, "latest", target)
+	}
+}
+
+func TestUnpackStreamISO(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-iso-")
+	ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	makeISOTree(t, srcDir, time.Now())
+
+	compressed := new(bytes.Buffer)
+	gw := gzip.NewWriter(compressed)
+	ok(t, WriteISO(gw, srcDir, "cidata"))
+	ok(t, gw.Close())
+
+	destDir := filepath.Join(tmpDir, "dest")
+	_, err = UnpackStream(bytes.NewReader(compressed.Bytes()), destDir)
+	ok(t, err)
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "openstack", "current", "meta_data.json"))
+	ok(t, err)
+	equals(t, `{"uuid": "box"}`, string(data))
+}
+
+func TestWriteISOBsdtar(t *testing.T) {
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		t.Skip("bsdtar is not installed")
+	}
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-iso-")
+	ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	makeISOTree(t, srcDir, time.Now())
+
+	file, err := os.Create(filepath.Join(tmpDir, "test.iso"))
+	ok(t, err)
+	ok(t, WriteISO(file, srcDir, "config-2"))
+	ok(t, file.Close())
+
+	out, err := exec.Command(bsdtar, "-tf", file.Name()).CombinedOutput()
+	ok(t, err)
+
+	for _, name := range []string{
+		"openstack/latest/user_data",
+		"openstack/current",
+		"a very long name that does not fit in 8.3.txt",
+		"a very long name that does not fit in 8.3.TXT",
+	} {
+		assert(t, bytes.Contains(out, []byte(name)), "bsdtar did not list %s:\n%s", name, out)
+	}
+}
+
+func TestUnpackCorruptISO(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-iso-")
+	ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	makeISOTree(t, srcDir, time.Now())
+
+	buf := new(bytes.Buffer)
+	ok(t, WriteISO(buf, srcDir, "config-2"))
+
+	// Cuts the image right after the volume descriptors.
+	truncated := buf.Bytes()[:20*isoSectorSize]
+	_, err = UnpackISOStream(bytes.NewReader(truncated), filepath.Join(tmpDir, "dest"))
+	assert(t, err != nil, "truncated image should fail")
+}
@@ -0,0 +1,852 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package unzipit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Rock Ridge extension identification, as written by mkisofs.
+const (
+	rrID         = "RRIP_1991A"
+	rrDescriptor = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+	rrSource     = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+)
+
+// Joliet names are limited to 64 UCS-2 characters.
+const maxJolietName = 64
+
+// WriteISO writes an ISO 9660 image holding the files in srcPath, with Rock
+// Ridge extensions for POSIX names, permissions, times and symlinks, and
+// Joliet extensions for Windows. volumeID labels the image, i.e.: config-2
+// for OpenStack config drives or cidata for cloud-init NoCloud ones.
+//
+// It is meant for small images, such as config drives: files must be smaller
+// than 4GB and their names must fit in a single directory record. Files
+// other than regular files, directories and symlinks are skipped.
+func WriteISO(w io.Writer, srcPath, volumeID string) error {
+	iw := &isoWriter{
+		volumeID:  volumeID,
+		rockRidge: true,
+		joliet:    true,
+	}
+	return iw.write(w, srcPath)
+}
+
+// isoWriter lays out and writes an ISO 9660 image.
+type isoWriter struct {
+	volumeID  string
+	rockRidge bool
+	joliet    bool
+
+	root *isoNode
+	// Directories in path table order, for each hierarchy
+	dirs       []*isoNode
+	jolietDirs []*isoNode
+	// Regular files, in the order their data is written
+	files []*isoNode
+
+	// Sector of the Rock Ridge continuation area, holding the ER entry
+	ceSector uint32
+	// Sectors and size of the path tables
+	pathTableSize uint32
+	pathTables    [4]uint32
+	volumeSize    uint32
+	recordingTime time.Time
+}
+
+// isoNode is a file, directory or symlink going into the image.
+type isoNode struct {
+	name   string
+	path   string
+	finfo  os.FileInfo
+	target string
+	parent *isoNode
+
+	// Children in primary and Joliet directory order
+	children       []*isoNode
+	jolietChildren []*isoNode
+
+	// Identifiers in the primary and Joliet hierarchies
+	ident       []byte
+	jolietIdent []byte
+
+	// Directories: numbers in the path tables, extents and sizes
+	number       int
+	jolietNumber int
+	extent       uint32
+	size         uint32
+	jolietExtent uint32
+	jolietSize   uint32
+
+	// Regular files: extent of their data
+	dataExtent uint32
+}
+
+func (n *isoNode) isDir() bool {
+	return n.finfo.IsDir()
+}
+
+func (n *isoNode) isSymlink() bool {
+	return n.finfo.Mode()&os.ModeSymlink != 0
+}
+
+// write writes the image of srcPath into w.
+func (iw *isoWriter) write(w io.Writer, srcPath string) error {
+	finfo, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	if !finfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", srcPath)
+	}
+
+	iw.root = &isoNode{path: srcPath, finfo: finfo}
+	iw.root.parent = iw.root
+	iw.recordingTime = finfo.ModTime()
+
+	if err := iw.scan(iw.root); err != nil {
+		return err
+	}
+
+	if err := iw.layout(); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	iso := &sectorWriter{w: bw}
+	if err := iw.writeImage(iso); err != nil {
+		return err
+	}
+
+	if iso.sectors != iw.volumeSize {
+		return fmt.Errorf("ISO image layout mismatch: wrote %d sectors, expected %d", iso.sectors, iw.volumeSize)
+	}
+	return bw.Flush()
+}
+
+// scan reads the files in dir, recursively, naming them in both hierarchies.
+func (iw *isoWriter) scan(dir *isoNode) error {
+	entries, err := ioutil.ReadDir(dir.path)
+	if err != nil {
+		return err
+	}
+
+	for _, finfo := range entries {
+		node := &isoNode{
+			name:   finfo.Name(),
+			path:   filepath.Join(dir.path, finfo.Name()),
+			finfo:  finfo,
+			parent: dir,
+		}
+
+		switch {
+		case finfo.IsDir():
+			if err := iw.scan(node); err != nil {
+				return err
+			}
+		case finfo.Mode()&os.ModeSymlink != 0:
+			if node.target, err = os.Readlink(node.path); err != nil {
+				return err
+			}
+		case finfo.Mode().IsRegular():
+			if finfo.Size() > 0xffffffff {
+				return fmt.Errorf("%s is too big for an ISO image", node.path)
+			}
+		default:
+			log.Printf("[WARN] Skipping %s, only regular files, directories and symlinks can go into ISO images", node.path)
+			continue
+		}
+
+		dir.children = append(dir.children, node)
+	}
+
+	iw.nameChildren(dir)
+	return nil
+}
+
+// nameChildren gives unique identifiers to the files in dir and sorts them
+// in each hierarchy.
+func (iw *isoWriter) nameChildren(dir *isoNode) {
+	taken := make(map[string]bool)
+	jolietTaken := make(map[string]bool)
+	for _, node := range dir.children {
+		node.ident = []byte(uniqueName(taken, func(suffix string) string {
+			return isoIdentifier(node.name, node.isDir(), suffix)
+		}))
+
+		node.jolietIdent = ucs2(uniqueName(jolietTaken, func(suffix string) string {
+			return jolietIdentifier(node.name, node.isDir(), suffix)
+		}))
+	}
+
+	dir.jolietChildren = make([]*isoNode, 0, len(dir.children))
+	for _, node := range dir.children {
+		// Joliet has no symlinks
+		if !node.isSymlink() {
+			dir.jolietChildren = append(dir.jolietChildren, node)
+		}
+	}
+
+	sort.Slice(dir.children, func(i, j int) bool {
+		return bytes.Compare(dir.children[i].ident, dir.children[j].ident) < 0
+	})
+	sort.Slice(dir.jolietChildren, func(i, j int) bool {
+		return bytes.Compare(dir.jolietChildren[i].jolietIdent, dir.jolietChildren[j].jolietIdent) < 0
+	})
+}
+
+// uniqueName returns the first name returned by nameFn, for an increasing
+// suffix, not taken yet.
+func uniqueName(taken map[string]bool, nameFn func(suffix string) string) string {
+	name := nameFn("")
+	for i := 1; taken[name]; i++ {
+		name = nameFn(fmt.Sprintf("_%d", i))
+	}
+	taken[name] = true
+	return name
+}
+
+// isoIdentifier returns the ISO 9660 level 1 identifier of a file: an 8.3
+// upper case name made of letters, digits and underscores, followed by a
+// version number for files. suffix is appended to the name to make it unique.
+func isoIdentifier(name string, dir bool, suffix string) string {
+	base, ext := name, ""
+	if !dir {
+		if i := strings.LastIndex(name, "."); i > 0 {
+			base, ext = name[:i], name[i+1:]
+		}
+	}
+
+	base = dChars(base, 8-len(suffix)) + suffix
+	if dir {
+		return base
+	}
+	return base + "." + dChars(ext, 3) + ";1"
+}
+
+// dChars maps a name to ISO 9660 d-characters, truncating it to max.
+func dChars(name string, max int) string {
+	var buf bytes.Buffer
+	for _, r := range strings.ToUpper(name) {
+		if buf.Len() == max {
+			break
+		}
+
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			buf.WriteRune(r)
+		} else {
+			buf.WriteByte('_')
+		}
+	}
+	return buf.String()
+}
+
+// jolietIdentifier returns the Joliet identifier of a file, truncated to fit
+// along with suffix and the version number of files.
+func jolietIdentifier(name string, dir bool, suffix string) string {
+	max := maxJolietName - len(suffix)
+	if !dir {
+		max -= 2
+	}
+
+	units := utf16.Encode([]rune(name))
+	if len(units) > max {
+		units = units[:max]
+	}
+
+	name = string(utf16.Decode(units)) + suffix
+	if !dir {
+		name += ";1"
+	}
+	return name
+}
+
+// ucs2 encodes s in big endian UCS-2, as Joliet names are.
+func ucs2(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+// layout assigns sectors to everything in the image.
+func (iw *isoWriter) layout() error {
+	iw.dirs = directories(iw.root, func(n *isoNode) []*isoNode { return n.children })
+	for i, dir := range iw.dirs {
+		dir.number = i + 1
+	}
+
+	if iw.joliet {
+		iw.jolietDirs = directories(iw.root, func(n *isoNode) []*isoNode { return n.jolietChildren })
+		for i, dir := range iw.jolietDirs {
+			dir.jolietNumber = i + 1
+		}
+	}
+
+	// Volume descriptors, starting at sector 16
+	next := uint32(17)
+	if iw.joliet {
+		next++
+	}
+	next++
+
+	iw.pathTableSize = uint32(len(pathTable(iw.dirs, false, false)))
+	pathTableSectors := sectors(int64(iw.pathTableSize))
+	for i := range iw.pathTables {
+		if i >= 2 && !iw.joliet {
+			break
+		}
+
+		size := pathTableSectors
+		if i >= 2 {
+			size = sectors(int64(len(pathTable(iw.jolietDirs, true, false))))
+		}
+		iw.pathTables[i] = next
+		next += size
+	}
+
+	for _, dir := range iw.dirs {
+		records, err := iw.dirRecords(dir, false)
+		if err != nil {
+			return err
+		}
+
+		dir.extent = next
+		dir.size = uint32(len(packRecords(records)))
+		next += sectors(int64(dir.size))
+	}
+
+	// Readers such as libarchive want continuation areas after the
+	// directories using them.
+	if iw.rockRidge {
+		iw.ceSector = next
+		next++
+	}
+
+	for _, dir := range iw.jolietDirs {
+		records, err := iw.dirRecords(dir, true)
+		if err != nil {
+			return err
+		}
+
+		dir.jolietExtent = next
+		dir.jolietSize = uint32(len(packRecords(records)))
+		next += sectors(int64(dir.jolietSize))
+	}
+
+	for _, dir := range iw.dirs {
+		for _, node := range dir.children {
+			if node.isDir() || node.isSymlink() {
+				continue
+			}
+
+			node.dataExtent = next
+			next += sectors(node.finfo.Size())
+			iw.files = append(iw.files, node)
+		}
+	}
+
+	iw.volumeSize = next
+	return nil
+}
+
+// directories returns the directories under root, root included, in path
+// table order: breadth first, in directory order.
+func directories(root *isoNode, children func(*isoNode) []*isoNode) []*isoNode {
+	dirs := []*isoNode{root}
+	for i := 0; i < len(dirs); i++ {
+		for _, node := range children(dirs[i]) {
+			if node.isDir() {
+				dirs = append(dirs, node)
+			}
+		}
+	}
+	return dirs
+}
+
+// sectors returns the number of sectors taken by size bytes.
+func sectors(size int64) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+// writeImage writes the image once laid out.
+func (iw *isoWriter) writeImage(w *sectorWriter) error {
+	// System area
+	if err := w.write(make([]byte, 16*isoSectorSize)); err != nil {
+		return err
+	}
+
+	if err := w.write(iw.volumeDescriptor(false)); err != nil {
+		return err
+	}
+
+	if iw.joliet {
+		if err := w.write(iw.volumeDescriptor(true)); err != nil {
+			return err
+		}
+	}
+
+	terminator := make([]byte, isoSectorSize)
+	terminator[0] = isoTerminator
+	copy(terminator[1:], magicISO)
+	terminator[6] = 1
+	if err := w.write(terminator); err != nil {
+		return err
+	}
+
+	tables := [][]byte{pathTable(iw.dirs, false, false), pathTable(iw.dirs, false, true)}
+	if iw.joliet {
+		tables = append(tables, pathTable(iw.jolietDirs, true, false), pathTable(iw.jolietDirs, true, true))
+	}
+
+	for _, table := range tables {
+		if err := w.write(table); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range iw.dirs {
+		records, err := iw.dirRecords(dir, false)
+		if err != nil {
+			return err
+		}
+
+		if err := w.write(packRecords(records)); err != nil {
+			return err
+		}
+	}
+
+	if iw.rockRidge {
+		if err := w.write(erEntry()); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range iw.jolietDirs {
+		records, err := iw.dirRecords(dir, true)
+		if err != nil {
+			return err
+		}
+
+		if err := w.write(packRecords(records)); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range iw.files {
+		if err := w.writeFile(node.path, node.finfo.Size()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// volumeDescriptor returns the primary volume descriptor, or the Joliet one.
+func (iw *isoWriter) volumeDescriptor(joliet bool) []byte {
+	vd := make([]byte, isoSectorSize)
+	vd[0] = isoPrimary
+	copy(vd[1:], magicISO)
+	vd[6] = 1
+
+	text := func(field []byte, s string) {
+		if joliet {
+			units := ucs2(s)
+			for i := 0; i+1 < len(field); i += 2 {
+				field[i], field[i+1] = 0, ' '
+			}
+			copy(field, units)
+			return
+		}
+
+		for i := range field {
+			field[i] = ' '
+		}
+		copy(field, s)
+	}
+
+	text(vd[8:40], "")
+	text(vd[40:72], iw.volumeID)
+	putBoth32(vd[80:], iw.volumeSize)
+	putBoth16(vd[120:], 1)
+	putBoth16(vd[124:], 1)
+	putBoth16(vd[128:], isoSectorSize)
+
+	root, tables := iw.root.extent, iw.pathTables[0:2]
+	rootSize := iw.root.size
+	tableSize := iw.pathTableSize
+	if joliet {
+		vd[0] = isoSupplementary
+		copy(vd[88:], "%/E")
+		root, tables = iw.root.jolietExtent, iw.pathTables[2:4]
+		rootSize = iw.root.jolietSize
+		tableSize = uint32(len(pathTable(iw.jolietDirs, true, false)))
+	}
+
+	putBoth32(vd[132:], tableSize)
+	binary.LittleEndian.PutUint32(vd[140:], tables[0])
+	binary.BigEndian.PutUint32(vd[148:], tables[1])
+
+	copy(vd[156:190], dirRecord(root, rootSize, iw.root.finfo.ModTime(), isoFlagDir, []byte{0}, nil))
+
+	for _, field := range [][]byte{vd[190:318], vd[318:446], vd[446:574], vd[574:702], vd[702:739], vd[739:776], vd[776:813]} {
+		text(field, "")
+	}
+
+	putVolumeTime(vd[813:830], iw.recordingTime)
+	putVolumeTime(vd[830:847], iw.recordingTime)
+	putVolumeTime(vd[847:864], time.Time{})
+	putVolumeTime(vd[864:881], time.Time{})
+	vd[881] = 1
+
+	return vd
+}
+
+// pathTable returns the little endian, or big endian, path table of a
+// hierarchy.
+func pathTable(dirs []*isoNode, joliet, bigEndian bool) []byte {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	var buf bytes.Buffer
+	for _, dir := range dirs {
+		ident, extent, parent := dir.ident, dir.extent, dir.parent.number
+		if joliet {
+			ident, extent, parent = dir.jolietIdent, dir.jolietExtent, dir.parent.jolietNumber
+		}
+
+		if dir.parent == dir {
+			ident = []byte{0}
+		}
+
+		record := make([]byte, 8+len(ident)+len(ident)%2)
+		record[0] = byte(len(ident))
+		order.PutUint32(record[2:], extent)
+		order.PutUint16(record[6:], uint16(parent))
+		copy(record[8:], ident)
+		buf.Write(record)
+	}
+	return buf.Bytes()
+}
+
+// dirRecords returns the records of a directory, in the primary hierarchy
+// or in the Joliet one.
+func (iw *isoWriter) dirRecords(dir *isoNode, joliet bool) ([][]byte, error) {
+	extent, size := dir.extent, dir.size
+	parentExtent, parentSize := dir.parent.extent, dir.parent.size
+	children := dir.children
+	if joliet {
+		extent, size = dir.jolietExtent, dir.jolietSize
+		parentExtent, parentSize = dir.parent.jolietExtent, dir.parent.jolietSize
+		children = dir.jolietChildren
+	}
+
+	var dotSU, dotdotSU []byte
+	if iw.rockRidge && !joliet {
+		if dir == iw.root {
+			dotSU = append(dotSU, spEntry()...)
+			dotSU = append(dotSU, ceEntry(iw.ceSector, 0, uint32(len(erEntry())))...)
+		}
+		dotSU = append(dotSU, iw.attributes(dir)...)
+		dotdotSU = iw.attributes(dir.parent)
+	}
+
+	records := [][]byte{
+		dirRecord(extent, size, dir.finfo.ModTime(), isoFlagDir, []byte{0}, dotSU),
+		dirRecord(parentExtent, parentSize, dir.parent.finfo.ModTime(), isoFlagDir, []byte{1}, dotdotSU),
+	}
+
+	for _, node := range children {
+		ident := node.ident
+		if joliet {
+			ident = node.jolietIdent
+		}
+
+		var su []byte
+		if iw.rockRidge && !joliet {
+			su = append(iw.attributes(node), nmEntry(node.name)...)
+			if node.isSymlink() {
+				sl, err := slEntry(node.target)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s", node.path, err)
+				}
+				su = append(su, sl...)
+			}
+		}
+
+		var record []byte
+		switch {
+		case node.isDir() && joliet:
+			record = dirRecord(node.jolietExtent, node.jolietSize, node.finfo.ModTime(), isoFlagDir, ident, su)
+		case node.isDir():
+			record = dirRecord(node.extent, node.size, node.finfo.ModTime(), isoFlagDir, ident, su)
+		case node.isSymlink():
+			record = dirRecord(0, 0, node.finfo.ModTime(), 0, ident, su)
+		default:
+			record = dirRecord(node.dataExtent, uint32(node.finfo.Size()), node.finfo.ModTime(), 0, ident, su)
+		}
+
+		if record == nil {
+			return nil, fmt.Errorf("%s: name is too long for an ISO image", node.path)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// attributes returns the Rock Ridge entries holding the POSIX attributes of
+// a file.
+func (iw *isoWriter) attributes(node *isoNode) []byte {
+	mode := uint32(node.finfo.Mode().Perm())
+	nlink := uint32(1)
+	switch {
+	case node.isDir():
+		mode |= posixDir
+		nlink = 2
+		for _, child := range node.children {
+			if child.isDir() {
+				nlink++
+			}
+		}
+	case node.isSymlink():
+		mode |= posixSymlink
+	default:
+		mode |= posixRegular
+	}
+
+	return append(pxEntry(mode, nlink), tfEntry(node.finfo.ModTime())...)
+}
+
+// dirRecord returns a directory record, or nil if it does not fit in the 255
+// bytes records can take.
+func dirRecord(extent, size uint32, mtime time.Time, flags byte, ident, su []byte) []byte {
+	length := 33 + len(ident)
+	if length%2 == 1 {
+		length++
+	}
+
+	if length+len(su) > 255 {
+		return nil
+	}
+
+	record := make([]byte, length+len(su))
+	record[0] = byte(len(record))
+	putBoth32(record[2:], extent)
+	putBoth32(record[10:], size)
+	putRecordTime(record[18:25], mtime)
+	record[25] = flags
+	putBoth16(record[28:], 1)
+	record[32] = byte(len(ident))
+	copy(record[33:], ident)
+	copy(record[length:], su)
+	return record
+}
+
+// packRecords lays out directory records in sectors, which they must not
+// cross.
+func packRecords(records [][]byte) []byte {
+	var buf bytes.Buffer
+	for _, record := range records {
+		used := buf.Len() % isoSectorSize
+		if used+len(record) > isoSectorSize {
+			buf.Write(make([]byte, isoSectorSize-used))
+		}
+		buf.Write(record)
+	}
+
+	if used := buf.Len() % isoSectorSize; used > 0 {
+		buf.Write(make([]byte, isoSectorSize-used))
+	}
+	return buf.Bytes()
+}
+
+// spEntry returns the SUSP entry announcing Rock Ridge.
+func spEntry() []byte {
+	return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}
+}
+
+// ceEntry returns a SUSP continuation area entry.
+func ceEntry(sector, offset, length uint32) []byte {
+	e := make([]byte, 28)
+	copy(e, "CE")
+	e[2], e[3] = 28, 1
+	putBoth32(e[4:], sector)
+	putBoth32(e[12:], offset)
+	putBoth32(e[20:], length)
+	return e
+}
+
+// erEntry returns the SUSP entry identifying Rock Ridge.
+func erEntry() []byte {
+	e := make([]byte, 8, 8+len(rrID)+len(rrDescriptor)+len(rrSource))
+	copy(e, "ER")
+	e[2], e[3] = byte(cap(e)), 1
+	e[4], e[5], e[6], e[7] = byte(len(rrID)), byte(len(rrDescriptor)), byte(len(rrSource)), 1
+	e = append(e, rrID...)
+	e = append(e, rrDescriptor...)
+	return append(e, rrSource...)
+}
+
+// pxEntry returns a Rock Ridge entry holding POSIX file attributes.
+func pxEntry(mode, nlink uint32) []byte {
+	e := make([]byte, 36)
+	copy(e, "PX")
+	e[2], e[3] = 36, 1
+	putBoth32(e[4:], mode)
+	putBoth32(e[12:], nlink)
+	return e
+}
+
+// tfEntry returns a Rock Ridge entry holding the modification and access
+// times of a file.
+func tfEntry(mtime time.Time) []byte {
+	e := make([]byte, 19)
+	copy(e, "TF")
+	e[2], e[3] = 19, 1
+	e[4] = 1<<1 | 1<<2
+	putRecordTime(e[5:12], mtime)
+	putRecordTime(e[12:19], mtime)
+	return e
+}
+
+// nmEntry returns a Rock Ridge entry holding the name of a file.
+func nmEntry(name string) []byte {
+	e := make([]byte, 5, 5+len(name))
+	copy(e, "NM")
+	e[2], e[3] = byte(5+len(name)), 1
+	return append(e, name...)
+}
+
+// slEntry returns a Rock Ridge entry holding the target of a symlink.
+func slEntry(target string) ([]byte, error) {
+	e := []byte{'S', 'L', 0, 1, 0}
+
+	components := strings.Split(target, "/")
+	if strings.HasPrefix(target, "/") {
+		e = append(e, 1<<3, 0)
+		components = components[1:]
+	}
+
+	for _, component := range components {
+		switch component {
+		case "":
+			continue
+		case ".":
+			e = append(e, 1<<1, 0)
+		case "..":
+			e = append(e, 1<<2, 0)
+		default:
+			e = append(e, 0, byte(len(component)))
+			e = append(e, component...)
+		}
+	}
+
+	if len(e) > 255 {
+		return nil, fmt.Errorf("symlink target is too long for an ISO image")
+	}
+	e[2] = byte(len(e))
+	return e, nil
+}
+
+// putBoth16 writes v in both little and big endian, as ISO 9660 does.
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+// putBoth32 writes v in both little and big endian, as ISO 9660 does.
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// putRecordTime writes the 7 bytes dates of directory records, in UTC.
+func putRecordTime(b []byte, t time.Time) {
+	t = t.UTC()
+	b[0] = byte(t.Year() - 1900)
+	b[1] = byte(t.Month())
+	b[2] = byte(t.Day())
+	b[3] = byte(t.Hour())
+	b[4] = byte(t.Minute())
+	b[5] = byte(t.Second())
+	b[6] = 0
+}
+
+// putVolumeTime writes the 17 bytes dates of volume descriptors, in UTC. Zero
+// times are written as not specified.
+func putVolumeTime(b []byte, t time.Time) {
+	if t.IsZero() {
+		copy(b, "0000000000000000")
+		b[16] = 0
+		return
+	}
+
+	t = t.UTC()
+	copy(b, fmt.Sprintf("%s%02d", t.Format("20060102150405"), t.Nanosecond()/1e7))
+	b[16] = 0
+}
+
+// sectorWriter writes an image, keeping count of the sectors written.
+type sectorWriter struct {
+	w       io.Writer
+	sectors uint32
+}
+
+// write writes data, padding it to a whole number of sectors.
+func (s *sectorWriter) write(data []byte) error {
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	return s.pad(int64(len(data)))
+}
+
+// writeFile writes the content of a file, padded to a whole number of
+// sectors. The file must still be as big as when it was laid out.
+func (s *sectorWriter) writeFile(path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.CopyN(s.w, file, size); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%s was truncated while writing the ISO image", path)
+		}
+		return err
+	}
+	return s.pad(size)
+}
+
+// pad completes the last sector written, counting the sectors.
+func (s *sectorWriter) pad(size int64) error {
+	n := sectors(size)
+	if rest := int64(n)*isoSectorSize - size; rest > 0 {
+		if _, err := s.w.Write(make([]byte, rest)); err != nil {
+			return err
+		}
+	}
+	s.sectors += n
+	return nil
+}
@@ -0,0 +1,27 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package unzipit
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var errUnsupported = errors.New("unzipit: named pipes are not supported on this platform")
+
+// mkfifo creates a named pipe.
+func mkfifo(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkfifo", Path: path, Err: errUnsupported}
+}
+
+// lchtimes changes the times of a symlink rather than the ones of the file it
+// points to. It is not possible on this platform, so it does nothing.
+func lchtimes(path string, atime, mtime time.Time) error {
+	return nil
+}
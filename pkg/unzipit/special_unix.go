@@ -0,0 +1,44 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package unzipit
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// mkfifo creates a named pipe.
+func mkfifo(path string, perm os.FileMode) error {
+	if err := unix.Mkfifo(path, uint32(perm)); err != nil {
+		return &os.PathError{Op: "mkfifo", Path: path, Err: err}
+	}
+	return nil
+}
+
+// lchtimes changes the times of a symlink rather than the ones of the file it
+// points to.
+func lchtimes(path string, atime, mtime time.Time) error {
+	if mtime.IsZero() {
+		return nil
+	}
+
+	if atime.IsZero() {
+		atime = mtime
+	}
+
+	tv := []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	}
+	if err := unix.Lutimes(path, tv); err != nil {
+		return &os.PathError{Op: "lutimes", Path: path, Err: err}
+	}
+	return nil
+}
@@ -10,44 +10,76 @@ import (
 	"bufio"
 	"bytes"
 	"compress/bzip2"
-	"compress/gzip"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"os"
-	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
 )
 
 var (
-	magicZIP  = []byte{0x50, 0x4b, 0x03, 0x04}
-	magicGZ   = []byte{0x1f, 0x8b}
-	magicBZIP = []byte{0x42, 0x5a}
-	magicTAR  = []byte{0x75, 0x73, 0x74, 0x61, 0x72} // at offset 257
+	magicZIP       = []byte{0x50, 0x4b, 0x03, 0x04}
+	magicGZ        = []byte{0x1f, 0x8b}
+	magicBZIP      = []byte{0x42, 0x5a}
+	magicXZ        = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+	magicZSTD      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	magicLZ4       = []byte{0x04, 0x22, 0x4d, 0x18}
+	magicLZ4Legacy = []byte{0x02, 0x21, 0x4c, 0x18}
+	magicTAR       = []byte{0x75, 0x73, 0x74, 0x61, 0x72} // at offset 257
 )
 
-// Check whether a file has the magic number for tar, gzip, bzip2 or zip files
+// Check whether a file has the magic number for tar, gzip, bzip2, xz, zstd,
+// lz4, zip or ISO 9660 files
 //
 // Note that this function does not advance the Reader.
 //
 // 50 4b 03 04 for pkzip format
 // 1f 8b for .gz
 // 42 5a for bzip
+// fd 37 7a 58 5a 00 for .xz
+// 28 b5 2f fd for .zst
+// 04 22 4d 18 for .lz4, or 02 21 4c 18 for legacy .lz4
 // 75 73 74 61 72 at offset 257 for tar files
+// 43 44 30 30 31 at offset 32769 for ISO 9660 images
 func magicNumber(reader *bufio.Reader, offset int) (string, error) {
-	headerBytes, err := reader.Peek(offset + 5)
-	if err != nil {
+	headerBytes, err := reader.Peek(offset + 6)
+	if len(headerBytes) < offset+5 {
 		return "", err
 	}
 
-	magic := headerBytes[offset : offset+5]
+	magic := headerBytes[offset:]
 
-	if bytes.Equal(magicTAR, magic) {
+	if bytes.Equal(magicTAR, magic[0:5]) {
 		return "tar", nil
 	}
 
+	if bytes.Equal(magicISO, magic[0:5]) {
+		return "iso", nil
+	}
+
+	if bytes.HasPrefix(magic, magicXZ) {
+		return "xz", nil
+	}
+
+	if bytes.Equal(magicZSTD, magic[0:4]) {
+		return "zstd", nil
+	}
+
+	if bytes.Equal(magicLZ4, magic[0:4]) || bytes.Equal(magicLZ4Legacy, magic[0:4]) {
+		return "lz4", nil
+	}
+
 	if bytes.Equal(magicZIP, magic[0:4]) {
 		return "zip", nil
 	}
@@ -67,36 +99,137 @@ func magicNumber(reader *bufio.Reader, offset int) (string, error) {
 // File formats supported are:
 //   - .tar.gz
 //   - .tar.bzip2
+//   - .tar.xz
+//   - .tar.zst
+//   - .tar.lz4
 //   - .zip
 //   - .tar
+//   - .iso, compressed or not
 //
 // If it cannot recognize the file format, it will save the file, as is, to the
 // destination path.
 func Unpack(file *os.File, destPath string) (string, error) {
+	return UnpackWithLimits(file, destPath, DefaultLimits)
+}
+
+// UnpackWithLimits is like Unpack, stopping with a *LimitError as soon as
+// the archive goes over the given limits.
+func UnpackWithLimits(file *os.File, destPath string, limits Limits) (string, error) {
+	return UnpackContext(context.Background(), file, destPath, Options{Limits: limits})
+}
+
+// UnpackContext is like Unpack, extracting entries and reporting progress as
+// told by opts. It stops with ctx.Err() as soon as ctx is done, leaving what
+// was extracted so far behind.
+func UnpackContext(ctx context.Context, file *os.File, destPath string, opts Options) (string, error) {
+	x, err := newFileExtractor(ctx, file, destPath, opts)
+	if err != nil {
+		return "", err
+	}
+	return x.unpack(file)
+}
+
+// Extract is like UnpackContext, describing what was extracted instead of
+// just where.
+func Extract(ctx context.Context, file *os.File, destPath string, opts Options) (*Result, error) {
+	x, err := newFileExtractor(ctx, file, destPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := x.unpack(file); err != nil {
+		return nil, err
+	}
+	return x.result(), nil
+}
+
+// newFileExtractor returns an extractor unpacking file into destPath, or into
+// a new temporary directory if destPath is empty.
+func newFileExtractor(ctx context.Context, file *os.File, destPath string, opts Options) (*extractor, error) {
 	if file == nil {
-		return "", errors.New("You must provide a valid file to unpack")
+		return nil, errors.New("You must provide a valid file to unpack")
 	}
 
 	var err error
 	if destPath == "" {
 		destPath, err = ioutil.TempDir(os.TempDir(), "unpackit-")
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
 	// Makes sure despPath exists
 	os.MkdirAll(destPath, 0740)
 
-	r := bufio.NewReader(file)
-	return UnpackStream(r, destPath)
+	return newExtractor(ctx, destPath, opts, nil), nil
+}
+
+// unpack unpacks an archive file of any of the supported formats. Formats
+// are told apart in the same order as unpackStream does, so that files are
+// unpacked the same way either way.
+func (x *extractor) unpack(file *os.File) (string, error) {
+	fstat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// ISO images and ZIP archives are read in place rather than copied to a
+	// temporary file first, as streams are.
+	header := bufio.NewReader(io.NewSectionReader(file, 0, fstat.Size()))
+	ftype, _ := magicNumber(header, 0)
+	switch ftype {
+	case "zip":
+		zr, err := zip.NewReader(file, fstat.Size())
+		if err != nil {
+			return "", err
+		}
+		return x.unzip(zr)
+	case "gzip", "bzip", "xz", "zstd", "lz4":
+	default:
+		if ftype, _ = magicNumber(header, 257); ftype != "tar" && isISO(file) {
+			return x.unpackISO(file, fstat.Size())
+		}
+	}
+
+	x.input = &countingReader{r: &contextReader{x.ctx, bufio.NewReader(file)}}
+	return x.unpackStream()
 }
 
 // UnpackStream unpacks a compressed stream. Note that if the stream is a using ZIP
-// compression (but only ZIP compression), it's going to get buffered in its entirety
-// to memory prior to decompression.
+// compression (but only ZIP compression), it's going to get copied in its entirety
+// to a temporary file prior to decompression.
 func UnpackStream(reader io.Reader, destPath string) (string, error) {
-	r := bufio.NewReader(reader)
+	return UnpackStreamWithLimits(reader, destPath, DefaultLimits)
+}
+
+// UnpackStreamWithLimits is like UnpackStream, stopping with a *LimitError
+// as soon as the archive goes over the given limits.
+func UnpackStreamWithLimits(reader io.Reader, destPath string, limits Limits) (string, error) {
+	return UnpackStreamContext(context.Background(), reader, destPath, Options{Limits: limits})
+}
+
+// UnpackStreamContext is like UnpackStream, extracting entries and reporting
+// progress as told by opts. It stops with ctx.Err() as soon as ctx is done.
+func UnpackStreamContext(ctx context.Context, reader io.Reader, destPath string, opts Options) (string, error) {
+	input := &countingReader{r: &contextReader{ctx, reader}}
+	return newExtractor(ctx, destPath, opts, input).unpackStream()
+}
+
+// ExtractStream is like UnpackStreamContext, describing what was extracted
+// instead of just where.
+func ExtractStream(ctx context.Context, reader io.Reader, destPath string, opts Options) (*Result, error) {
+	input := &countingReader{r: &contextReader{ctx, reader}}
+	x := newExtractor(ctx, destPath, opts, input)
+	if _, err := x.unpackStream(); err != nil {
+		return nil, err
+	}
+	return x.result(), nil
+}
+
+// unpackStream unpacks the stream of any of the supported formats read from
+// x.input.
+func (x *extractor) unpackStream() (string, error) {
+	r := bufio.NewReader(x.input)
 
 	// Reads magic number from the stream so we can better determine how to proceed
 	ftype, err := magicNumber(r, 0)
@@ -116,10 +249,25 @@ func UnpackStream(reader io.Reader, destPath string) (string, error) {
 		if err != nil {
 			return "", err
 		}
+	case "xz":
+		decompressingReader, err = UnxzStream(r)
+		if err != nil {
+			return "", err
+		}
+	case "zstd":
+		decompressingReader, err = UnzstdStream(r)
+		if err != nil {
+			return "", err
+		}
+	case "lz4":
+		decompressingReader, err = Unlz4Stream(r)
+		if err != nil {
+			return "", err
+		}
 	case "zip":
 		// Like TAR, ZIP is also an archiving format, therefore we can just return
 		// after it finishes
-		return UnzipStream(r, destPath)
+		return x.unzipStream(r)
 	default:
 		decompressingReader = r
 	}
@@ -127,11 +275,21 @@ func UnpackStream(reader io.Reader, destPath string) (string, error) {
 	// Check magic number in offset 257 too see if this is also a TAR file
 	ftype, err = magicNumber(decompressingReader, 257)
 	if ftype == "tar" {
-		return Untar(decompressingReader, destPath)
+		return x.untar(decompressingReader)
+	}
+
+	// ISO 9660 images start with 32KB of system area
+	decompressingReader = bufio.NewReaderSize(decompressingReader, isoMagicOffset+isoSectorSize)
+	ftype, err = magicNumber(decompressingReader, isoMagicOffset)
+	if ftype == "iso" {
+		return x.unpackISOStream(decompressingReader)
 	}
 
 	// If it's not a TAR archive then save it to disk as is.
-	destRawFile := filepath.Join(destPath, sanitize(path.Base("tarstream")))
+	destRawFile, err := x.entry(Entry{Name: "tarstream"})
+	if err != nil || destRawFile == "" {
+		return x.destPath, err
+	}
 
 	// Creates destination file
 	destFile, err := os.Create(destRawFile)
@@ -141,11 +299,11 @@ func UnpackStream(reader io.Reader, destPath string) (string, error) {
 	defer destFile.Close()
 
 	// Copies data to destination file
-	if _, err := io.Copy(destFile, decompressingReader); err != nil {
+	if err := x.copy(destFile, decompressingReader); err != nil {
 		return "", err
 	}
 
-	return destPath, nil
+	return x.destPath, nil
 }
 
 // Bunzip2 decompresses a bzip2 file and returns the decompressed stream
@@ -175,17 +333,51 @@ func Gunzip(file *os.File) (*bufio.Reader, error) {
 	return bufio.NewReader(gunzipReader), nil
 }
 
-// GunzipStream unpacks a gzipped stream
+// GunzipStream unpacks a gzipped stream. BGZF streams, made of independent
+// gzip members, are decompressed in parallel.
 func GunzipStream(reader io.Reader) (*bufio.Reader, error) {
+	r := bufio.NewReader(reader)
+	if isBGZF(r) {
+		return bufio.NewReader(newBGZFReader(r)), nil
+	}
+
 	var decompressingReader *gzip.Reader
 	var err error
-	if decompressingReader, err = gzip.NewReader(reader); err != nil {
+	if decompressingReader, err = gzip.NewReader(r); err != nil {
+		return nil, err
+	}
+
+	return bufio.NewReader(decompressingReader), nil
+}
+
+// UnxzStream unpacks a xz stream
+func UnxzStream(reader io.Reader) (*bufio.Reader, error) {
+	decompressingReader, err := xz.NewReader(reader)
+	if err != nil {
 		return nil, err
 	}
 
 	return bufio.NewReader(decompressingReader), nil
 }
 
+// UnzstdStream unpacks a zstd stream
+func UnzstdStream(reader io.Reader) (*bufio.Reader, error) {
+	// With a concurrency of one the decoder runs synchronously, so that
+	// there are no goroutines left behind if the stream is not read to
+	// the end.
+	decompressingReader, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return bufio.NewReader(decompressingReader), nil
+}
+
+// Unlz4Stream unpacks a lz4 stream, made of frames or legacy frames
+func Unlz4Stream(reader io.Reader) (*bufio.Reader, error) {
+	return bufio.NewReader(lz4.NewReader(reader)), nil
+}
+
 // Unzip decompresses and unarchives a ZIP archive, returning the final path or an error
 func Unzip(file *os.File, destPath string) (string, error) {
 	fstat, err := file.Stat()
@@ -198,70 +390,185 @@ func Unzip(file *os.File, destPath string) (string, error) {
 		return "", err
 	}
 
-	return unpackZip(zr, destPath)
+	return newExtractor(context.Background(), destPath, Options{Limits: DefaultLimits}, nil).unzip(zr)
 }
 
 // UnzipStream unpacks a ZIP stream. Because of the nature of the ZIP format,
-// the stream is copied to memory before decompression.
+// whose index is at the end of the archive, the stream is copied to a
+// temporary file, in os.TempDir(), before decompression.
 func UnzipStream(r io.Reader, destPath string) (string, error) {
-	data, err := ioutil.ReadAll(r)
+	return newExtractor(context.Background(), destPath, Options{Limits: DefaultLimits}, nil).unzipStream(r)
+}
+
+// unzipStream copies a ZIP stream to a temporary file and unpacks it.
+func (x *extractor) unzipStream(r io.Reader) (string, error) {
+	file, size, err := spill(r)
 	if err != nil {
 		return "", err
 	}
+	defer os.Remove(file.Name())
+	defer file.Close()
 
-	memReader := bytes.NewReader(data)
-	zr, err := zip.NewReader(memReader, int64(len(data)))
+	zr, err := zip.NewReader(file, size)
 	if err != nil {
 		return "", err
 	}
 
-	return unpackZip(zr, destPath)
+	return x.unzip(zr)
 }
 
-func unpackZip(zr *zip.Reader, destPath string) (string, error) {
-	// Iterate through the files in the archive,
-	// printing some of their contents.
-	pathSeparator := string(os.PathSeparator)
+// spill copies r to a temporary file, for formats that cannot be unpacked
+// sequentially. The file must be closed and removed once done with it.
+func spill(r io.Reader) (*os.File, int64, error) {
+	file, err := ioutil.TempFile("", "unzipit-")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// unzip unpacks the files in a ZIP archive.
+func (x *extractor) unzip(zr *zip.Reader) (string, error) {
+	// The ratio is computed from the size of the entries, rather than from
+	// the size of the archive.
+	x.input = nil
+
+	var dirs []dirAttrs
 	for _, f := range zr.File {
-		rc, err := f.Open()
+		// Symlinks are stored as files holding their target.
+		var size int64
+		if f.Mode().IsRegular() {
+			size = int64(f.UncompressedSize64)
+		}
+
+		path, err := x.entry(Entry{
+			Name:    f.Name,
+			Size:    size,
+			Mode:    f.Mode(),
+			ModTime: f.Modified,
+		})
 		if err != nil {
 			return "", err
 		}
-		defer rc.Close()
 
-		filePath := sanitize(f.Name)
-		sepInd := strings.LastIndex(filePath, pathSeparator)
+		if path == "" {
+			continue
+		}
+		x.compressed += int64(f.CompressedSize64)
+		x.read += int64(f.CompressedSize64)
+
+		// Permissions are only recorded by Unix zip tools. Entries made
+		// elsewhere get the default ones.
+		perm := f.Mode().Perm()
+		if creator := f.CreatorVersion >> 8; creator != creatorUnix && creator != creatorMacOSX {
+			perm = 0
+		}
 
-		// If the file is a subdirectory, it creates it before attempting to
-		// create the actual file
-		if sepInd > -1 {
-			directory := filePath[0:sepInd]
-			os.MkdirAll(filepath.Join(destPath, directory), 0740)
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, 0740); err != nil {
+				return "", err
+			}
+			dirs = append(dirs, dirAttrs{path, perm, f.Modified, f.Modified})
+			continue
 		}
 
-		file, err := os.Create(filepath.Join(destPath, filePath))
-		if err != nil {
+		if path == x.destPath {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0740); err != nil {
 			return "", err
 		}
-		defer file.Close()
 
-		if _, err := io.CopyN(file, rc, int64(f.UncompressedSize64)); err != nil {
+		if err := x.unzipEntry(f, path, perm); err != nil {
 			return "", err
 		}
-		defer rc.Close()
 	}
-	return destPath, nil
+
+	if err := x.checkLinks(); err != nil {
+		return "", err
+	}
+
+	if err := restoreDirs(dirs); err != nil {
+		return "", err
+	}
+	return x.destPath, nil
+}
+
+// Zip creator host systems recording Unix file modes
+const (
+	creatorUnix   = 3
+	creatorMacOSX = 19
+)
+
+// Symlinks in zip files are stored as files holding the link target, which
+// should not be anywhere near this size.
+const maxLinkTarget = 4096
+
+// unzipEntry extracts a file or symlink from a zip archive into path.
+func (x *extractor) unzipEntry(f *zip.File, path string, perm os.FileMode) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := removeExisting(path); err != nil {
+		return err
+	}
+
+	if f.Mode()&os.ModeSymlink != 0 {
+		target, err := ioutil.ReadAll(io.LimitReader(rc, maxLinkTarget))
+		if err != nil {
+			return err
+		}
+
+		if err := x.symlink(f.Name, string(target), path); err != nil {
+			return err
+		}
+		return lchtimes(path, f.Modified, f.Modified)
+	}
+
+	if err := x.writeFile(path, rc); err != nil {
+		return err
+	}
+	return restoreAttrs(path, perm, f.Modified, f.Modified)
 }
 
 // Untar unarchives a TAR archive and returns the final destination path or an error
+//
+// Regular files, directories, symlinks, hard links and FIFOs are created with
+// the permission bits and modification times recorded in the archive.
+// Character and block devices are skipped, since creating them requires
+// privileges the service does not have and images have no use for them.
 func Untar(data io.Reader, destPath string) (string, error) {
+	return UntarContext(context.Background(), data, destPath, Options{Limits: DefaultLimits})
+}
+
+// UntarContext is like Untar, extracting entries and reporting progress as
+// told by opts. It stops with ctx.Err() as soon as ctx is done.
+func UntarContext(ctx context.Context, data io.Reader, destPath string, opts Options) (string, error) {
+	input := &countingReader{r: &contextReader{ctx, data}}
+	return newExtractor(ctx, destPath, opts, input).untar(input)
+}
+
+// untar unarchives a TAR archive.
+func (x *extractor) untar(data io.Reader) (string, error) {
 	// Makes sure destPath exists
-	os.MkdirAll(destPath, 0740)
+	os.MkdirAll(x.destPath, 0740)
 
 	tr := tar.NewReader(data)
 
 	// Iterate through the files in the archive.
-	rootdir := destPath
+	rootdir := x.destPath
+	var dirs []dirAttrs
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -273,36 +580,186 @@ func Untar(data io.Reader, destPath string) (string, error) {
 			return rootdir, err
 		}
 
-		if hdr.FileInfo().IsDir() {
-			d := filepath.Join(destPath, sanitize(hdr.Name))
-			if rootdir == destPath {
-				rootdir = d
+		path, err := x.entry(Entry{
+			Name:     hdr.Name,
+			Size:     hdr.Size,
+			Mode:     hdr.FileInfo().Mode(),
+			Linkname: hdr.Linkname,
+			ModTime:  hdr.ModTime,
+		})
+		if err != nil {
+			return rootdir, err
+		}
+
+		if path == "" {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			if rootdir == x.destPath {
+				rootdir = path
+			}
+
+			if err := os.MkdirAll(path, 0740); err != nil {
+				return rootdir, err
 			}
-			os.MkdirAll(d, os.FileMode(hdr.Mode))
+			dirs = append(dirs, dirAttrs{path, hdr.FileInfo().Mode().Perm(), hdr.AccessTime, hdr.ModTime})
 			continue
 		}
 
-		path := filepath.Join(destPath, sanitize(hdr.Name))
-		parentDir, _ := filepath.Split(path)
+		// An entry without name would otherwise replace destPath itself
+		if path == x.destPath {
+			continue
+		}
 
-		err = os.MkdirAll(parentDir, 0740)
+		err = os.MkdirAll(filepath.Dir(path), 0740)
 		if err != nil {
 			return rootdir, err
 		}
 
-		file, err := os.Create(path)
-		if err != nil {
+		if err := x.untarEntry(tr, hdr, path); err != nil {
 			return rootdir, err
 		}
+	}
 
-		defer file.Close()
+	if err := x.checkLinks(); err != nil {
+		return rootdir, err
+	}
 
-		if _, err := io.Copy(file, tr); err != nil {
-			return rootdir, err
+	if err := restoreDirs(dirs); err != nil {
+		return rootdir, err
+	}
+	return rootdir, nil
+}
+
+// untarEntry extracts anything but a directory from a tar archive into path.
+func (x *extractor) untarEntry(tr *tar.Reader, hdr *tar.Header, path string) error {
+	perm := hdr.FileInfo().Mode().Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeCont, tar.TypeGNUSparse:
+		if err := removeExisting(path); err != nil {
+			return err
 		}
+
+		if err := x.writeFile(path, tr); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := removeExisting(path); err != nil {
+			return err
+		}
+
+		if err := x.symlink(hdr.Name, hdr.Linkname, path); err != nil {
+			return err
+		}
+		return lchtimes(path, hdr.AccessTime, hdr.ModTime)
+	case tar.TypeLink:
+		if err := removeExisting(path); err != nil {
+			return err
+		}
+
+		target, err := x.linkTarget(hdr.Name, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		// The target shares its inode, and so its mode and times, with
+		// the link.
+		return os.Link(target, path)
+	case tar.TypeFifo:
+		if err := removeExisting(path); err != nil {
+			return err
+		}
+
+		if err := mkfifo(path, perm); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		log.Printf("[WARN] Skipping device file %s", hdr.Name)
+		return nil
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		log.Printf("[WARN] Skipping %s, unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+		return nil
 	}
 
-	return rootdir, nil
+	return restoreAttrs(path, perm, hdr.AccessTime, hdr.ModTime)
+}
+
+// removeExisting removes whatever file is at path so that it is replaced,
+// rather than written through if it happens to be a symlink.
+func removeExisting(path string) error {
+	finfo, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if finfo.IsDir() {
+		return fmt.Errorf("%s already exists and is a directory", path)
+	}
+	return os.Remove(path)
+}
+
+// writeFile creates a file at path with the data read from r, within the
+// limits.
+func (x *extractor) writeFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	if err := x.copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// dirAttrs holds the attributes of an extracted directory, which are restored
+// once everything is extracted. Otherwise, extracting its content would
+// update its modification time, and fail if it is not writable.
+type dirAttrs struct {
+	path  string
+	perm  os.FileMode
+	atime time.Time
+	mtime time.Time
+}
+
+// restoreDirs restores the attributes of extracted directories, subdirectories
+// first.
+func restoreDirs(dirs []dirAttrs) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		if err := restoreAttrs(d.path, d.perm, d.atime, d.mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAttrs sets the permissions and times of an extracted file, leaving
+// the default ones when they are unknown, i.e.: are zero.
+func restoreAttrs(path string, perm os.FileMode, atime, mtime time.Time) error {
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			return err
+		}
+	}
+
+	if mtime.IsZero() {
+		return nil
+	}
+
+	if atime.IsZero() {
+		atime = mtime
+	}
+	return os.Chtimes(path, atime, mtime)
 }
 
 // Sanitizes name to avoid overwriting sensitive system files when unarchiving
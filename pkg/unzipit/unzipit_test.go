@@ -6,16 +6,20 @@ package unzipit
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 // assert fails the test if the condition is false.
@@ -52,6 +56,10 @@ func TestUnpack(t *testing.T) {
 	}{
 		{"./fixtures/test.tar.bzip2", 2},
 		{"./fixtures/test.tar.gz", 2},
+		{"./fixtures/test.tar.xz", 2},
+		{"./fixtures/test.tar.zst", 2},
+		{"./fixtures/test.tar.bgzf.gz", 2},
+		{"./fixtures/test.tar.lz4", 2},
 		{"./fixtures/test.zip", 2},
 		{"./fixtures/filetest.zip", 3},
 		{"./fixtures/test.tar", 2},
@@ -84,6 +92,10 @@ func TestUnpackStream(t *testing.T) {
 	}{
 		{"./fixtures/test.tar.bzip2", 2},
 		{"./fixtures/test.tar.gz", 2},
+		{"./fixtures/test.tar.xz", 2},
+		{"./fixtures/test.tar.zst", 2},
+		{"./fixtures/test.tar.bgzf.gz", 2},
+		{"./fixtures/test.tar.lz4", 2},
 		{"./fixtures/test.zip", 2},
 		{"./fixtures/test.tar", 2},
 		{"./fixtures/cfgdrv.iso", 1},
@@ -110,6 +122,36 @@ func TestUnpackStream(t *testing.T) {
 	}
 }
 
+func TestUnpackFileAsStream(t *testing.T) {
+	// The body of the only entry starts right after its 512 bytes header,
+	// placing the ISO 9660 magic number where ISO images have it.
+	body := strings.Repeat("x", isoMagicOffset-512) + string(magicISO) + strings.Repeat("x", isoSectorSize)
+	data := makeTar(t, []testEntry{{tar.TypeReg, "image.bin", "", body}})
+
+	tempDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-file-as-stream-")
+	ok(t, err)
+	defer os.RemoveAll(tempDir)
+
+	tarPath := filepath.Join(tempDir, "image.tar")
+	ok(t, ioutil.WriteFile(tarPath, data, 0640))
+
+	file, err := os.Open(tarPath)
+	ok(t, err)
+	defer file.Close()
+
+	destPath, err := Unpack(file, filepath.Join(tempDir, "file"))
+	ok(t, err)
+	unpacked, err := ioutil.ReadFile(filepath.Join(destPath, "image.bin"))
+	ok(t, err)
+	assert(t, string(unpacked) == body, "file: image.bin does not match")
+
+	destPath, err = UnpackStream(bytes.NewReader(data), filepath.Join(tempDir, "stream"))
+	ok(t, err)
+	unpacked, err = ioutil.ReadFile(filepath.Join(destPath, "image.bin"))
+	ok(t, err)
+	assert(t, string(unpacked) == body, "stream: image.bin does not match")
+}
+
 func TestMagicNumber(t *testing.T) {
 	var tests = []struct {
 		filepath string
@@ -118,15 +160,21 @@ func TestMagicNumber(t *testing.T) {
 	}{
 		{"./fixtures/test.tar.bzip2", 0, "bzip"},
 		{"./fixtures/test.tar.gz", 0, "gzip"},
+		{"./fixtures/test.tar.bgzf.gz", 0, "gzip"},
+		{"./fixtures/test.tar.xz", 0, "xz"},
+		{"./fixtures/test.tar.zst", 0, "zstd"},
+		{"./fixtures/test.tar.lz4", 0, "lz4"},
+		{"./fixtures/lz4-source-legacy.txt.lz4", 0, "lz4"},
 		{"./fixtures/test.zip", 0, "zip"},
 		{"./fixtures/test.tar", 257, "tar"},
+		{"./fixtures/cfgdrv.iso", isoMagicOffset, "iso"},
 	}
 
 	for _, test := range tests {
 		file, err := os.Open(test.filepath)
 		ok(t, err)
 
-		ftype, err := magicNumber(bufio.NewReader(file), test.offset)
+		ftype, err := magicNumber(bufio.NewReaderSize(file, test.offset+isoSectorSize), test.offset)
 		file.Close()
 		ok(t, err)
 
@@ -175,6 +223,206 @@ func TestUntar(t *testing.T) {
 	ok(t, err)
 }
 
+func TestUntarEntryTypes(t *testing.T) {
+	mtime := time.Date(2015, 11, 3, 10, 30, 0, 0, time.UTC)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+
+	var entries = []struct {
+		hdr  tar.Header
+		body string
+	}{
+		{tar.Header{Typeflag: tar.TypeDir, Name: "box.vmwarevm/", Mode: 0750}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "box.vmwarevm/box.vmx", Mode: 0600}, "numvcpus = 2"},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "box.vmwarevm/tools.sh", Mode: 0755}, "#!/bin/sh"},
+		{tar.Header{Typeflag: tar.TypeSymlink, Name: "box.vmwarevm/current.vmx", Linkname: "box.vmx"}, ""},
+		{tar.Header{Typeflag: tar.TypeLink, Name: "box.vmwarevm/backup.vmx", Linkname: "box.vmwarevm/box.vmx"}, ""},
+		{tar.Header{Typeflag: tar.TypeFifo, Name: "box.vmwarevm/pipe", Mode: 0640}, ""},
+		{tar.Header{Typeflag: tar.TypeChar, Name: "box.vmwarevm/null", Mode: 0666, Devmajor: 1, Devminor: 3}, ""},
+		{tar.Header{Typeflag: tar.TypeDir, Name: "box.vmwarevm/readonly/", Mode: 0555}, ""},
+		{tar.Header{Typeflag: tar.TypeReg, Name: "box.vmwarevm/readonly/notes.txt", Mode: 0444}, "notes"},
+	}
+
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.body))
+		hdr.ModTime = mtime
+		ok(t, tw.WriteHeader(&hdr))
+
+		_, err := tw.Write([]byte(entry.body))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-entries-")
+	ok(t, err)
+	defer func() {
+		os.Chmod(filepath.Join(destDir, "box.vmwarevm", "readonly"), 0750)
+		os.RemoveAll(destDir)
+	}()
+
+	rootdir, err := Untar(bytes.NewReader(buf.Bytes()), destDir)
+	ok(t, err)
+	equals(t, filepath.Join(destDir, "box.vmwarevm"), rootdir)
+
+	modes := map[string]os.FileMode{
+		"":                   os.ModeDir | 0750,
+		"box.vmx":            0600,
+		"tools.sh":           0755,
+		"backup.vmx":         0600,
+		"pipe":               os.ModeNamedPipe | 0640,
+		"readonly":           os.ModeDir | 0555,
+		"readonly/notes.txt": 0444,
+	}
+
+	for name, mode := range modes {
+		finfo, err := os.Lstat(filepath.Join(rootdir, name))
+		ok(t, err)
+		equals(t, mode, finfo.Mode())
+		assert(t, finfo.ModTime().Equal(mtime), "%s modification time not restored: %s", name, finfo.ModTime())
+	}
+
+	target, err := os.Readlink(filepath.Join(rootdir, "current.vmx"))
+	ok(t, err)
+	equals(t, "box.vmx", target)
+
+	finfo, err := os.Lstat(filepath.Join(rootdir, "current.vmx"))
+	ok(t, err)
+	assert(t, finfo.ModTime().Equal(mtime), "symlink modification time not restored: %s", finfo.ModTime())
+
+	vmx, err := os.Stat(filepath.Join(rootdir, "box.vmx"))
+	ok(t, err)
+	backup, err := os.Stat(filepath.Join(rootdir, "backup.vmx"))
+	ok(t, err)
+	assert(t, os.SameFile(vmx, backup), "hard link was not created")
+
+	_, err = os.Lstat(filepath.Join(rootdir, "null"))
+	assert(t, os.IsNotExist(err), "device file should be skipped")
+}
+
+func TestUntarReplacesSymlinks(t *testing.T) {
+	outside, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-outside-")
+	ok(t, err)
+	defer os.RemoveAll(outside)
+
+	victim := filepath.Join(outside, "victim")
+	ok(t, ioutil.WriteFile(victim, []byte("untouched"), 0600))
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	ok(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "file", Mode: 0644, Size: 5}))
+	_, err = tw.Write([]byte("owned"))
+	ok(t, err)
+	ok(t, tw.Close())
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-replace-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	// Left behind in the destination directory, i.e.: by an earlier attempt
+	ok(t, os.Symlink(victim, filepath.Join(destDir, "file")))
+
+	_, err = Untar(bytes.NewReader(buf.Bytes()), destDir)
+	ok(t, err)
+
+	data, err := ioutil.ReadFile(victim)
+	ok(t, err)
+	equals(t, "untouched", string(data))
+
+	data, err = ioutil.ReadFile(filepath.Join(destDir, "file"))
+	ok(t, err)
+	equals(t, "owned", string(data))
+}
+
+func TestUnzipModes(t *testing.T) {
+	mtime := time.Date(2015, 11, 3, 10, 30, 0, 0, time.UTC)
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	var entries = []struct {
+		name string
+		mode os.FileMode
+		body string
+	}{
+		{"box.vmwarevm/", os.ModeDir | 0750, ""},
+		{"box.vmwarevm/box.vmx", 0600, "numvcpus = 2"},
+		{"box.vmwarevm/tools.sh", 0755, "#!/bin/sh"},
+		{"box.vmwarevm/current.vmx", os.ModeSymlink | 0777, "box.vmx"},
+	}
+
+	for _, entry := range entries {
+		fh := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: mtime}
+		fh.SetMode(entry.mode)
+
+		w, err := zw.CreateHeader(fh)
+		ok(t, err)
+		_, err = w.Write([]byte(entry.body))
+		ok(t, err)
+	}
+
+	// Entries made by non Unix tools get default permissions.
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "readme.txt", Modified: mtime})
+	ok(t, err)
+	_, err = w.Write([]byte("readme"))
+	ok(t, err)
+	ok(t, zw.Close())
+
+	destDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-zip-")
+	ok(t, err)
+	defer os.RemoveAll(destDir)
+
+	_, err = UnzipStream(bytes.NewReader(buf.Bytes()), destDir)
+	ok(t, err)
+
+	for _, entry := range entries {
+		finfo, err := os.Lstat(filepath.Join(destDir, entry.name))
+		ok(t, err)
+
+		if entry.mode&os.ModeSymlink == 0 {
+			equals(t, entry.mode, finfo.Mode())
+		}
+		assert(t, finfo.ModTime().Equal(mtime), "%s modification time not restored: %s", entry.name, finfo.ModTime())
+	}
+
+	target, err := os.Readlink(filepath.Join(destDir, "box.vmwarevm", "current.vmx"))
+	ok(t, err)
+	equals(t, "box.vmx", target)
+
+	data, err := ioutil.ReadFile(filepath.Join(destDir, "readme.txt"))
+	ok(t, err)
+	equals(t, "readme", string(data))
+}
+
+func TestUnzipStreamTempFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "unpackit-tests-tmp-")
+	ok(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmpDir)
+
+	destDir, err := ioutil.TempDir(tmpDir, "dest-")
+	ok(t, err)
+
+	file, err := os.Open("./fixtures/filetest.zip")
+	ok(t, err)
+	defer file.Close()
+
+	_, err = UnzipStream(bufio.NewReader(file), destDir)
+	ok(t, err)
+	equals(t, 3, calcNumberOfFiles(t, destDir))
+
+	// Truncated archives fail, the temporary file is removed all the same.
+	_, err = UnzipStream(io.LimitReader(bytes.NewReader(makeZip(t, []testEntry{{tar.TypeReg, "a", "", "a"}})), 10), destDir)
+	assert(t, err != nil, "truncated archive should fail")
+
+	files, err := ioutil.ReadDir(tmpDir)
+	ok(t, err)
+	equals(t, 1, len(files))
+}
+
 func TestSanitize(t *testing.T) {
 	var tests = []struct {
 		malicious string
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Capabilities describes the features a hypervisor driver supports.
+type Capabilities struct {
+	// Whether virtual machines can be created as linked clones of a gold image
+	LinkedClones bool `json:"linked_clones"`
+	// Whether virtual machines boot properly without a graphical environment
+	Headless bool `json:"headless"`
+	// Whether virtual machine snapshots are supported
+	Snapshots bool `json:"snapshots"`
+}
+
+// Driver creates virtual machines for a specific hypervisor.
+type Driver interface {
+	// Capabilities returns the features supported by the hypervisor.
+	Capabilities() Capabilities
+	// NewVM returns the virtual machine backed by the given VMX file path.
+	NewVM(vmxPath string) (VirtualMachine, error)
+}
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes a driver available by the provided name. If Register is
+// called twice with the same name or if driver is nil, it panics.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if driver == nil {
+		panic("vmware: Register driver is nil")
+	}
+
+	if _, dup := drivers[name]; dup {
+		panic("vmware: Register called twice for driver " + name)
+	}
+	drivers[name] = driver
+}
+
+// Lookup returns the driver registered under the given name.
+func Lookup(name string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	driver, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("[VMWare] Unknown driver %q, available drivers: %v", name, driverNames())
+	}
+	return driver, nil
+}
+
+// Drivers returns a sorted list of the names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	return driverNames()
+}
+
+// driverNames must be called holding driversMu.
+func driverNames() []string {
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
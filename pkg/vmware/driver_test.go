@@ -0,0 +1,40 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDriverRegistry(t *testing.T) {
+	for _, name := range []string{"fake", "fusion", "fusion7"} {
+		_, err := Lookup(name)
+		ok(t, err)
+	}
+
+	_, err := Lookup("hyper-v")
+	assert(t, err != nil, "unknown drivers should not be found")
+
+	fusion7, err := Lookup("fusion7")
+	ok(t, err)
+	assert(t, !fusion7.Capabilities().Headless, "Fusion 7 does not boot headless VMs properly")
+
+	fusion, err := Lookup("fusion")
+	ok(t, err)
+	assert(t, fusion.Capabilities().Headless, "Newer Fusion versions support headless mode")
+}
+
+func TestFusionDriverWithoutVMRun(t *testing.T) {
+	os.Setenv("VMWARE_VMRUN_PATH", filepath.Join(os.TempDir(), "non-existent-vmrun"))
+	defer os.Unsetenv("VMWARE_VMRUN_PATH")
+
+	driver, err := Lookup("fusion7")
+	ok(t, err)
+
+	_, err = driver.NewVM("/tmp/vm1/vm1.vmx")
+	assert(t, err != nil, "an error was expected when vmrun is missing")
+}
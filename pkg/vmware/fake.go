@@ -0,0 +1,735 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Power states tracked by the fake VMware host.
+const (
+	fakePoweredOff = "stopped"
+	fakePoweredOn  = "running"
+	fakeSuspended  = "suspended"
+)
+
+func init() {
+	Register("fake", &fakeDriver{})
+}
+
+// fakeDriver is the driver registered as "fake". It manages virtual machines
+// through a FakeHost configured from the environment, see NewFakeHostFromEnv.
+type fakeDriver struct {
+	once sync.Once
+	host *FakeHost
+	err  error
+}
+
+// load creates the fake host upon first use.
+func (d *fakeDriver) load() (*FakeHost, error) {
+	d.once.Do(func() {
+		d.host, d.err = NewFakeHostFromEnv()
+	})
+	return d.host, d.err
+}
+
+// Capabilities returns the features reported by the fake host.
+func (d *fakeDriver) Capabilities() Capabilities {
+	host, err := d.load()
+	if err != nil {
+		return Capabilities{}
+	}
+	return host.Capabilities()
+}
+
+// NewVM returns a virtual machine managed by the fake host.
+func (d *fakeDriver) NewVM(vmxPath string) (VirtualMachine, error) {
+	host, err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	return host.NewVM(vmxPath)
+}
+
+// FakeHost emulates a VMware host so that code depending on VirtualMachine can
+// be exercised where no VMware product is installed. It can be registered as
+// a Driver as well. The state of every
+// virtual machine is kept on disk, one file per VMX path, inside StateDir.
+// This allows the fakevmrun program and in-process FakeVMs to share the
+// same view of the host.
+type FakeHost struct {
+	// Directory where virtual machines state is kept
+	StateDir string
+	// Artificial delays to apply, keyed by vmrun command name. For instance:
+	// "start", "clone" or "getGuestIPAddress"
+	Latencies map[string]time.Duration
+	// Errors to return, keyed by vmrun command name
+	Failures map[string]error
+	// Features reported when used as a Driver
+	Features Capabilities
+
+	mu sync.Mutex
+}
+
+// fakeVMState is what gets persisted for every virtual machine.
+type fakeVMState struct {
+	VMXPath   string `json:"vmx_path"`
+	Power     string `json:"power"`
+	IPAddress string `json:"ip_address"`
+}
+
+// NewFakeHost creates a new instance of FakeHost keeping its state in the
+// given directory.
+func NewFakeHost(stateDir string) *FakeHost {
+	return &FakeHost{
+		StateDir:  stateDir,
+		Latencies: make(map[string]time.Duration),
+		Failures:  make(map[string]error),
+		Features: Capabilities{
+			LinkedClones: true,
+			Headless:     true,
+			Snapshots:    true,
+		},
+	}
+}
+
+// NewFakeHostFromEnv creates a FakeHost configured through environment
+// variables:
+//
+//	FAKE_VMRUN_STATE_DIR: directory where state is kept. Defaults to $TMPDIR/fakevmrun
+//	FAKE_VMRUN_LATENCY: comma separated list of command=duration, i.e.: start=2s,clone=500ms
+//	FAKE_VMRUN_FAIL: comma separated list of command[=message], i.e.: start,clone=disk full
+func NewFakeHostFromEnv() (*FakeHost, error) {
+	stateDir := os.Getenv("FAKE_VMRUN_STATE_DIR")
+	if stateDir == "" {
+		stateDir = filepath.Join(os.TempDir(), "fakevmrun")
+	}
+
+	host := NewFakeHost(stateDir)
+
+	for _, item := range splitList(os.Getenv("FAKE_VMRUN_LATENCY")) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("[Fake] Invalid latency %q, expected command=duration", item)
+		}
+
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		host.Latencies[parts[0]] = d
+	}
+
+	for _, item := range splitList(os.Getenv("FAKE_VMRUN_FAIL")) {
+		parts := strings.SplitN(item, "=", 2)
+		message := "injected failure"
+		if len(parts) == 2 {
+			message = parts[1]
+		}
+		host.Failures[parts[0]] = errors.New(message)
+	}
+
+	return host, nil
+}
+
+// splitList splits a comma separated list discarding empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// VM returns a virtual machine managed by this host.
+func (h *FakeHost) VM(vmxPath string) *FakeVM {
+	return &FakeVM{
+		vmxPath: vmxPath,
+		host:    h,
+	}
+}
+
+// Capabilities returns the features this host was configured with.
+func (h *FakeHost) Capabilities() Capabilities {
+	return h.Features
+}
+
+// NewVM returns a virtual machine managed by this host.
+func (h *FakeHost) NewVM(vmxPath string) (VirtualMachine, error) {
+	return h.VM(vmxPath), nil
+}
+
+// SetLatency configures an artificial delay for a vmrun command.
+func (h *FakeHost) SetLatency(command string, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Latencies[command] = latency
+}
+
+// SetFailure configures an error to be returned by a vmrun command. A nil
+// error clears any previously injected failure.
+func (h *FakeHost) SetFailure(command string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.Failures, command)
+		return
+	}
+	h.Failures[command] = err
+}
+
+// simulate applies the latency and failure configured for a command.
+func (h *FakeHost) simulate(command string) error {
+	h.mu.Lock()
+	latency := h.Latencies[command]
+	failure := h.Failures[command]
+	h.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	if failure != nil {
+		return fmt.Errorf("[Fake] %s: %s", command, failure)
+	}
+	return nil
+}
+
+// stateFile returns the file where the state of a virtual machine is kept.
+func (h *FakeHost) stateFile(vmxPath string) string {
+	return filepath.Join(h.StateDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(vmxPath))))
+}
+
+// state loads the state of a virtual machine. Unknown virtual machines are
+// reported as powered off.
+func (h *FakeHost) state(vmxPath string) (*fakeVMState, error) {
+	data, err := ioutil.ReadFile(h.stateFile(vmxPath))
+	if os.IsNotExist(err) {
+		return &fakeVMState{VMXPath: vmxPath, Power: fakePoweredOff}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	state := new(fakeVMState)
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveState atomically persists the state of a virtual machine.
+func (h *FakeHost) saveState(state *fakeVMState) error {
+	if err := os.MkdirAll(h.StateDir, 0740); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	file := h.stateFile(state.VMXPath)
+	tmpFile := fmt.Sprintf("%s.%d.tmp", file, os.Getpid())
+	if err := ioutil.WriteFile(tmpFile, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// removeState forgets about a virtual machine.
+func (h *FakeHost) removeState(vmxPath string) error {
+	err := os.Remove(h.stateFile(vmxPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Running returns the VMX paths of all the virtual machines currently running.
+func (h *FakeHost) Running() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(h.StateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var running []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		var state fakeVMState
+		if err := json.Unmarshal(data, &state); err != nil {
+			continue
+		}
+
+		if state.Power == fakePoweredOn {
+			running = append(running, state.VMXPath)
+		}
+	}
+	sort.Strings(running)
+
+	return running, nil
+}
+
+// fakeIPAddress derives a stable IP address from the VMX file path.
+func fakeIPAddress(vmxPath string) string {
+	sum := sha1.Sum([]byte(vmxPath))
+	return fmt.Sprintf("192.168.%d.%d", sum[0], 2+int(sum[1])%250)
+}
+
+// Host types accepted by the -T flag.
+var fakeHostTypes = map[string]bool{
+	"fusion": true,
+	"player": true,
+	"ws":     true,
+}
+
+// RunCommand interprets vmrun command line arguments against this host,
+// writing to stdout and stderr the same way vmrun does. It returns the exit
+// code the vmrun program would have returned.
+func (h *FakeHost) RunCommand(args []string, stdout, stderr io.Writer) int {
+	// Skips global flags such as -T ws or -gu user -gp password
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		if args[0] == "-T" && !fakeHostTypes[args[1]] {
+			fmt.Fprintf(stderr, "Error: Invalid host type: %s\n", args[1])
+			return 255
+		}
+		args = args[2:]
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "Error: No command specified")
+		return 255
+	}
+
+	command, params := args[0], args[1:]
+	if command != "list" && len(params) == 0 {
+		fmt.Fprintf(stderr, "Error: Invalid arguments for command %s\n", command)
+		return 255
+	}
+
+	var err error
+	switch command {
+	case "list":
+		var running []string
+		if err = h.simulate(command); err == nil {
+			running, err = h.Running()
+		}
+		if err == nil {
+			fmt.Fprintf(stdout, "Total running VMs: %d\n", len(running))
+			for _, vmxPath := range running {
+				fmt.Fprintln(stdout, vmxPath)
+			}
+		}
+	case "clone":
+		if len(params) < 3 {
+			err = errors.New("Invalid arguments for command clone")
+			break
+		}
+		err = h.VM(params[1]).CloneFrom(params[0], CloneType(params[2]))
+	case "start":
+		headless := len(params) > 1 && params[1] == "nogui"
+		err = h.VM(params[0]).Start(headless)
+	case "stop", "reset":
+		mode := PowerSoft
+		if len(params) > 1 {
+			mode = PowerMode(params[1])
+		}
+
+		if command == "stop" {
+			err = h.VM(params[0]).Stop(mode)
+		} else {
+			err = h.VM(params[0]).Reset(mode)
+		}
+	case "suspend":
+		err = h.VM(params[0]).Suspend()
+	case "unpause":
+		// Virtual machines are never paused, suspended ones are resumed
+		// through start.
+		err = errors.New("The virtual machine is not paused")
+	case "deleteVM":
+		err = h.VM(params[0]).Delete()
+	case "getGuestIPAddress":
+		var ip string
+		if ip, err = h.VM(params[0]).IPAddress(); err == nil {
+			fmt.Fprintln(stdout, ip)
+		}
+	case "checkToolsState":
+		vm := h.VM(params[0])
+		var running bool
+		if running, err = vm.IsRunning(); err == nil {
+			if running {
+				fmt.Fprintln(stdout, "running")
+			} else {
+				fmt.Fprintln(stdout, "installed")
+			}
+		}
+	default:
+		err = fmt.Errorf("Unrecognized command: %s", command)
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return 255
+	}
+	return 0
+}
+
+// FakeVM is a virtual machine managed by a FakeHost.
+type FakeVM struct {
+	vmxPath string
+	host    *FakeHost
+}
+
+// verifyVMXPath verifies that the VMX file path is not empty.
+func (v *FakeVM) verifyVMXPath() error {
+	if v.vmxPath == "" {
+		return errors.New("[Fake] Empty VMX file path. Nothing to operate on.")
+	}
+	return nil
+}
+
+// Info returns the virtual machine information from its VMX file.
+func (v *FakeVM) Info() (*VMInfo, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return nil, err
+	}
+
+	return readVMXInfo(v.vmxPath)
+}
+
+// SetInfo stores the VM information in its VMX file.
+func (v *FakeVM) SetInfo(info *VMInfo) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	return writeVMXInfo(v.vmxPath, info)
+}
+
+// CloneFrom copies the source VMX file into the VMX file path of the function receiver.
+// Disks are only copied for full clones.
+func (v *FakeVM) CloneFrom(src string, ctype CloneType) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if err := v.host.simulate("clone"); err != nil {
+		return err
+	}
+
+	if ctype != CloneFull && ctype != CloneLinked {
+		return fmt.Errorf("[Fake] Invalid clone type: %s", ctype)
+	}
+
+	if _, err := os.Stat(v.vmxPath); err == nil {
+		return fmt.Errorf("[Fake] The destination file already exists: %s", v.vmxPath)
+	}
+
+	vmx, err := readVMXFile(src)
+	if err != nil {
+		return err
+	}
+
+	destDir := filepath.Dir(v.vmxPath)
+	if err := os.MkdirAll(destDir, 0740); err != nil {
+		return err
+	}
+
+	if ctype == CloneFull {
+		disks, _ := filepath.Glob(filepath.Join(filepath.Dir(src), "*.vmdk"))
+		for _, disk := range disks {
+			if err := copyFile(disk, filepath.Join(destDir, filepath.Base(disk))); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := filepath.Base(v.vmxPath)
+	vmx["displayname"] = strings.TrimSuffix(name, filepath.Ext(name))
+
+	return writeVMXFile(v.vmxPath, vmx)
+}
+
+// copyFile copies a file's content from src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Start powers on the virtual machine. Suspended virtual machines are resumed.
+func (v *FakeVM) Start(headless bool) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if err := v.host.simulate("start"); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(v.vmxPath); err != nil {
+		return fmt.Errorf("[Fake] Cannot open VM: %s", v.vmxPath)
+	}
+
+	v.host.mu.Lock()
+	defer v.host.mu.Unlock()
+
+	state, err := v.host.state(v.vmxPath)
+	if err != nil {
+		return err
+	}
+
+	if state.Power == fakePoweredOn {
+		return errors.New("[Fake] The virtual machine is already running")
+	}
+
+	// Starting a suspended virtual machine resumes it from its checkpoint,
+	// which VMware discards once the virtual machine runs again. This is how
+	// drivers implement Resume, as vmrun's unpause is for paused ones only.
+	suspended, err := readVMXSuspended(v.vmxPath)
+	if err != nil {
+		return err
+	}
+
+	if state.Power == fakeSuspended || suspended {
+		if err := v.setCheckpoint(""); err != nil {
+			return err
+		}
+	}
+
+	state.Power = fakePoweredOn
+	state.IPAddress = fakeIPAddress(v.vmxPath)
+
+	return v.host.saveState(state)
+}
+
+// setPower transitions a running virtual machine to the given power state.
+func (v *FakeVM) setPower(command, power string) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if err := v.host.simulate(command); err != nil {
+		return err
+	}
+
+	v.host.mu.Lock()
+	defer v.host.mu.Unlock()
+
+	state, err := v.host.state(v.vmxPath)
+	if err != nil {
+		return err
+	}
+
+	if state.Power != fakePoweredOn {
+		return errors.New("[Fake] The virtual machine is not powered on")
+	}
+
+	if power == fakeSuspended {
+		if err := v.setCheckpoint(v.checkpointFile()); err != nil {
+			return err
+		}
+	}
+
+	state.Power = power
+	if power != fakePoweredOn {
+		state.IPAddress = ""
+	}
+
+	return v.host.saveState(state)
+}
+
+// checkpointFile returns where the state of the virtual machine is saved
+// to when suspending it.
+func (v *FakeVM) checkpointFile() string {
+	return strings.TrimSuffix(v.vmxPath, filepath.Ext(v.vmxPath)) + ".vmss"
+}
+
+// setCheckpoint saves or discards the suspended state the same way VMware does,
+// see readVMXSuspended.
+func (v *FakeVM) setCheckpoint(vmssPath string) error {
+	vmx, err := readVMXFile(v.vmxPath)
+	if err != nil {
+		return err
+	}
+
+	if vmssPath == "" {
+		os.Remove(v.checkpointFile())
+		vmx["checkpoint.vmstate"] = ""
+		return writeVMXFile(v.vmxPath, vmx)
+	}
+
+	if err := ioutil.WriteFile(vmssPath, []byte("fake suspended state"), 0640); err != nil {
+		return err
+	}
+	vmx["checkpoint.vmstate"] = filepath.Base(vmssPath)
+
+	return writeVMXFile(v.vmxPath, vmx)
+}
+
+// Stop powers off the virtual machine.
+func (v *FakeVM) Stop(mode PowerMode) error {
+	return v.setPower("stop", fakePoweredOff)
+}
+
+// Reset restarts the virtual machine. Its IP address is kept.
+func (v *FakeVM) Reset(mode PowerMode) error {
+	return v.setPower("reset", fakePoweredOn)
+}
+
+// Suspend saves the virtual machine state to a .vmss file and powers it off.
+func (v *FakeVM) Suspend() error {
+	return v.setPower("suspend", fakeSuspended)
+}
+
+// Resume powers on a suspended virtual machine.
+func (v *FakeVM) Resume(headless bool) error {
+	return v.Start(headless)
+}
+
+// Delete removes the virtual machine files from disk.
+func (v *FakeVM) Delete() error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if err := v.host.simulate("deleteVM"); err != nil {
+		return err
+	}
+
+	v.host.mu.Lock()
+	defer v.host.mu.Unlock()
+
+	state, err := v.host.state(v.vmxPath)
+	if err != nil {
+		return err
+	}
+
+	if state.Power == fakePoweredOn {
+		return errors.New("[Fake] The virtual machine should not be powered on. It is already running.")
+	}
+
+	if err := os.RemoveAll(filepath.Dir(v.vmxPath)); err != nil {
+		return err
+	}
+
+	return v.host.removeState(v.vmxPath)
+}
+
+// IsRunning returns whether or not the virtual machine is running.
+func (v *FakeVM) IsRunning() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	if err := v.host.simulate("list"); err != nil {
+		return false, err
+	}
+
+	v.host.mu.Lock()
+	defer v.host.mu.Unlock()
+
+	state, err := v.host.state(v.vmxPath)
+	if err != nil {
+		return false, err
+	}
+
+	return state.Power == fakePoweredOn, nil
+}
+
+// IsSuspended returns whether or not the virtual machine is suspended.
+func (v *FakeVM) IsSuspended() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	return readVMXSuspended(v.vmxPath)
+}
+
+// HasToolsInstalled always reports VMware Tools as installed for existing
+// virtual machines.
+func (v *FakeVM) HasToolsInstalled() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	if err := v.host.simulate("checkToolsState"); err != nil {
+		return false, err
+	}
+
+	return v.Exists()
+}
+
+// IPAddress returns the IP address assigned to the virtual machine when
+// it was powered on.
+func (v *FakeVM) IPAddress() (string, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return "", err
+	}
+
+	if err := v.host.simulate("getGuestIPAddress"); err != nil {
+		return "", err
+	}
+
+	v.host.mu.Lock()
+	defer v.host.mu.Unlock()
+
+	state, err := v.host.state(v.vmxPath)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Power != fakePoweredOn {
+		return "", errors.New("[Fake] The virtual machine is not powered on")
+	}
+
+	return state.IPAddress, nil
+}
+
+// Exists returns whether or not the VMX file for this VM exists.
+func (v *FakeVM) Exists() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(v.vmxPath); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command fakevmrun is a stand-in for VMware's vmrun program. It keeps virtual
+// machines state on disk instead of talking to a real hypervisor, so that
+// osx-builder can run end to end on hosts without VMware installed:
+//
+//	go build -o /tmp/vmrun github.com/c4milo/osx-builder/pkg/vmware/fakevmrun
+//	VMWARE_VMRUN_PATH=/tmp/vmrun osx-builder
+//
+// Supported commands are clone, start, stop, reset, suspend, list, deleteVM,
+// getGuestIPAddress and checkToolsState. Latencies and failures can be injected through the
+// FAKE_VMRUN_LATENCY and FAKE_VMRUN_FAIL environment variables, see
+// vmware.NewFakeHostFromEnv.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/c4milo/osx-builder/pkg/vmware"
+)
+
+func main() {
+	host, err := vmware.NewFakeHostFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(255)
+	}
+
+	os.Exit(host.RunCommand(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -0,0 +1,17 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+func init() {
+	// VMware Fusion 8 and newer use the same vmrun interface as Fusion 7 but
+	// boot virtual machines in headless mode properly.
+	Register("fusion", &fusionDriver{
+		capabilities: Capabilities{
+			LinkedClones: true,
+			Headless:     true,
+			Snapshots:    true,
+		},
+	})
+}
@@ -7,13 +7,41 @@ package vmware
 import (
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
-	"strconv"
 	"strings"
 )
 
+func init() {
+	// Headless mode is not supported due to a VMware Fusion 7 bug. See Start below.
+	Register("fusion7", &fusionDriver{
+		capabilities: Capabilities{
+			LinkedClones: true,
+			Headless:     false,
+			Snapshots:    true,
+		},
+	})
+}
+
+// fusionDriver creates virtual machines managed by VMware Fusion.
+type fusionDriver struct {
+	capabilities Capabilities
+}
+
+// Capabilities returns the features supported by this version of VMware Fusion.
+func (d *fusionDriver) Capabilities() Capabilities {
+	return d.capabilities
+}
+
+// NewVM returns a VMware Fusion virtual machine.
+func (d *fusionDriver) NewVM(vmxPath string) (VirtualMachine, error) {
+	vm, err := NewFusion7VM(vmxPath)
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
 // Fusion7VM defines a VMWare Fusion7 provider.
 type Fusion7VM struct {
 	vmxPath   string
@@ -21,17 +49,17 @@ type Fusion7VM struct {
 }
 
 // NewFusion7VM creates a new instance of Fusion7VM, receiving a VMX file path
-// as parameter.
-func NewFusion7VM(vmxPath string) *Fusion7VM {
+// as parameter. It returns an error if vmrun cannot be found.
+func NewFusion7VM(vmxPath string) (*Fusion7VM, error) {
 	fusion7 := &Fusion7VM{
 		vmxPath: vmxPath,
 	}
 
 	if err := fusion7.lookupVMRunPath(); err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
 
-	return fusion7
+	return fusion7, nil
 }
 
 // lookupVMRunPath finds vmrun tool in local filesystem.
@@ -80,31 +108,7 @@ func (v *Fusion7VM) Info() (*VMInfo, error) {
 		return nil, err
 	}
 
-	vmx, err := readVMXFile(v.vmxPath)
-	if err != nil {
-		return nil, err
-	}
-
-	info := new(VMInfo)
-	info.Name = vmx["displayname"]
-	info.Annotation = vmx["annotation"]
-
-	numcpus, err := strconv.ParseInt(vmx["numvcpus"], 0, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	memsize, err := strconv.ParseInt(vmx["memsize"], 0, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	info.CPUs = int(numcpus)
-	info.MemorySize = int(memsize)
-	info.NetworkType = NetworkType(vmx["ethernet0.connectiontype"])
-	info.GuestOS = vmx["guestos"]
-
-	return info, nil
+	return readVMXInfo(v.vmxPath)
 }
 
 // SetInfo stores the VM information in VMWare
@@ -113,43 +117,7 @@ func (v *Fusion7VM) SetInfo(info *VMInfo) error {
 		return err
 	}
 
-	vmx, err := readVMXFile(v.vmxPath)
-	if err != nil {
-		return err
-	}
-
-	vmx["displayname"] = info.Name
-	vmx["annotation"] = info.Annotation
-	vmx["numvcpus"] = strconv.Itoa(info.CPUs)
-	vmx["memsize"] = strconv.Itoa(info.MemorySize)
-
-	// This is to make sure to auto answer popups windows in the GUI. This is
-	// especially helpful when running in headless mode
-	vmx["msg.autoanswer"] = "true"
-
-	// The following settings does nothing in Fusion7.
-	// vmx["gui.exitatpoweroff"] = "true"
-	// vmx["gui.restricted"] = "true"
-	// vmx["gui.exitonclihlt"] = "true"
-
-	// Deletes all network adapters. For the simplicity's sake
-	// we are going to deliberately use only one network adapter.
-	for k, _ := range vmx {
-		if strings.HasPrefix(k, "ethernet") {
-			delete(vmx, k)
-		}
-	}
-
-	vmx["ethernet0.present"] = "true"
-	vmx["ethernet0.startconnected"] = "true"
-	vmx["ethernet0.virtualdev"] = "e1000"
-	vmx["ethernet0.connectiontype"] = string(info.NetworkType)
-
-	if err := writeVMXFile(v.vmxPath, vmx); err != nil {
-		return err
-	}
-
-	return nil
+	return writeVMXInfo(v.vmxPath, info)
 }
 
 // Start launches a virtual machine.
@@ -179,12 +147,26 @@ func (v *Fusion7VM) Start(headless bool) error {
 }
 
 // Stop stops a virtual machine.
-func (v *Fusion7VM) Stop() error {
+func (v *Fusion7VM) Stop(mode PowerMode) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(v.vmRunPath, "stop", v.vmxPath, string(mode))
+	if _, _, err := runAndLog(cmd); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reset restarts a virtual machine.
+func (v *Fusion7VM) Reset(mode PowerMode) error {
 	if err := v.verifyVMXPath(); err != nil {
 		return err
 	}
 
-	cmd := exec.Command(v.vmRunPath, "stop", v.vmxPath)
+	cmd := exec.Command(v.vmRunPath, "reset", v.vmxPath, string(mode))
 	if _, _, err := runAndLog(cmd); err != nil {
 		return err
 	}
@@ -192,6 +174,27 @@ func (v *Fusion7VM) Stop() error {
 	return nil
 }
 
+// Suspend saves the state of a virtual machine to disk and powers it off.
+func (v *Fusion7VM) Suspend() error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	cmd := exec.Command(v.vmRunPath, "suspend", v.vmxPath)
+	if _, _, err := runAndLog(cmd); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Resume powers on a suspended virtual machine, restoring its saved state.
+// Note that vmrun's unpause only applies to paused virtual machines,
+// suspended ones are resumed from their checkpoint when started.
+func (v *Fusion7VM) Resume(headless bool) error {
+	return v.Start(headless)
+}
+
 // Delete removes a virtual machine using normal vmrun means.
 func (v *Fusion7VM) Delete() error {
 	if err := v.verifyVMXPath(); err != nil {
@@ -227,6 +230,15 @@ func (v *Fusion7VM) IsRunning() (bool, error) {
 	return false, nil
 }
 
+// IsSuspended returns whether or not a virtual machine is suspended.
+func (v *Fusion7VM) IsSuspended() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	return readVMXSuspended(v.vmxPath)
+}
+
 // HasToolsInstalled returns whether or not VMWare Tools is running in the VM.
 func (v *Fusion7VM) HasToolsInstalled() (bool, error) {
 	if err := v.verifyVMXPath(); err != nil {
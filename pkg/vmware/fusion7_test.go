@@ -0,0 +1,155 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain turns the test binary into a fake vmrun program when FAKE_VMRUN
+// is set, so that drivers shelling out to vmrun can be tested against it.
+func TestMain(m *testing.M) {
+	if os.Getenv("FAKE_VMRUN") == "1" {
+		host, err := NewFakeHostFromEnv()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+			os.Exit(255)
+		}
+		os.Exit(host.RunCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
+	os.Exit(m.Run())
+}
+
+// setupFakeVMRun points vmrun to the fake program and creates a gold
+// virtual machine to clone from.
+func setupFakeVMRun(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-vmware")
+	ok(t, err)
+
+	os.Setenv("FAKE_VMRUN", "1")
+	os.Setenv("FAKE_VMRUN_STATE_DIR", filepath.Join(dir, "state"))
+	os.Setenv("VMWARE_VMRUN_PATH", os.Args[0])
+
+	goldvmx := filepath.Join(dir, "gold", "gold.vmx")
+	ok(t, os.MkdirAll(filepath.Dir(goldvmx), 0740))
+	ok(t, writeVMXFile(goldvmx, map[string]string{
+		"displayname": "gold",
+		"numvcpus":    "1",
+		"memsize":     "512",
+		"guestos":     "darwin14-64",
+	}))
+
+	return goldvmx, func() {
+		os.Unsetenv("FAKE_VMRUN")
+		os.Unsetenv("FAKE_VMRUN_STATE_DIR")
+		os.Unsetenv("FAKE_VMRUN_FAIL")
+		os.Unsetenv("VMWARE_VMRUN_PATH")
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFusion7Lifecycle(t *testing.T) {
+	goldvmx, cleanup := setupFakeVMRun(t)
+	defer cleanup()
+
+	vmxPath := filepath.Join(filepath.Dir(filepath.Dir(goldvmx)), "vm1", "vm1.vmx")
+	vm, err := NewFusion7VM(vmxPath)
+	ok(t, err)
+
+	exists, err := vm.Exists()
+	ok(t, err)
+	assert(t, !exists, "%s should not exist yet", vmxPath)
+
+	ok(t, vm.CloneFrom(goldvmx, CloneLinked))
+	ok(t, vm.SetInfo(&VMInfo{
+		Name:        "vm1",
+		CPUs:        2,
+		MemorySize:  1024,
+		NetworkType: NetworkNAT,
+	}))
+
+	info, err := vm.Info()
+	ok(t, err)
+	equals(t, 2, info.CPUs)
+	equals(t, 1024, info.MemorySize)
+	equals(t, NetworkNAT, info.NetworkType)
+	equals(t, "darwin14-64", info.GuestOS)
+
+	ok(t, vm.Start(true))
+
+	running, err := vm.IsRunning()
+	ok(t, err)
+	assert(t, running, "%s should be running", vmxPath)
+
+	ip, err := vm.IPAddress()
+	ok(t, err)
+	assert(t, strings.HasPrefix(ip, "192.168."), "unexpected IP address %q", ip)
+
+	ok(t, vm.Suspend())
+
+	suspended, err := vm.IsSuspended()
+	ok(t, err)
+	assert(t, suspended, "%s should be suspended", vmxPath)
+
+	running, err = vm.IsRunning()
+	ok(t, err)
+	assert(t, !running, "%s should not be running while suspended", vmxPath)
+
+	ok(t, vm.Resume(true))
+
+	suspended, err = vm.IsSuspended()
+	ok(t, err)
+	assert(t, !suspended, "%s should have been resumed", vmxPath)
+
+	// Starting a suspended virtual machine resumes it as well.
+	ok(t, vm.Suspend())
+	ok(t, vm.Start(true))
+
+	suspended, err = vm.IsSuspended()
+	ok(t, err)
+	assert(t, !suspended, "%s should have been resumed by starting it", vmxPath)
+
+	running, err = vm.IsRunning()
+	ok(t, err)
+	assert(t, running, "%s should be running once resumed", vmxPath)
+
+	ok(t, vm.Reset(PowerSoft))
+	ok(t, vm.Stop(PowerHard))
+
+	err = vm.Stop(PowerSoft)
+	assert(t, err != nil, "stopping a powered off virtual machine should fail")
+
+	running, err = vm.IsRunning()
+	ok(t, err)
+	assert(t, !running, "%s should be stopped", vmxPath)
+
+	ok(t, vm.Delete())
+
+	exists, err = vm.Exists()
+	ok(t, err)
+	assert(t, !exists, "%s should have been deleted", vmxPath)
+}
+
+func TestFusion7InjectedFailure(t *testing.T) {
+	goldvmx, cleanup := setupFakeVMRun(t)
+	defer cleanup()
+
+	os.Setenv("FAKE_VMRUN_FAIL", "start=license expired")
+
+	vmxPath := filepath.Join(filepath.Dir(filepath.Dir(goldvmx)), "vm1", "vm1.vmx")
+	vm, err := NewFusion7VM(vmxPath)
+	ok(t, err)
+	ok(t, vm.CloneFrom(goldvmx, CloneLinked))
+
+	err = vm.Start(false)
+	assert(t, err != nil, "an error was expected when starting the virtual machine")
+	assert(t, strings.Contains(err.Error(), "license expired"), "unexpected error: %s", err)
+}
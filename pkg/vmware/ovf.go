@@ -0,0 +1,570 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// OVFError is returned when an OVF descriptor cannot be turned into a VMX
+// file.
+type OVFError struct {
+	// Path of the OVF descriptor
+	Path string
+	// What is wrong with the descriptor
+	Reason string
+}
+
+// Implements Error interface.
+func (e *OVFError) Error() string {
+	return fmt.Sprintf("[VMWare] Invalid OVF descriptor %s: %s", filepath.Base(e.Path), e.Reason)
+}
+
+// ovfEnvelope is the root element of OVF descriptors. Elements are matched
+// regardless of their namespace, which differs between OVF 1.x and 2.x.
+type ovfEnvelope struct {
+	XMLName       xml.Name          `xml:"Envelope"`
+	Files         []ovfFile         `xml:"References>File"`
+	Disks         []ovfDisk         `xml:"DiskSection>Disk"`
+	VirtualSystem *ovfVirtualSystem `xml:"VirtualSystem"`
+	Collection    *struct{}         `xml:"VirtualSystemCollection"`
+}
+
+// ovfFile is a file referenced by an OVF descriptor, relative to it.
+type ovfFile struct {
+	ID   string `xml:"id,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// ovfDisk is a virtual disk, backed by one of the referenced files.
+type ovfDisk struct {
+	ID      string `xml:"diskId,attr"`
+	FileRef string `xml:"fileRef,attr"`
+	Format  string `xml:"format,attr"`
+}
+
+// ovfVirtualSystem describes a virtual machine.
+type ovfVirtualSystem struct {
+	ID         string `xml:"id,attr"`
+	Name       string `xml:"Name"`
+	Annotation string `xml:"AnnotationSection>Annotation"`
+	OS         struct {
+		ID     int    `xml:"id,attr"`
+		OSType string `xml:"osType,attr"`
+	} `xml:"OperatingSystemSection"`
+	Hardware []ovfHardware `xml:"VirtualHardwareSection"`
+}
+
+// ovfHardware is the virtual hardware of a virtual machine.
+type ovfHardware struct {
+	SystemType string `xml:"System>VirtualSystemType"`
+	// OVF 1.x describes all devices as Item, OVF 2.x has dedicated elements
+	// for NICs and disks.
+	Items        []ovfItem `xml:"Item"`
+	NICItems     []ovfItem `xml:"EthernetPortItem"`
+	StorageItems []ovfItem `xml:"StorageItem"`
+	// VMware specific settings
+	Config      []ovfConfig `xml:"Config"`
+	ExtraConfig []ovfConfig `xml:"ExtraConfig"`
+}
+
+// ovfItem is a virtual device, as a CIM resource allocation setting.
+type ovfItem struct {
+	InstanceID      string   `xml:"InstanceID"`
+	ResourceType    int      `xml:"ResourceType"`
+	ResourceSubType string   `xml:"ResourceSubType"`
+	Parent          string   `xml:"Parent"`
+	Address         string   `xml:"Address"`
+	AddressOnParent string   `xml:"AddressOnParent"`
+	HostResource    []string `xml:"HostResource"`
+	Connection      []string `xml:"Connection"`
+	VirtualQuantity int64    `xml:"VirtualQuantity"`
+	AllocationUnits string   `xml:"AllocationUnits"`
+	CoresPerSocket  int      `xml:"CoresPerSocket"`
+}
+
+// ovfConfig is a VMware specific setting, written by VMware when exporting.
+type ovfConfig struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// CIM resource types of the virtual devices mapped into VMX files.
+const (
+	resourceCPU            = 3
+	resourceMemory         = 4
+	resourceIDEController  = 5
+	resourceSCSIController = 6
+	resourceEthernet       = 10
+	resourceCDDrive        = 15
+	resourceDVDDrive       = 16
+	resourceDisk           = 17
+	resourceOtherStorage   = 20
+	resourceUSBController  = 23
+	resourceSoundCard      = 35
+)
+
+// CIM operating system IDs, used when the descriptor does not have the VMware
+// guest OS.
+var ovfGuestOSes = map[int]string{
+	1:   "other",
+	36:  "otherlinux",
+	101: "otherlinux-64",
+	102: "other-64",
+}
+
+// OVF network adapter types and their VMX counterparts.
+var ovfNICTypes = map[string]string{
+	"e1000":   "e1000",
+	"e1000e":  "e1000e",
+	"pcnet32": "vlance",
+	"vmxnet":  "vmxnet",
+	"vmxnet2": "vmxnet",
+	"vmxnet3": "vmxnet3",
+}
+
+// OVF SCSI controller types and their VMX counterparts.
+var ovfSCSITypes = map[string]string{
+	"lsilogic":    "lsilogic",
+	"lsilogicsas": "lsisas1068",
+	"buslogic":    "buslogic",
+	"virtualscsi": "pvscsi",
+}
+
+// ExtraConfig settings copied from OVF descriptors into VMX files. Others,
+// i.e.: serial ports, shared folders or anything pointing at files, could
+// expose the host to whoever built the image, so they are left out.
+var ovfExtraConfigKeys = map[string]bool{
+	"board-id":                      true,
+	"board-id.reflecthost":          true,
+	"cpuid.corespersocket":          true,
+	"ehci.present":                  true,
+	"hw.model":                      true,
+	"hw.model.reflecthost":          true,
+	"ich7m.present":                 true,
+	"keyboard.vusb.enable":          true,
+	"mouse.vusb.enable":             true,
+	"smbios.reflecthost":            true,
+	"smc.present":                   true,
+	"smc.version":                   true,
+	"svga.vramsize":                 true,
+	"tools.synctime":                true,
+	"tools.upgrade.policy":          true,
+	"usb.present":                   true,
+	"usb.vbluetooth.startconnected": true,
+	"vhv.enable":                    true,
+}
+
+// ImportOVF generates the VMX file at vmxPath out of the OVF descriptor at
+// ovfPath, i.e.: the one found in OVA packages, mapping its CPUs, memory,
+// network adapters, disks and guest OS. The VMX file must be in the same
+// directory as the descriptor, as disks are referenced relative to it.
+//
+// Disks exported in the streamOptimized format, which VMware cannot run
+// virtual machines from, are converted in place with vmware-vdiskmanager.
+// An *OVFError is returned if there are such disks and it is not found.
+func ImportOVF(ovfPath, vmxPath string) error {
+	if filepath.Dir(ovfPath) != filepath.Dir(vmxPath) {
+		return fmt.Errorf("[VMWare] VMX file %s must be next to OVF descriptor %s", vmxPath, ovfPath)
+	}
+
+	file, err := os.Open(ovfPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var envelope ovfEnvelope
+	if err := xml.NewDecoder(file).Decode(&envelope); err != nil {
+		return &OVFError{ovfPath, err.Error()}
+	}
+
+	vmx, converts, err := ovfToVMX(&envelope, filepath.Dir(ovfPath))
+	if err != nil {
+		return &OVFError{ovfPath, err.Error()}
+	}
+
+	for _, disk := range converts {
+		if err := convertStreamOptimized(ovfPath, disk); err != nil {
+			return err
+		}
+	}
+
+	return writeVMXFile(vmxPath, vmx)
+}
+
+// ovfToVMX maps an OVF descriptor into VMX settings. Disks are looked for in
+// dir. It also returns the disks in the streamOptimized format.
+func ovfToVMX(envelope *ovfEnvelope, dir string) (map[string]string, []string, error) {
+	if envelope.Collection != nil {
+		return nil, nil, fmt.Errorf("only descriptors with a single virtual machine are supported")
+	}
+
+	system := envelope.VirtualSystem
+	if system == nil || len(system.Hardware) == 0 {
+		return nil, nil, fmt.Errorf("no virtual machine hardware found")
+	}
+	hw := system.Hardware[0]
+
+	name := system.Name
+	if name == "" {
+		name = system.ID
+	}
+
+	vmx := map[string]string{
+		".encoding":         "UTF-8",
+		"config.version":    "8",
+		"virtualhw.version": "9",
+		"displayname":       name,
+		"annotation":        system.Annotation,
+		"guestos":           ovfGuestOS(system.OS.OSType, system.OS.ID),
+		"numvcpus":          "1",
+		"memsize":           "512",
+		"floppy0.present":   "FALSE",
+		"msg.autoanswer":    "true",
+	}
+
+	for _, systemType := range strings.Fields(hw.SystemType) {
+		if strings.HasPrefix(systemType, "vmx-") {
+			vmx["virtualhw.version"] = strings.TrimLeft(strings.TrimPrefix(systemType, "vmx-"), "0")
+			break
+		}
+	}
+
+	files := make(map[string]string)
+	for _, f := range envelope.Files {
+		files[f.ID] = f.Href
+	}
+
+	disks := make(map[string]ovfDisk)
+	for _, d := range envelope.Disks {
+		disks[d.ID] = d
+	}
+
+	items := append(append(append([]ovfItem(nil), hw.Items...), hw.NICItems...), hw.StorageItems...)
+
+	// Controllers come first, as disks refer to them.
+	controllers := make(map[string]string)
+	buses := make(map[string]int)
+	for _, item := range items {
+		var bus string
+		switch item.ResourceType {
+		case resourceIDEController:
+			bus = "ide"
+		case resourceSCSIController:
+			bus = "scsi"
+		case resourceOtherStorage:
+			subType := strings.ToLower(item.ResourceSubType)
+			switch {
+			case strings.Contains(subType, "ahci") || strings.Contains(subType, "sata"):
+				bus = "sata"
+			case strings.Contains(subType, "nvme"):
+				bus = "nvme"
+			default:
+				return nil, nil, fmt.Errorf("unsupported storage controller %q", item.ResourceSubType)
+			}
+		default:
+			continue
+		}
+
+		number := buses[bus]
+		if n, err := strconv.Atoi(item.Address); err == nil {
+			number = n
+		}
+		buses[bus] = number + 1
+
+		controller := fmt.Sprintf("%s%d", bus, number)
+		controllers[item.InstanceID] = controller
+
+		// IDE controllers are always there.
+		if bus == "ide" {
+			continue
+		}
+		vmx[controller+".present"] = "TRUE"
+
+		if bus == "scsi" {
+			virtualDev, ok := ovfSCSITypes[strings.ToLower(item.ResourceSubType)]
+			if !ok {
+				virtualDev = "lsilogic"
+			}
+			vmx[controller+".virtualdev"] = virtualDev
+		}
+	}
+
+	var converts []string
+	nics := 0
+	units := make(map[string]int)
+	// Devices indexed by their controller and unit, i.e.: sata0:1
+	devices := make(map[string]string)
+	for _, item := range items {
+		switch item.ResourceType {
+		case resourceCPU:
+			if item.VirtualQuantity > 0 {
+				vmx["numvcpus"] = strconv.FormatInt(item.VirtualQuantity, 10)
+			}
+			if item.CoresPerSocket > 0 {
+				vmx["cpuid.corespersocket"] = strconv.Itoa(item.CoresPerSocket)
+			}
+
+		case resourceMemory:
+			unit, err := allocationUnits(item.AllocationUnits)
+			if err != nil {
+				return nil, nil, err
+			}
+			if item.VirtualQuantity <= 0 || item.VirtualQuantity > math.MaxInt64/unit {
+				return nil, nil, fmt.Errorf("memory size %d %s is out of range", item.VirtualQuantity, item.AllocationUnits)
+			}
+
+			memsize := item.VirtualQuantity * unit / (1 << 20)
+			if memsize < 1 {
+				return nil, nil, fmt.Errorf("memory size %d %s is less than 1MB", item.VirtualQuantity, item.AllocationUnits)
+			}
+			vmx["memsize"] = strconv.FormatInt(memsize, 10)
+
+		case resourceEthernet:
+			nic := fmt.Sprintf("ethernet%d", nics)
+			nics++
+
+			virtualDev, ok := ovfNICTypes[strings.ToLower(item.ResourceSubType)]
+			if !ok {
+				virtualDev = "e1000"
+			}
+
+			vmx[nic+".present"] = "TRUE"
+			vmx[nic+".startconnected"] = "TRUE"
+			vmx[nic+".virtualdev"] = virtualDev
+			vmx[nic+".connectiontype"] = string(NetworkNAT)
+			vmx[nic+".addresstype"] = "generated"
+
+		case resourceDisk, resourceCDDrive, resourceDVDDrive:
+			controller, ok := controllers[item.Parent]
+			if !ok {
+				return nil, nil, fmt.Errorf("device %s has no controller", item.InstanceID)
+			}
+
+			unit := units[controller]
+			if n, err := strconv.Atoi(item.AddressOnParent); err == nil {
+				unit = n
+			}
+			units[controller] = unit + 1
+
+			device := fmt.Sprintf("%s:%d", controller, unit)
+			if other, ok := devices[device]; ok {
+				return nil, nil, fmt.Errorf("devices %s and %s are both at %s", other, item.InstanceID, device)
+			}
+			devices[device] = item.InstanceID
+			vmx[device+".present"] = "TRUE"
+
+			href, disk, err := ovfHostResource(item, files, disks)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if href != "" {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(href))); err != nil {
+					return nil, nil, fmt.Errorf("file %s is missing", href)
+				}
+			}
+
+			if item.ResourceType != resourceDisk {
+				if href == "" {
+					vmx[device+".devicetype"] = "cdrom-raw"
+					vmx[device+".filename"] = "auto detect"
+					vmx[device+".startconnected"] = "FALSE"
+				} else {
+					vmx[device+".devicetype"] = "cdrom-image"
+					vmx[device+".filename"] = href
+				}
+				continue
+			}
+
+			if href == "" {
+				return nil, nil, fmt.Errorf("disk %s has no file", item.InstanceID)
+			}
+			vmx[device+".filename"] = href
+
+			if strings.HasSuffix(strings.ToLower(disk.Format), "#streamoptimized") {
+				converts = append(converts, filepath.Join(dir, filepath.FromSlash(href)))
+			}
+
+		case resourceUSBController:
+			vmx["usb.present"] = "TRUE"
+			if strings.Contains(strings.ToLower(item.ResourceSubType), "ehci") {
+				vmx["ehci.present"] = "TRUE"
+			}
+
+		case resourceSoundCard:
+			vmx["sound.present"] = "TRUE"
+		}
+	}
+
+	for _, config := range hw.Config {
+		if config.Key == "firmware" {
+			vmx["firmware"] = config.Value
+		}
+	}
+
+	for _, config := range hw.ExtraConfig {
+		key := strings.ToLower(config.Key)
+		if !ovfExtraConfigKeys[key] {
+			log.Printf("[WARN] Ignoring unsupported OVF ExtraConfig setting %q", config.Key)
+			continue
+		}
+		vmx[key] = config.Value
+	}
+
+	return vmx, converts, nil
+}
+
+// ovfHostResource returns the file backing a disk or CD-ROM drive, relative
+// to the descriptor, along with its disk. It returns an empty path if the
+// device has no file.
+func ovfHostResource(item ovfItem, files map[string]string, disks map[string]ovfDisk) (string, ovfDisk, error) {
+	var disk ovfDisk
+	if len(item.HostResource) == 0 || item.HostResource[0] == "" {
+		return "", disk, nil
+	}
+
+	resource := item.HostResource[0]
+	var fileRef string
+	switch {
+	case strings.HasPrefix(resource, "ovf:/disk/"), strings.HasPrefix(resource, "/disk/"):
+		var ok bool
+		disk, ok = disks[path.Base(resource)]
+		if !ok {
+			return "", disk, fmt.Errorf("disk %s is not described", resource)
+		}
+		fileRef = disk.FileRef
+	case strings.HasPrefix(resource, "ovf:/file/"), strings.HasPrefix(resource, "/file/"):
+		fileRef = path.Base(resource)
+	default:
+		return "", disk, fmt.Errorf("unsupported host resource %q", resource)
+	}
+
+	// Disks with no file are created empty when deploying, which is not
+	// supported.
+	href, ok := files[fileRef]
+	if !ok {
+		return "", disk, fmt.Errorf("%s has no file", resource)
+	}
+
+	// Files must be within the directory of the descriptor.
+	clean := path.Clean(href)
+	if href == "" || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") ||
+		strings.Contains(href, "://") || strings.Contains(href, "\\") {
+		return "", disk, fmt.Errorf("file %q is not next to the descriptor", href)
+	}
+
+	return clean, disk, nil
+}
+
+// ovfGuestOS returns the VMX guest OS given the VMware guest OS of a
+// descriptor, i.e.: darwin14_64Guest, or its CIM operating system ID.
+func ovfGuestOS(osType string, cimID int) string {
+	if osType != "" {
+		guest := strings.ToLower(strings.TrimSuffix(osType, "Guest"))
+		switch {
+		case strings.HasSuffix(guest, "_64"):
+			guest = strings.TrimSuffix(guest, "_64") + "-64"
+		case strings.HasSuffix(guest, "64"):
+			guest = strings.TrimSuffix(guest, "64") + "-64"
+		}
+		return guest
+	}
+
+	if guest, ok := ovfGuestOSes[cimID]; ok {
+		return guest
+	}
+	return "other"
+}
+
+// allocationUnits returns the number of bytes in the given OVF allocation
+// units, i.e.: byte * 2^20 or MegaBytes.
+func allocationUnits(units string) (int64, error) {
+	u := strings.ToLower(strings.Replace(units, " ", "", -1))
+	switch u {
+	case "", "megabytes", "mb":
+		// Memory is given in megabytes if not said otherwise.
+		return 1 << 20, nil
+	case "byte", "bytes":
+		return 1, nil
+	case "kilobytes", "kb":
+		return 1 << 10, nil
+	case "gigabytes", "gb":
+		return 1 << 30, nil
+	}
+
+	if strings.HasPrefix(u, "byte*") {
+		factor := strings.TrimPrefix(u, "byte*")
+		if strings.HasPrefix(factor, "2^") {
+			exp, err := strconv.ParseUint(strings.TrimPrefix(factor, "2^"), 10, 6)
+			if err == nil && exp < 63 {
+				return 1 << exp, nil
+			}
+		} else if n, err := strconv.ParseInt(factor, 10, 64); err == nil && n > 0 {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unsupported allocation units %q", units)
+}
+
+// Default locations of vmware-vdiskmanager, in order of preference, used
+// when it is not found in $PATH.
+var vdiskManagerPaths = []string{
+	"/Applications/VMware Fusion.app/Contents/Library/vmware-vdiskmanager",
+	"/usr/bin/vmware-vdiskmanager",
+	"/usr/local/bin/vmware-vdiskmanager",
+}
+
+// lookupVDiskManagerPath finds vmware-vdiskmanager in the local filesystem.
+// VMWARE_VDISKMANAGER_PATH takes precedence over $PATH and the default
+// installation paths.
+func lookupVDiskManagerPath() (string, error) {
+	if path := os.Getenv("VMWARE_VDISKMANAGER_PATH"); path != "" {
+		return path, nil
+	}
+
+	if path, err := exec.LookPath("vmware-vdiskmanager"); err == nil {
+		return path, nil
+	}
+
+	for _, path := range vdiskManagerPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", fmt.Errorf("[VMWare] vmware-vdiskmanager program not found in $PATH nor in %v", vdiskManagerPaths)
+}
+
+// convertStreamOptimized converts a streamOptimized disk of the OVF
+// descriptor at ovfPath, as found in OVA packages, into a growable disk
+// VMware can run virtual machines from.
+func convertStreamOptimized(ovfPath, disk string) error {
+	vdiskManager, err := lookupVDiskManagerPath()
+	if err != nil {
+		return &OVFError{ovfPath, fmt.Sprintf("vmware-vdiskmanager, needed to convert streamOptimized disk %s, "+
+			"was not found in $PATH nor in %v", filepath.Base(disk), vdiskManagerPaths)}
+	}
+
+	converted := strings.TrimSuffix(disk, filepath.Ext(disk)) + ".converted.vmdk"
+	os.Remove(converted)
+	if _, _, err := runAndLog(exec.Command(vdiskManager, "-r", disk, "-t", "0", converted)); err != nil {
+		os.Remove(converted)
+		return err
+	}
+
+	return os.Rename(converted, disk)
+}
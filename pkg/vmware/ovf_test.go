@@ -0,0 +1,335 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOVF is an OVF descriptor as exported by VMware ovftool.
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope vmw:buildId="build-2496824" xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:cim="http://schemas.dmtf.org/wbem/wscim/1/common" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+  <References>
+    <File ovf:href="osx-disk1.vmdk" ovf:id="file1" ovf:size="1045504"/>
+    <File ovf:href="tools/darwin.iso" ovf:id="file2" ovf:size="4096"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disk information</Info>
+    <Disk ovf:capacity="40" ovf:capacityAllocationUnits="byte * 2^30" ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized" ovf:populatedSize="1310720"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>The list of logical networks</Info>
+    <Network ovf:name="nat">
+      <Description>The nat network</Description>
+    </Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="osx-10.11">
+    <Info>A virtual machine</Info>
+    <Name>osx-10.11</Name>
+    <AnnotationSection>
+      <Info>A human-readable annotation</Info>
+      <Annotation>OS X El Capitan</Annotation>
+    </AnnotationSection>
+    <OperatingSystemSection ovf:id="1" vmw:osType="darwin15_64Guest">
+      <Info>The kind of installed guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware requirements</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>osx-10.11</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-11</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:ElementName>2 virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>2</rasd:VirtualQuantity>
+        <vmw:CoresPerSocket ovf:required="false">2</vmw:CoresPerSocket>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:ElementName>4096MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>4096</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:ElementName>SATA Controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>vmware.sata.ahci</rasd:ResourceSubType>
+        <rasd:ResourceType>20</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard Disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item ovf:required="false">
+        <rasd:AddressOnParent>1</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>false</rasd:AutomaticAllocation>
+        <rasd:ElementName>CD-ROM 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/file/file2</rasd:HostResource>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>15</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>2</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>nat</rasd:Connection>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>6</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000e</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+      <Item ovf:required="false">
+        <rasd:Address>0</rasd:Address>
+        <rasd:ElementName>USB Controller (EHCI)</rasd:ElementName>
+        <rasd:InstanceID>7</rasd:InstanceID>
+        <rasd:ResourceSubType>vmware.usb.ehci</rasd:ResourceSubType>
+        <rasd:ResourceType>23</rasd:ResourceType>
+      </Item>
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="efi"/>
+      <vmw:ExtraConfig ovf:required="false" vmw:key="smc.present" vmw:value="TRUE"/>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// setupOVF writes an OVF descriptor, along with the files it references,
+// into a temporary directory.
+func setupOVF(t *testing.T, descriptor string) (string, func()) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-ovf")
+	ok(t, err)
+
+	ok(t, os.MkdirAll(filepath.Join(dir, "tools"), 0755))
+	ok(t, ioutil.WriteFile(filepath.Join(dir, "osx-disk1.vmdk"), []byte("streamOptimized"), 0644))
+	ok(t, ioutil.WriteFile(filepath.Join(dir, "tools", "darwin.iso"), []byte("iso"), 0644))
+
+	ovfPath := filepath.Join(dir, "osx.ovf")
+	ok(t, ioutil.WriteFile(ovfPath, []byte(descriptor), 0644))
+
+	return ovfPath, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// fakeVDiskManager fakes vmware-vdiskmanager -r src -t 0 dst in dir. The
+// returned function undoes it.
+func fakeVDiskManager(t *testing.T, dir string) func() {
+	vdiskManager := filepath.Join(dir, "vmware-vdiskmanager")
+	ok(t, ioutil.WriteFile(vdiskManager, []byte("#!/bin/sh\necho converted > \"$5\"\n"), 0755))
+
+	os.Setenv("VMWARE_VDISKMANAGER_PATH", vdiskManager)
+	return func() {
+		os.Unsetenv("VMWARE_VDISKMANAGER_PATH")
+	}
+}
+
+func TestImportOVF(t *testing.T) {
+	ovfPath, cleanup := setupOVF(t, testOVF)
+	defer cleanup()
+
+	dir := filepath.Dir(ovfPath)
+	defer fakeVDiskManager(t, dir)()
+
+	vmxPath := filepath.Join(dir, "osx.vmx")
+	ok(t, ImportOVF(ovfPath, vmxPath))
+
+	vmx, err := readVMXFile(vmxPath)
+	ok(t, err)
+
+	for key, value := range map[string]string{
+		"displayname":              "osx-10.11",
+		"annotation":               "OS X El Capitan",
+		"guestos":                  "darwin15-64",
+		"virtualhw.version":        "11",
+		"numvcpus":                 "2",
+		"cpuid.corespersocket":     "2",
+		"memsize":                  "4096",
+		"sata0.present":            "TRUE",
+		"sata0:0.present":          "TRUE",
+		"sata0:0.filename":         "osx-disk1.vmdk",
+		"sata0:1.devicetype":       "cdrom-image",
+		"sata0:1.filename":         "tools/darwin.iso",
+		"ethernet0.present":        "TRUE",
+		"ethernet0.virtualdev":     "e1000e",
+		"ethernet0.connectiontype": "nat",
+		"usb.present":              "TRUE",
+		"ehci.present":             "TRUE",
+		"firmware":                 "efi",
+		"smc.present":              "TRUE",
+	} {
+		equals(t, value, vmx[key])
+	}
+
+	info, err := readVMXInfo(vmxPath)
+	ok(t, err)
+	equals(t, 2, info.CPUs)
+	equals(t, 4096, info.MemorySize)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "osx-disk1.vmdk"))
+	ok(t, err)
+	equals(t, "converted\n", string(data))
+}
+
+func TestImportOVFUnsafeSettings(t *testing.T) {
+	annotation := "OS X\"\nserial0.present = \"TRUE\"\nserial0.fileName = \"/etc/passwd\" |22"
+	descriptor := strings.Replace(testOVF, "<Annotation>OS X El Capitan</Annotation>",
+		"<Annotation>"+strings.Replace(annotation, `"`, "&quot;", -1)+"</Annotation>", 1)
+	descriptor = strings.Replace(descriptor, "</VirtualHardwareSection>", `
+      <vmw:ExtraConfig ovf:required="false" vmw:key="serial0.fileName" vmw:value="/etc/passwd"/>
+      <vmw:ExtraConfig ovf:required="false" vmw:key="sharedFolder0.hostPath" vmw:value="/"/>
+      <vmw:ExtraConfig ovf:required="false" vmw:key="sata0:0.fileName" vmw:value="/dev/sda"/>
+      <vmw:ExtraConfig ovf:required="false" vmw:key="parallel0.fileName" vmw:value="/etc/shadow"/>
+      <vmw:ExtraConfig ovf:required="false" vmw:key="board-id" vmw:value="Mac-&quot;42"/>
+    </VirtualHardwareSection>`, 1)
+
+	ovfPath, cleanup := setupOVF(t, descriptor)
+	defer cleanup()
+	defer fakeVDiskManager(t, filepath.Dir(ovfPath))()
+
+	vmxPath := strings.TrimSuffix(ovfPath, ".ovf") + ".vmx"
+	ok(t, ImportOVF(ovfPath, vmxPath))
+
+	data, err := ioutil.ReadFile(vmxPath)
+	ok(t, err)
+	for _, line := range strings.Split(string(data), "\n") {
+		key := strings.ToLower(line)
+		assert(t, !strings.HasPrefix(key, "serial") && !strings.HasPrefix(key, "parallel") &&
+			!strings.HasPrefix(key, "sharedfolder"), "unsafe setting written: %s", line)
+	}
+
+	vmx, err := readVMXFile(vmxPath)
+	ok(t, err)
+	equals(t, annotation, vmx["annotation"])
+	equals(t, "osx-disk1.vmdk", vmx["sata0:0.filename"])
+	equals(t, `Mac-"42`, vmx["board-id"])
+	assert(t, strings.Contains(string(data), `annotation = "OS X|22|0Aserial0.present = |22TRUE|22|0A`),
+		"annotation should be encoded like VMware does: %s", data)
+}
+
+func TestImportOVFWithoutVDiskManager(t *testing.T) {
+	ovfPath, cleanup := setupOVF(t, testOVF)
+	defer cleanup()
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", filepath.Dir(ovfPath))
+
+	defaultPaths := vdiskManagerPaths
+	defer func() { vdiskManagerPaths = defaultPaths }()
+	vdiskManagerPaths = nil
+
+	vmxPath := strings.TrimSuffix(ovfPath, ".ovf") + ".vmx"
+	err := ImportOVF(ovfPath, vmxPath)
+	ovfErr, invalid := err.(*OVFError)
+	assert(t, invalid, "an OVF error was expected, got %v", err)
+	assert(t, strings.Contains(ovfErr.Reason, "osx-disk1.vmdk") && strings.Contains(ovfErr.Reason, "vmware-vdiskmanager"),
+		"the disk and the missing tool should be named: %s", ovfErr.Reason)
+
+	_, err = os.Stat(vmxPath)
+	assert(t, os.IsNotExist(err), "no VMX file should be written")
+
+	data, err := ioutil.ReadFile(filepath.Join(filepath.Dir(ovfPath), "osx-disk1.vmdk"))
+	ok(t, err)
+	equals(t, "streamOptimized", string(data))
+}
+
+func TestImportInvalidOVF(t *testing.T) {
+	var tests = []struct {
+		desc       string
+		descriptor string
+	}{
+		{"not xml", "osx"},
+		{"missing disk", strings.Replace(testOVF, `ovf:href="osx-disk1.vmdk"`, `ovf:href="missing.vmdk"`, 1)},
+		{"disk outside", strings.Replace(testOVF, `ovf:href="osx-disk1.vmdk"`, `ovf:href="../osx-disk1.vmdk"`, 1)},
+		{"absolute disk", strings.Replace(testOVF, `ovf:href="osx-disk1.vmdk"`, `ovf:href="/etc/passwd"`, 1)},
+		{"remote disk", strings.Replace(testOVF, `ovf:href="osx-disk1.vmdk"`, `ovf:href="http://example.com/osx-disk1.vmdk"`, 1)},
+		{"undescribed disk", strings.Replace(testOVF, "ovf:/disk/vmdisk1", "ovf:/disk/vmdisk2", 1)},
+		{"no controller", strings.Replace(testOVF, "<rasd:Parent>3</rasd:Parent>", "<rasd:Parent>9</rasd:Parent>", 1)},
+		{"memory units", strings.Replace(testOVF, "byte * 2^20", "bits", 1)},
+		{"no memory", strings.Replace(testOVF, "<rasd:VirtualQuantity>4096</rasd:VirtualQuantity>",
+			"<rasd:VirtualQuantity>0</rasd:VirtualQuantity>", 1)},
+		{"memory under 1MB", strings.Replace(testOVF, "byte * 2^20", "bytes", 1)},
+		{"memory overflow", strings.Replace(testOVF, "<rasd:VirtualQuantity>4096</rasd:VirtualQuantity>",
+			"<rasd:VirtualQuantity>9223372036854775807</rasd:VirtualQuantity>", 1)},
+		{"same unit", strings.Replace(testOVF, "<rasd:AddressOnParent>1</rasd:AddressOnParent>",
+			"<rasd:AddressOnParent>0</rasd:AddressOnParent>", 1)},
+		{"several machines", strings.Replace(strings.Replace(testOVF,
+			"<VirtualSystem ", "<VirtualSystemCollection ovf:id=\"vapp\"><VirtualSystem ", 1),
+			"</VirtualSystem>", "</VirtualSystem></VirtualSystemCollection>", 1)},
+	}
+
+	for _, test := range tests {
+		ovfPath, cleanup := setupOVF(t, test.descriptor)
+
+		vmxPath := strings.TrimSuffix(ovfPath, ".ovf") + ".vmx"
+		err := ImportOVF(ovfPath, vmxPath)
+		_, invalid := err.(*OVFError)
+		assert(t, invalid, "%s: an OVF error was expected, got %v", test.desc, err)
+
+		_, err = os.Stat(vmxPath)
+		assert(t, os.IsNotExist(err), "%s: no VMX file should be written", test.desc)
+		cleanup()
+	}
+}
+
+func TestOVFGuestOS(t *testing.T) {
+	var tests = []struct {
+		osType string
+		cimID  int
+		guest  string
+	}{
+		{"darwin14_64Guest", 0, "darwin14-64"},
+		{"darwin64Guest", 0, "darwin-64"},
+		{"ubuntu64Guest", 94, "ubuntu-64"},
+		{"windows7_64Guest", 0, "windows7-64"},
+		{"otherGuest", 1, "other"},
+		{"", 101, "otherlinux-64"},
+		{"", 0, "other"},
+	}
+
+	for _, test := range tests {
+		equals(t, test.guest, ovfGuestOS(test.osType, test.cimID))
+	}
+}
+
+func TestOVFAllocationUnits(t *testing.T) {
+	var tests = []struct {
+		units string
+		bytes int64
+	}{
+		{"byte * 2^20", 1 << 20},
+		{"byte*2^30", 1 << 30},
+		{"byte * 1024", 1024},
+		{"MegaBytes", 1 << 20},
+		{"", 1 << 20},
+		{"GB", 1 << 30},
+		{"byte", 1},
+	}
+
+	for _, test := range tests {
+		n, err := allocationUnits(test.units)
+		ok(t, err)
+		equals(t, test.bytes, n)
+	}
+
+	for _, units := range []string{"bits", "byte * 2^64", "byte * -1"} {
+		_, err := allocationUnits(units)
+		assert(t, err != nil, "%s should not be supported", units)
+	}
+}
@@ -29,6 +29,16 @@ const (
 	CloneLinked CloneType = "linked"
 )
 
+// PowerMode represents how power operations are carried out.
+type PowerMode string
+
+const (
+	// The guest OS is asked to carry out the operation through VMware Tools
+	PowerSoft PowerMode = "soft"
+	// The operation is carried out right away, as pulling the power cord
+	PowerHard PowerMode = "hard"
+)
+
 // VMInfo defines the minimum amount of VM properties needed either to be configured
 // or to be returned back for the purpose of this project.
 type VMInfo struct {
@@ -38,18 +48,23 @@ type VMInfo struct {
 	CPUs        int
 	GuestOS     string
 	NetworkType NetworkType
+	// Whether to launch the VM without graphical environment
+	Headless bool
 }
 
 // VirtualMachine defines the set of virtual machine operations used in this project.
 type VirtualMachine interface {
-	lookupVMRunPath() error
 	Info() (*VMInfo, error)
 	SetInfo(info *VMInfo) error
 	CloneFrom(srcfile string, ctype CloneType) error
 	Start(headless bool) error
-	Stop() error
+	Stop(mode PowerMode) error
+	Reset(mode PowerMode) error
+	Suspend() error
+	Resume(headless bool) error
 	Delete() error
 	IsRunning() (bool, error)
+	IsSuspended() (bool, error)
 	HasToolsInstalled() (bool, error)
 	IPAddress() (string, error)
 	Exists() (bool, error)
@@ -6,10 +6,13 @@ package vmware
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -22,14 +25,14 @@ func readVMXFile(vmxpath string) (map[string]string, error) {
 
 	vmx := make(map[string]string)
 	for _, line := range strings.Split(string(data), "\n") {
-		values := strings.Split(line, "=")
+		values := strings.SplitN(line, "=", 2)
 		if len(values) != 2 {
 			continue
 		}
 
 		k := strings.TrimSpace(values[0])
 		v := strings.TrimSpace(values[1])
-		vmx[strings.ToLower(k)] = strings.Trim(v, `"`)
+		vmx[strings.ToLower(k)] = decodeVMXValue(strings.Trim(v, `"`))
 	}
 
 	return vmx, nil
@@ -55,7 +58,7 @@ func writeVMXFile(vmxpath string, vmx map[string]string) error {
 
 	var buf bytes.Buffer
 	for _, key := range keys {
-		buf.WriteString(key + " = " + `"` + vmx[key] + `"`)
+		buf.WriteString(key + " = " + `"` + encodeVMXValue(vmx[key]) + `"`)
 		buf.WriteString("\n")
 	}
 
@@ -65,3 +68,144 @@ func writeVMXFile(vmxpath string, vmx map[string]string) error {
 
 	return nil
 }
+
+// encodeVMXValue escapes control characters, quotes and pipes the way VMware
+// does, as a pipe followed by their hexadecimal code, i.e.: |0A for line
+// feeds, so that values can't break out of their line.
+func encodeVMXValue(value string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < 0x20 || c == 0x7f || c == '"' || c == '|' {
+			fmt.Fprintf(&buf, "|%02X", c)
+			continue
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+// decodeVMXValue undoes encodeVMXValue. Pipes not followed by a hexadecimal
+// code are kept as they are.
+func decodeVMXValue(value string) string {
+	if !strings.Contains(value, "|") {
+		return value
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] == '|' && i+2 < len(value) {
+			if c, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				buf.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		buf.WriteByte(value[i])
+	}
+	return buf.String()
+}
+
+// readVMXInfo reads the virtual machine information out of the given VMX file path.
+func readVMXInfo(vmxpath string) (*VMInfo, error) {
+	vmx, err := readVMXFile(vmxpath)
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(VMInfo)
+	info.Name = vmx["displayname"]
+	info.Annotation = vmx["annotation"]
+
+	numcpus, err := strconv.ParseInt(vmx["numvcpus"], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	memsize, err := strconv.ParseInt(vmx["memsize"], 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	info.CPUs = int(numcpus)
+	info.MemorySize = int(memsize)
+	info.NetworkType = NetworkType(vmx["ethernet0.connectiontype"])
+	info.GuestOS = vmx["guestos"]
+	info.Headless = vmx["osxbuilder.headless"] == "true"
+
+	return info, nil
+}
+
+// writeVMXInfo stores the virtual machine information in the given VMX file path.
+func writeVMXInfo(vmxpath string, info *VMInfo) error {
+	vmx, err := readVMXFile(vmxpath)
+	if err != nil {
+		return err
+	}
+
+	vmx["displayname"] = info.Name
+	vmx["annotation"] = info.Annotation
+	vmx["numvcpus"] = strconv.Itoa(info.CPUs)
+	vmx["memsize"] = strconv.Itoa(info.MemorySize)
+	vmx["osxbuilder.headless"] = strconv.FormatBool(info.Headless)
+
+	// This is to make sure to auto answer popups windows in the GUI. This is
+	// especially helpful when running in headless mode
+	vmx["msg.autoanswer"] = "true"
+
+	// The following settings does nothing in Fusion7.
+	// vmx["gui.exitatpoweroff"] = "true"
+	// vmx["gui.restricted"] = "true"
+	// vmx["gui.exitonclihlt"] = "true"
+
+	// Keeps the adapter model of the gold image, such as the one set when
+	// importing an OVF descriptor, as the guest OS may only have drivers for
+	// that one.
+	virtualDev := vmx["ethernet0.virtualdev"]
+	if virtualDev == "" {
+		virtualDev = "e1000"
+	}
+
+	// Deletes all network adapters. For the simplicity's sake
+	// we are going to deliberately use only one network adapter.
+	for k, _ := range vmx {
+		if strings.HasPrefix(k, "ethernet") {
+			delete(vmx, k)
+		}
+	}
+
+	vmx["ethernet0.present"] = "true"
+	vmx["ethernet0.startconnected"] = "true"
+	vmx["ethernet0.virtualdev"] = virtualDev
+	vmx["ethernet0.connectiontype"] = string(info.NetworkType)
+
+	return writeVMXFile(vmxpath, vmx)
+}
+
+// readVMXSuspended tells whether the virtual machine in the given VMX file path
+// is suspended. When suspending a virtual machine, VMware saves its memory
+// to a .vmss file referenced by the checkpoint.vmstate key. The key is
+// cleared once the virtual machine is resumed.
+func readVMXSuspended(vmxpath string) (bool, error) {
+	vmx, err := readVMXFile(vmxpath)
+	if err != nil {
+		return false, err
+	}
+
+	vmstate := vmx["checkpoint.vmstate"]
+	if vmstate == "" {
+		return false, nil
+	}
+
+	if !filepath.IsAbs(vmstate) {
+		vmstate = filepath.Join(filepath.Dir(vmxpath), vmstate)
+	}
+
+	if _, err := os.Stat(vmstate); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,334 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	Register("workstation", &workstationDriver{})
+}
+
+// workstationDriver creates virtual machines managed by VMware Workstation.
+type workstationDriver struct{}
+
+// Capabilities returns the features supported by VMware Workstation.
+func (d *workstationDriver) Capabilities() Capabilities {
+	return Capabilities{
+		LinkedClones: true,
+		Headless:     true,
+		Snapshots:    true,
+	}
+}
+
+// NewVM returns a VMware Workstation virtual machine.
+func (d *workstationDriver) NewVM(vmxPath string) (VirtualMachine, error) {
+	vm, err := NewWorkstationVM(vmxPath)
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Default locations of vmrun in Linux, in order of preference, used when it
+// is not found in $PATH.
+var workstationVMRunPaths = []string{
+	"/usr/bin/vmrun",
+	"/usr/local/bin/vmrun",
+	"/usr/lib/vmware/bin/vmrun",
+}
+
+// WorkstationVM defines a VMWare Workstation provider, for Linux hosts.
+type WorkstationVM struct {
+	vmxPath   string
+	vmRunPath string
+}
+
+// NewWorkstationVM creates a new instance of WorkstationVM, receiving a VMX file
+// path as parameter. It returns an error if vmrun cannot be found.
+func NewWorkstationVM(vmxPath string) (*WorkstationVM, error) {
+	ws := &WorkstationVM{
+		vmxPath: vmxPath,
+	}
+
+	if err := ws.lookupVMRunPath(); err != nil {
+		return nil, err
+	}
+
+	return ws, nil
+}
+
+// lookupVMRunPath finds vmrun tool in local filesystem. VMWARE_VMRUN_PATH takes
+// precedence over $PATH and the default installation paths.
+func (v *WorkstationVM) lookupVMRunPath() error {
+	if vmrunPath := os.Getenv("VMWARE_VMRUN_PATH"); vmrunPath != "" {
+		if _, err := os.Stat(vmrunPath); err != nil {
+			return fmt.Errorf("[Workstation] VMWare vmrun program not found at path: %s", vmrunPath)
+		}
+		v.vmRunPath = vmrunPath
+		return nil
+	}
+
+	if vmrunPath, err := exec.LookPath("vmrun"); err == nil {
+		v.vmRunPath = vmrunPath
+		return nil
+	}
+
+	for _, vmrunPath := range workstationVMRunPaths {
+		if _, err := os.Stat(vmrunPath); err == nil {
+			v.vmRunPath = vmrunPath
+			return nil
+		}
+	}
+
+	return fmt.Errorf("[Workstation] VMWare vmrun program not found in $PATH nor in %v", workstationVMRunPaths)
+}
+
+// vmrun returns a vmrun command targeting VMware Workstation.
+func (v *WorkstationVM) vmrun(args ...string) *exec.Cmd {
+	return exec.Command(v.vmRunPath, append([]string{"-T", "ws"}, args...)...)
+}
+
+// verifyVMXPath verifies that the VMX file path is not empty.
+func (v *WorkstationVM) verifyVMXPath() error {
+	if v.vmxPath == "" {
+		return errors.New("[Workstation] Empty VMX file path. Nothing to operate on.")
+	}
+	return nil
+}
+
+// CloneFrom clones the source VMX file into the VMX file path of the function receiver.
+func (v *WorkstationVM) CloneFrom(src string, ctype CloneType) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if _, _, err := runAndLog(v.vmrun("clone", src, v.vmxPath, string(ctype))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Info returns the virtual machine information from VMWare
+func (v *WorkstationVM) Info() (*VMInfo, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return nil, err
+	}
+
+	return readVMXInfo(v.vmxPath)
+}
+
+// SetInfo stores the VM information in VMWare
+func (v *WorkstationVM) SetInfo(info *VMInfo) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	return writeVMXInfo(v.vmxPath, info)
+}
+
+// Start launches a virtual machine.
+func (v *WorkstationVM) Start(headless bool) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	guiParam := "gui"
+	if headless {
+		guiParam = "nogui"
+	}
+
+	if _, _, err := runAndLog(v.vmrun("start", v.vmxPath, guiParam)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stop stops a virtual machine.
+func (v *WorkstationVM) Stop(mode PowerMode) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if _, _, err := runAndLog(v.vmrun("stop", v.vmxPath, string(mode))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reset restarts a virtual machine.
+func (v *WorkstationVM) Reset(mode PowerMode) error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if _, _, err := runAndLog(v.vmrun("reset", v.vmxPath, string(mode))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Suspend saves the state of a virtual machine to disk and powers it off.
+func (v *WorkstationVM) Suspend() error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if _, _, err := runAndLog(v.vmrun("suspend", v.vmxPath)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Resume powers on a suspended virtual machine, restoring its saved state.
+// Note that vmrun's unpause only applies to paused virtual machines,
+// suspended ones are resumed from their checkpoint when started.
+func (v *WorkstationVM) Resume(headless bool) error {
+	return v.Start(headless)
+}
+
+// Delete removes a virtual machine using normal vmrun means.
+func (v *WorkstationVM) Delete() error {
+	if err := v.verifyVMXPath(); err != nil {
+		return err
+	}
+
+	if _, _, err := runAndLog(v.vmrun("deleteVM", v.vmxPath)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsRunning returns whether or not a virtual machine is running.
+func (v *WorkstationVM) IsRunning() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	stdout, _, err := runAndLog(v.vmrun("list"))
+	if err != nil {
+		return false, err
+	}
+
+	for _, vmxPath := range parseWorkstationList(stdout) {
+		if sameFile(vmxPath, v.vmxPath) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parseWorkstationList returns the VMX paths listed by `vmrun -T ws list`. Its
+// output starts with a "Total running VMs: N" header followed by one VMX path
+// per line. Workstation does not normalize paths, so they may contain trailing
+// whitespace or be relative to the directory vmrun was started from.
+func parseWorkstationList(stdout string) []string {
+	var paths []string
+	for _, line := range strings.Split(stdout, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Total running VMs:") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths
+}
+
+// sameFile tells whether two paths point to the same file, resolving
+// relative paths and symlinks.
+func sameFile(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	fa, err := os.Stat(a)
+	if err != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fa, fb)
+}
+
+// IsSuspended returns whether or not a virtual machine is suspended.
+func (v *WorkstationVM) IsSuspended() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	return readVMXSuspended(v.vmxPath)
+}
+
+// HasToolsInstalled returns whether or not VMWare Tools is running in the VM.
+func (v *WorkstationVM) HasToolsInstalled() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	stdout, _, err := runAndLog(v.vmrun("checkToolsState", v.vmxPath))
+	if err != nil {
+		return false, err
+	}
+
+	for _, line := range strings.Split(stdout, "\n") {
+		switch strings.TrimSpace(line) {
+		case "installed", "running":
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IPAddress queries VMWare Tools to get the virtual machine IP address.
+func (v *WorkstationVM) IPAddress() (string, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return "", err
+	}
+
+	stdout, _, err := runAndLog(v.vmrun("getGuestIPAddress", v.vmxPath))
+	if err != nil {
+		return "", err
+	}
+
+	addresses := strings.Split(stdout, "\n")
+
+	if len(addresses) > 0 {
+		return strings.TrimSpace(addresses[0]), nil
+	}
+
+	return "", nil
+}
+
+// Exists returns whether or not the VMX file for this VM exists.
+func (v *WorkstationVM) Exists() (bool, error) {
+	if err := v.verifyVMXPath(); err != nil {
+		return false, err
+	}
+
+	if _, err := os.Stat(v.vmxPath); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,85 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vmware
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseWorkstationList(t *testing.T) {
+	var tests = []struct {
+		stdout string
+		paths  []string
+	}{
+		{"Total running VMs: 0\n", nil},
+		{
+			"Total running VMs: 2\r\n/vms/a/a.vmx  \r\n/vms/b/b.vmx\r\n",
+			[]string{"/vms/a/a.vmx", "/vms/b/b.vmx"},
+		},
+		{"Total running VMs: 1\n/home/user/vms/My VM/My VM.vmx\n", []string{"/home/user/vms/My VM/My VM.vmx"}},
+	}
+
+	for _, test := range tests {
+		equals(t, test.paths, parseWorkstationList(test.stdout))
+	}
+}
+
+func TestWorkstationVMRunLookup(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-vmrun")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	vmrunPath := filepath.Join(dir, "vmrun")
+	ok(t, ioutil.WriteFile(vmrunPath, []byte("#!/bin/sh\n"), 0755))
+
+	path := os.Getenv("PATH")
+	defer os.Setenv("PATH", path)
+	os.Setenv("PATH", dir)
+
+	vm, err := NewWorkstationVM("/tmp/vm1/vm1.vmx")
+	ok(t, err)
+	equals(t, vmrunPath, vm.vmRunPath)
+}
+
+func TestWorkstationLifecycle(t *testing.T) {
+	goldvmx, cleanup := setupFakeVMRun(t)
+	defer cleanup()
+
+	driver, err := Lookup("workstation")
+	ok(t, err)
+
+	// Uses a symlinked directory to make sure running VMs are still matched
+	// if vmrun reports a different path for the same file.
+	root := filepath.Dir(filepath.Dir(goldvmx))
+	ok(t, os.Symlink(root, filepath.Join(root, "link")))
+	vmxPath := filepath.Join(root, "link", "vm1", "vm1.vmx")
+
+	vm, err := driver.NewVM(vmxPath)
+	ok(t, err)
+
+	ok(t, vm.CloneFrom(goldvmx, CloneLinked))
+	ok(t, vm.Start(true))
+
+	realVM, err := NewWorkstationVM(filepath.Join(root, "vm1", "vm1.vmx"))
+	ok(t, err)
+
+	running, err := realVM.IsRunning()
+	ok(t, err)
+	assert(t, running, "%s should be running", vmxPath)
+
+	ip, err := vm.IPAddress()
+	ok(t, err)
+	assert(t, ip != "", "IP address should not be empty")
+
+	installed, err := vm.HasToolsInstalled()
+	ok(t, err)
+	assert(t, installed, "VMware Tools should be reported as installed")
+
+	ok(t, vm.Stop(PowerSoft))
+	ok(t, vm.Delete())
+}
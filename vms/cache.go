@@ -0,0 +1,422 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/pkg/lockfile"
+)
+
+// CachedImage describes an image kept on disk, either as a gold image, as a
+// downloaded archive, or both.
+type CachedImage struct {
+	// Checksum of the image
+	Checksum string `json:"checksum"`
+	// Bytes used by the unpacked gold image
+	GoldSize int64 `json:"gold_size"`
+	// Bytes used by the downloaded image archive
+	ArchiveSize int64 `json:"archive_size"`
+	// Total bytes used by the image
+	Size int64 `json:"size"`
+	// Last time a virtual machine was created from the image
+	LastUsed time.Time `json:"last_used"`
+	// IDs of the virtual machines created from the image
+	VMs []string `json:"vms"`
+	// Signed manifest the gold image was unpacked from, if any
+	Manifest *ImageManifest `json:"manifest,omitempty"`
+}
+
+// ImageInUseError is returned when trying to remove an image virtual machines
+// were created from.
+type ImageInUseError struct {
+	Checksum string
+	VMs      []string
+}
+
+// Implements Error interface.
+func (e *ImageInUseError) Error() string {
+	if len(e.VMs) == 0 {
+		return fmt.Sprintf("Image %s is being used to create a virtual machine", e.Checksum)
+	}
+	return fmt.Sprintf("Image %s is used by virtual machines: %s", e.Checksum, strings.Join(e.VMs, ", "))
+}
+
+var (
+	pinsMu sync.Mutex
+	pins   = make(map[string]int)
+)
+
+// pinImage prevents an image from being removed while a virtual machine is
+// being created from it, before the VM shows up as referencing it.
+func pinImage(checksum string) {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+
+	pins[checksum]++
+}
+
+// unpinImage undoes pinImage.
+func unpinImage(checksum string) {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+
+	pins[checksum]--
+	if pins[checksum] <= 0 {
+		delete(pins, checksum)
+	}
+}
+
+// isImagePinned tells whether a virtual machine is being created from the
+// image.
+func isImagePinned(checksum string) bool {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+
+	return pins[checksum] > 0
+}
+
+// touchGoldImage records that a gold image was just used, so that it is the
+// last one to be evicted.
+func touchGoldImage(goldPath string) {
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(goldPath, goldManifestFile), now, now); err != nil {
+		log.Printf("[WARN] Unable to update last use of %s: %s", goldPath, err)
+	}
+}
+
+// dirSize returns the sum of the sizes of the regular files under path along
+// with the most recent modification time among them.
+func dirSize(path string) (int64, time.Time, error) {
+	var size int64
+	var modTime time.Time
+
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		size += info.Size()
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+		return nil
+	})
+
+	return size, modTime, err
+}
+
+// imageRefs holds the IDs of virtual machines indexed by the checksum of the
+// image they were created from.
+type imageRefs map[string][]string
+
+// unknownImage indexes the virtual machines whose image can't be told, i.e.:
+// half deleted ones or those with a corrupt VMX file.
+const unknownImage = ""
+
+// vms returns the IDs of the virtual machines that may have been created
+// from the image, which includes those whose image can't be told.
+func (r imageRefs) vms(checksum string) []string {
+	vms := append([]string(nil), r[checksum]...)
+	return append(vms, r[unknownImage]...)
+}
+
+// imageReferences returns the IDs of the virtual machines under
+// config.VMSPath, indexed by the checksum of the image they were created
+// from. Full clones are accounted for as well, as there is no cheap way to
+// tell them apart from linked clones. Virtual machines that can't be read
+// are indexed by unknownImage, rather than failing, so that no image is
+// removed while they are around.
+func imageReferences() (imageRefs, error) {
+	refs := make(imageRefs)
+
+	entries, err := ioutil.ReadDir(config.VMSPath)
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		checksum, exists, err := vmImage(entry.Name())
+		if err != nil {
+			log.Printf("[WARN] Unable to tell the image of VM %s, keeping all images: %s", entry.Name(), err)
+			refs[unknownImage] = append(refs[unknownImage], entry.Name())
+			continue
+		}
+
+		if exists {
+			refs[checksum] = append(refs[checksum], entry.Name())
+		}
+	}
+
+	return refs, nil
+}
+
+// vmImage returns the checksum of the image a virtual machine was created
+// from, along with whether the virtual machine exists.
+func vmImage(id string) (string, bool, error) {
+	vm, err := NewVM(VMConfig{
+		ID: id,
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	exists, err := vm.vmwareVM.Exists()
+	if err != nil || !exists {
+		return "", false, err
+	}
+
+	info, err := vm.vmwareVM.Info()
+	if err != nil {
+		return "", true, err
+	}
+
+	image, err := decodeImageAnnotation(info.Annotation)
+	if err != nil {
+		return "", true, fmt.Errorf("Unable to read image: %s", err)
+	}
+
+	if image.Checksum == unknownImage {
+		return "", true, fmt.Errorf("No image recorded")
+	}
+
+	// VMs created before checksums were lower cased may have recorded them
+	// in upper case.
+	return strings.ToLower(image.Checksum), true, nil
+}
+
+// listCachedImages returns the images kept in config.GoldImgsPath and
+// config.ImagesPath, sorted by checksum.
+func listCachedImages() ([]*CachedImage, error) {
+	images := make(map[string]*CachedImage)
+	image := func(checksum string) *CachedImage {
+		if images[checksum] == nil {
+			images[checksum] = &CachedImage{
+				Checksum: checksum,
+				VMs:      []string{},
+			}
+		}
+		return images[checksum]
+	}
+
+	entries, err := ioutil.ReadDir(config.GoldImgsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.Contains(entry.Name(), ".staging-") {
+			continue
+		}
+
+		goldPath := filepath.Join(config.GoldImgsPath, entry.Name())
+		size, _, err := dirSize(goldPath)
+		if err != nil {
+			return nil, err
+		}
+
+		img := image(entry.Name())
+		img.GoldSize = size
+		img.LastUsed = entry.ModTime()
+
+		if finfo, err := os.Stat(filepath.Join(goldPath, goldManifestFile)); err == nil {
+			img.LastUsed = finfo.ModTime()
+		}
+
+		if manifest, err := readGoldManifest(goldPath); err == nil && manifest.ImageManifest != nil {
+			img.Manifest, _ = parseManifest(manifest.ImageManifest)
+		}
+	}
+
+	entries, err = ioutil.ReadDir(config.ImagesPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		size, modTime, err := dirSize(filepath.Join(config.ImagesPath, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		img := image(entry.Name())
+		img.ArchiveSize = size
+		if modTime.After(img.LastUsed) {
+			img.LastUsed = modTime
+		}
+	}
+
+	refs, err := imageReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*CachedImage, 0, len(images))
+	for checksum, img := range images {
+		if vms := refs.vms(checksum); vms != nil {
+			img.VMs = vms
+		}
+		img.Size = img.GoldSize + img.ArchiveSize
+		list = append(list, img)
+	}
+
+	sort.Sort(byChecksum(list))
+	return list, nil
+}
+
+// byChecksum sorts cached images by checksum.
+type byChecksum []*CachedImage
+
+func (s byChecksum) Len() int           { return len(s) }
+func (s byChecksum) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byChecksum) Less(i, j int) bool { return s[i].Checksum < s[j].Checksum }
+
+// byLastUsed sorts cached images from the least to the most recently used.
+type byLastUsed []*CachedImage
+
+func (s byLastUsed) Len() int           { return len(s) }
+func (s byLastUsed) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastUsed) Less(i, j int) bool { return s[i].LastUsed.Before(s[j].LastUsed) }
+
+// removeCachedImage removes the gold image and the downloaded archive of an
+// image, unless virtual machines were created from it, in which case an
+// ImageInUseError is returned. It returns an error satisfying os.IsNotExist
+// if the image is not cached.
+func removeCachedImage(checksum string) error {
+	return removeImage(checksum, lockfile.Acquire)
+}
+
+// removeImage is removeCachedImage, locking the image with acquire. The lock
+// waits for the image to be prepared if that is happening, and keeps new
+// preparations from starting until the image is removed.
+func removeImage(checksum string, acquire func(string) (*lockfile.Lock, error)) error {
+	goldPath := filepath.Join(config.GoldImgsPath, checksum)
+	imgPath := filepath.Join(config.ImagesPath, checksum)
+
+	if err := os.MkdirAll(config.GoldImgsPath, 0740); err != nil {
+		return err
+	}
+
+	lock, err := acquire(filepath.Join(config.GoldImgsPath, checksum+".lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	_, goldErr := os.Stat(goldPath)
+	_, imgErr := os.Stat(imgPath)
+	if os.IsNotExist(goldErr) && os.IsNotExist(imgErr) {
+		return goldErr
+	}
+
+	if isImagePinned(checksum) {
+		return &ImageInUseError{Checksum: checksum}
+	}
+
+	refs, err := imageReferences()
+	if err != nil {
+		return err
+	}
+
+	if vms := refs.vms(checksum); len(vms) > 0 {
+		return &ImageInUseError{Checksum: checksum, VMs: vms}
+	}
+
+	log.Printf("[INFO] Removing image %s", checksum)
+	if err := os.RemoveAll(goldPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(imgPath)
+}
+
+var (
+	collectMu sync.Mutex
+	// Tracks image collections running in the background
+	imageCollections sync.WaitGroup
+)
+
+// collectImagesInBackground runs collectImages, logging its errors. It is
+// meant to run in its own goroutine once an operation is finished, as
+// collecting images may take a while, and imageCollections is expected to be
+// incremented before the operation is, so that whoever sees the operation
+// finished can wait for the collection as well.
+func collectImagesInBackground() {
+	defer imageCollections.Done()
+
+	if err := collectImages(); err != nil {
+		log.Printf("[ERROR] Unable to evict images over quota: %s", err)
+	}
+}
+
+// collectImages removes the least recently used images no virtual machine
+// was created from, until the space used fits in config.ImagesQuota. Images
+// being prepared, or otherwise locked, are skipped rather than waited for.
+func collectImages() error {
+	if config.ImagesQuota <= 0 {
+		return nil
+	}
+
+	collectMu.Lock()
+	defer collectMu.Unlock()
+
+	images, err := listCachedImages()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, img := range images {
+		total += img.Size
+	}
+
+	sort.Sort(byLastUsed(images))
+	for _, img := range images {
+		if total <= config.ImagesQuota {
+			break
+		}
+
+		if len(img.VMs) > 0 {
+			continue
+		}
+
+		err := removeImage(img.Checksum, lockfile.TryAcquire)
+		if _, ok := err.(*ImageInUseError); ok || os.IsNotExist(err) || err == lockfile.ErrLocked {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+		total -= img.Size
+	}
+
+	if total > config.ImagesQuota {
+		log.Printf("[WARN] Images use %d bytes, over the quota of %d bytes, but they are all in use",
+			total, config.ImagesQuota)
+	}
+
+	return nil
+}
@@ -0,0 +1,266 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/lockfile"
+)
+
+// destroyVM destroys a virtual machine through the API and waits until it
+// is gone.
+func (e *testEnv) destroyVM(t *testing.T, id string) {
+	var op operations.Operation
+	status := e.do(t, "DELETE", "/vms/"+id, nil, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.StatusSucceeded, e.waitOperation(t, op.ID).Status)
+}
+
+func TestImages(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var list ListImagesResult
+	status := env.do(t, "GET", "/images", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(list.Images))
+
+	vm := env.createVM(t, VMConfig{OSImage: env.image})
+
+	status = env.do(t, "GET", "/images", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(list.Images))
+
+	img := list.Images[0]
+	equals(t, env.image.Checksum, img.Checksum)
+	equals(t, []string{vm.ID}, img.VMs)
+	assert(t, img.GoldSize > 0, "gold image size should be known")
+	assert(t, img.ArchiveSize > 0, "archive size should be known")
+	equals(t, img.GoldSize+img.ArchiveSize, img.Size)
+	equals(t, img.Size, list.TotalSize)
+
+	var appErr apperror.Error
+	status = env.do(t, "DELETE", "/images/"+env.image.Checksum, nil, &appErr)
+	equals(t, http.StatusConflict, status)
+	equals(t, ErrImageInUse.Code, appErr.Code)
+	assert(t, strings.Contains(appErr.Message, vm.ID), "the VMs using the image should be listed: %s", appErr.Message)
+
+	env.destroyVM(t, vm.ID)
+
+	status = env.do(t, "DELETE", "/images/"+env.image.Checksum, nil, nil)
+	equals(t, http.StatusNoContent, status)
+
+	_, err := os.Stat(filepath.Join(config.GoldImgsPath, env.image.Checksum))
+	assert(t, os.IsNotExist(err), "gold image should have been removed")
+	_, err = os.Stat(filepath.Join(config.ImagesPath, env.image.Checksum))
+	assert(t, os.IsNotExist(err), "image archive should have been removed")
+
+	status = env.do(t, "GET", "/images", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(list.Images))
+
+	for _, checksum := range []string{env.image.Checksum, "..", "not-a-checksum"} {
+		status = env.do(t, "DELETE", "/images/"+checksum, nil, &appErr)
+		equals(t, http.StatusNotFound, status)
+		equals(t, ErrImageNotFound.Code, appErr.Code)
+	}
+}
+
+func TestImagesQuota(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	images := []Image{
+		env.image,
+		env.serveImage(t, "second", strings.Repeat("second disk", 100)),
+		env.serveImage(t, "third", strings.Repeat("third disk", 100)),
+	}
+
+	var vms []*VM
+	for _, image := range images {
+		vms = append(vms, env.createVM(t, VMConfig{OSImage: image}))
+
+		// Makes sure images are told apart by their last use.
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Images in use are kept regardless of the quota.
+	config.ImagesQuota = 1
+	ok(t, collectImages())
+
+	cached, err := listCachedImages()
+	ok(t, err)
+	equals(t, 3, len(cached))
+
+	config.ImagesQuota = 0
+	for _, vm := range vms {
+		env.destroyVM(t, vm.ID)
+	}
+
+	// Using the first image again makes the second one the least recently used.
+	env.destroyVM(t, env.createVM(t, VMConfig{OSImage: images[0]}).ID)
+
+	cached, err = listCachedImages()
+	ok(t, err)
+	equals(t, 3, len(cached))
+
+	sizes := make(map[string]int64)
+	for _, img := range cached {
+		sizes[img.Checksum] = img.Size
+	}
+
+	// Leaves room for two of the images, the quota is enforced after
+	// destroying a VM.
+	config.ImagesQuota = sizes[images[0].Checksum] + sizes[images[2].Checksum]
+	env.destroyVM(t, env.createVM(t, VMConfig{OSImage: images[2]}).ID)
+
+	cached, err = listCachedImages()
+	ok(t, err)
+	equals(t, 2, len(cached))
+	for _, img := range cached {
+		assert(t, img.Checksum != images[1].Checksum, "least recently used image should have been evicted")
+	}
+}
+
+func TestImagesQuotaLockedImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.destroyVM(t, env.createVM(t, VMConfig{OSImage: env.image}).ID)
+
+	// The image lock is held while the image is being prepared.
+	lock, err := lockfile.Acquire(filepath.Join(config.GoldImgsPath, env.image.Checksum+".lock"))
+	ok(t, err)
+
+	config.ImagesQuota = 1
+	collected := make(chan error, 1)
+	go func() {
+		collected <- collectImages()
+	}()
+
+	select {
+	case err := <-collected:
+		ok(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("collecting images waited for a locked image")
+	}
+
+	cached, err := listCachedImages()
+	ok(t, err)
+	equals(t, 1, len(cached))
+
+	ok(t, lock.Release())
+	ok(t, collectImages())
+
+	cached, err = listCachedImages()
+	ok(t, err)
+	equals(t, 0, len(cached))
+}
+
+func TestImagesUnreadableVM(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.destroyVM(t, env.createVM(t, VMConfig{OSImage: env.image}).ID)
+
+	brokenPath := filepath.Join(config.VMSPath, "broken")
+	ok(t, os.MkdirAll(brokenPath, 0740))
+	ok(t, ioutil.WriteFile(filepath.Join(brokenPath, "broken.vmx"), []byte(`annotation = "not base64"`), 0640))
+
+	// The broken VM may have been created from any image.
+	var list ListImagesResult
+	status := env.do(t, "GET", "/images", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(list.Images))
+	equals(t, []string{"broken"}, list.Images[0].VMs)
+
+	config.ImagesQuota = 1
+	ok(t, collectImages())
+
+	cached, err := listCachedImages()
+	ok(t, err)
+	equals(t, 1, len(cached))
+
+	var appErr apperror.Error
+	status = env.do(t, "DELETE", "/images/"+env.image.Checksum, nil, &appErr)
+	equals(t, http.StatusConflict, status)
+	equals(t, ErrImageInUse.Code, appErr.Code)
+
+	ok(t, os.RemoveAll(brokenPath))
+	ok(t, collectImages())
+
+	cached, err = listCachedImages()
+	ok(t, err)
+	equals(t, 0, len(cached))
+}
+
+func TestPrepareImageQuota(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	config.ImagesQuota = 1
+
+	var op operations.Operation
+	status := env.do(t, "POST", "/images", env.image, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.StatusSucceeded, env.waitOperation(t, op.ID).Status)
+
+	// The prepared image is over the quota but it was just prepared.
+	ok(t, validateGoldImage(filepath.Join(config.GoldImgsPath, env.image.Checksum), env.image))
+}
+
+func TestPrepareImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var op operations.Operation
+	status := env.do(t, "POST", "/images", env.image, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.TypePrepareImage, op.Type)
+	equals(t, env.image.Checksum, op.ResourceID)
+
+	finished := env.waitOperation(t, op.ID)
+	equals(t, operations.StatusSucceeded, finished.Status)
+	ok(t, validateGoldImage(filepath.Join(config.GoldImgsPath, env.image.Checksum), env.image))
+
+	// Creating a VM from a prepared image does not download it again.
+	env.createVM(t, VMConfig{OSImage: env.image})
+	equals(t, int32(1), atomic.LoadInt32(&env.downloads))
+
+	missing := env.image
+	missing.URL = env.images.URL + "/missing.tar.gz"
+	missing.Checksum = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	status = env.do(t, "POST", "/images", missing, &op)
+	equals(t, http.StatusAccepted, status)
+
+	finished = env.waitOperation(t, op.ID)
+	equals(t, operations.StatusFailed, finished.Status)
+	equals(t, operations.PhaseDownloading, finished.Phase)
+	equals(t, ErrPreparingImage.Code, finished.Error.Code)
+
+	invalid := []Image{
+		{Checksum: env.image.Checksum, ChecksumType: "sha1"},
+		{URL: env.image.URL, ChecksumType: "sha1"},
+		{URL: env.image.URL, Checksum: "../../etc", ChecksumType: "sha1"},
+		{URL: env.image.URL, Checksum: env.image.Checksum, ChecksumType: "crc32"},
+	}
+	for _, image := range invalid {
+		var appErr apperror.Error
+		status = env.do(t, "POST", "/images", image, &appErr)
+		equals(t, http.StatusBadRequest, status)
+		equals(t, ErrInvalidImage.Code, appErr.Code)
+	}
+}
@@ -0,0 +1,265 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/render"
+)
+
+// ImageHandlers is a map to functions where each function is in charge of
+// handling a HTTP verb or method for the /images path.
+var ImageHandlers map[string]func(http.ResponseWriter, *http.Request) = map[string]func(http.ResponseWriter, *http.Request){
+	"GET":    ListImages,
+	"POST":   PrepareImage,
+	"DELETE": RemoveImage,
+}
+
+// imageChecksum returns the image checksum from a /images/:checksum path,
+// lower cased, or an empty string if the path refers to the collection
+// itself.
+func imageChecksum(urlPath string) string {
+	return strings.ToLower(strings.Trim(strings.TrimPrefix(urlPath, "/images"), "/"))
+}
+
+// normalizeImage lower cases the image checksum, as it names gold images,
+// their locks and downloaded images, which would otherwise be told apart
+// from those of the same image given with an upper case checksum.
+func normalizeImage(image *Image) {
+	image.Checksum = strings.ToLower(image.Checksum)
+}
+
+// isChecksum tells whether s looks like a hex encoded checksum, so that it is
+// safe to use as a file name.
+func isChecksum(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ListImagesResult is the response of the ListImages service.
+type ListImagesResult struct {
+	Images []*CachedImage `json:"images"`
+	// Bytes used by all the images
+	TotalSize int64 `json:"total_size"`
+	// Bytes images are allowed to use before evicting them, zero if unlimited
+	Quota int64 `json:"quota"`
+}
+
+// ListImages returns the images cached, along with the virtual machines
+// created from them.
+func ListImages(w http.ResponseWriter, req *http.Request) {
+	if imageChecksum(req.URL.Path) != "" {
+		notFound(w, req)
+		return
+	}
+
+	images, err := listCachedImages()
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return
+	}
+
+	result := ListImagesResult{
+		Images: images,
+		Quota:  config.ImagesQuota,
+	}
+
+	for _, img := range images {
+		result.TotalSize += img.Size
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   result,
+	})
+}
+
+// validImage tells whether the image has everything needed to download it.
+func validImage(image Image) bool {
+	switch image.ChecksumType {
+	case "md5", "sha1", "sha256", "sha512":
+	default:
+		return false
+	}
+
+	switch image.LocalMode {
+	case LocalModeInPlace, LocalModeLink, LocalModeCopy:
+	default:
+		return false
+	}
+	return image.URL != "" && isChecksum(image.Checksum)
+}
+
+// PrepareImage downloads and unpacks an image in the background, so that
+// virtual machines can be created from it right away later on. The
+// preparation is tracked by the operation returned. Prepared images are
+// evicted like any other image no virtual machine was created from, once
+// they are the least recently used ones.
+func PrepareImage(w http.ResponseWriter, req *http.Request) {
+	if imageChecksum(req.URL.Path) != "" {
+		notFound(w, req)
+		return
+	}
+
+	var image Image
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrReadingReqBody.Message, ErrReadingReqBody.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrReadingReqBody.HTTPStatus,
+			Data:   ErrReadingReqBody,
+		})
+		return
+	}
+
+	err = json.Unmarshal(body, &image)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrParsingJSON.Message, ErrParsingJSON.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrParsingJSON.HTTPStatus,
+			Data:   ErrParsingJSON,
+		})
+		return
+	}
+
+	if !applyImageManifest(w, &image) {
+		return
+	}
+	normalizeImage(&image)
+
+	if !validImage(image) {
+		log.Printf(`[ERROR] msg="%s" code=%s image=%+v\n`,
+			ErrInvalidImage.Message, ErrInvalidImage.Code, image)
+
+		render.JSON(w, render.Options{
+			Status: ErrInvalidImage.HTTPStatus,
+			Data:   ErrInvalidImage,
+		})
+		return
+	}
+
+	op := newOperation(w, operations.TypePrepareImage, image.Checksum)
+	if op == nil {
+		return
+	}
+
+	go func() {
+		if _, err := prepareGoldImage(image, op); err != nil {
+			appErr := prepareError(err, ErrPreparingImage)
+			log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+				appErr.Message, appErr.Code, err.Error(), apperror.GetStacktrace())
+
+			op.Finish(appErr)
+			return
+		}
+
+		// The image just prepared is kept from being evicted right away,
+		// it counts as just used from then on.
+		pinImage(image.Checksum)
+		imageCollections.Add(1)
+		op.Finish(nil)
+		go func() {
+			defer unpinImage(image.Checksum)
+			collectImagesInBackground()
+		}()
+	}()
+
+	render.JSON(w, render.Options{
+		Status: http.StatusAccepted,
+		Data:   op.Snapshot(),
+	})
+}
+
+// RemoveImageParams defines parameters supported by the RemoveImage service.
+type RemoveImageParams struct {
+	// Image checksum
+	Checksum string
+}
+
+// RemoveImage removes the gold image and downloaded archive of an image,
+// unless virtual machines were created from it.
+func RemoveImage(w http.ResponseWriter, req *http.Request) {
+	params := RemoveImageParams{
+		Checksum: imageChecksum(req.URL.Path),
+	}
+
+	if params.Checksum == "" {
+		notFound(w, req)
+		return
+	}
+
+	var err error
+	if isChecksum(params.Checksum) {
+		err = removeCachedImage(params.Checksum)
+	} else {
+		err = os.ErrNotExist
+	}
+
+	if os.IsNotExist(err) {
+		log.Printf(`[ERROR] msg="%s" code=%s checksum=%s\n`,
+			ErrImageNotFound.Message, ErrImageNotFound.Code, params.Checksum)
+
+		render.JSON(w, render.Options{
+			Status: ErrImageNotFound.HTTPStatus,
+			Data:   ErrImageNotFound,
+		})
+		return
+	}
+
+	if ierr, ok := err.(*ImageInUseError); ok {
+		appErr := ErrImageInUse
+		appErr.Message = ierr.Error()
+
+		log.Printf(`[ERROR] msg="%s" code=%s\n`, appErr.Message, appErr.Code)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return
+	}
+
+	render.JSON(w, render.Options{
+		Status: http.StatusNoContent,
+	})
+}
@@ -40,6 +40,18 @@ var ErrCreatingVM = apperror.Error{
 	HTTPStatus: http.StatusInternalServerError,
 }
 
+var ErrDestroyingVM = apperror.Error{
+	Code:       "vm-destroy-error",
+	Message:    "There was an unexpected error trying to destroy the virtual machine. We are looking into it.",
+	HTTPStatus: http.StatusInternalServerError,
+}
+
+var ErrReconfiguringVM = apperror.Error{
+	Code:       "vm-reconfigure-error",
+	Message:    "There was an unexpected error trying to reconfigure the virtual machine. We are looking into it.",
+	HTTPStatus: http.StatusInternalServerError,
+}
+
 var ErrOpeningVM = apperror.Error{
 	Code: "vm-open-error",
 	Message: "The VM was found but we were unable to open its configuration file. " +
@@ -47,6 +59,102 @@ var ErrOpeningVM = apperror.Error{
 	HTTPStatus: http.StatusConflict,
 }
 
+var ErrHeadlessUnsupported = apperror.Error{
+	Code:       "headless-unsupported",
+	Message:    "The hypervisor driver in use does not support running virtual machines in headless mode.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrInvalidListLimit = apperror.Error{
+	Code:       "invalid-limit",
+	Message:    "The limit parameter must be a number between 1 and 500.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrInvalidCursor = apperror.Error{
+	Code:       "invalid-cursor",
+	Message:    "The provided cursor is not valid. Please use the cursor returned by a previous request.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrNotFound = apperror.Error{
+	Code:       "not-found",
+	Message:    "The requested resource was not found",
+	HTTPStatus: http.StatusNotFound,
+}
+
+var ErrInvalidAction = apperror.Error{
+	Code:       "invalid-action",
+	Message:    "The action must be one of start, stop, restart, suspend or resume.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrInvalidTransition = apperror.Error{
+	Code:       "invalid-transition",
+	Message:    "The action is not valid for the current status of the virtual machine.",
+	HTTPStatus: http.StatusConflict,
+}
+
+var ErrInvalidConfig = apperror.Error{
+	Code:       "invalid-config",
+	Message:    "One or more virtual machine properties have invalid values.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrInvalidImage = apperror.Error{
+	Code:       "invalid-image",
+	Message:    "The image url, checksum and checksum_type are required. Supported checksum types are md5, sha1, sha256 and sha512.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrUnsignedImage = apperror.Error{
+	Code:       "unsigned-image",
+	Message:    "Only images described by a signed manifest are allowed, manifest_url is required.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrUntrustedGoldImage = apperror.Error{
+	Code:       "untrusted-gold-image",
+	Message:    "It is kept, as virtual machines may have been cloned from it, but it has to be removed before creating virtual machines from the image again.",
+	HTTPStatus: http.StatusConflict,
+}
+
+var ErrInvalidManifest = apperror.Error{
+	Code:       "invalid-manifest",
+	Message:    "The image manifest could not be fetched or its signature could not be verified.",
+	HTTPStatus: http.StatusBadRequest,
+}
+
+var ErrPreparingImage = apperror.Error{
+	Code:       "image-prepare-error",
+	Message:    "There was an unexpected error trying to download or unpack the image. We are looking into it.",
+	HTTPStatus: http.StatusInternalServerError,
+}
+
+var ErrUnsafeImage = apperror.Error{
+	Code:       "unsafe-image",
+	Message:    "The image archive was refused, it has files outside of its directory or unpacks to too much data.",
+	HTTPStatus: http.StatusUnprocessableEntity,
+}
+
+var ErrInvalidOVF = apperror.Error{
+	Code:       "invalid-ovf",
+	Message:    "The OVF descriptor of the image could not be turned into a virtual machine.",
+	HTTPStatus: http.StatusUnprocessableEntity,
+}
+
+var ErrImageNotFound = apperror.Error{
+	Code:       "image-not-found",
+	Message:    "The requested image checksum was not found",
+	HTTPStatus: http.StatusNotFound,
+}
+
+var ErrImageInUse = apperror.Error{
+	Code:       "image-in-use",
+	Message:    "The image cannot be removed while virtual machines created from it exist.",
+	HTTPStatus: http.StatusConflict,
+}
+
 var ErrCbURL = apperror.Error{
 	Code:    "err-marshalling-response",
 	Message: "There was an error marshaling the response. Please try again creating your virtual machine.",
@@ -0,0 +1,730 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/lockfile"
+	"github.com/c4milo/osx-builder/pkg/unzipit"
+	"github.com/c4milo/osx-builder/pkg/vmware"
+)
+
+// progressReporter receives the progress of a long running task, such as an
+// operations.Operation, and tells when the task is to be canceled.
+type progressReporter interface {
+	SetPhase(phase operations.Phase)
+	SetProgressRate(progress int, bytesPerSecond int64)
+	Context() context.Context
+}
+
+// goldFlight is a gold image preparation in progress. Requests needing the
+// same gold image join it instead of preparing the image themselves, getting
+// its progress reported as well. The preparation is canceled once every
+// request that joined it is.
+type goldFlight struct {
+	checksum string
+	done     chan struct{}
+	path     string
+	err      error
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu        sync.Mutex
+	phase     operations.Phase
+	reporters []progressReporter
+}
+
+// join adds a reporter to be notified of the flight progress from now on.
+func (f *goldFlight) join(r progressReporter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.reporters = append(f.reporters, r)
+	if f.phase != "" {
+		r.SetPhase(f.phase)
+	}
+}
+
+// leave removes a reporter that no longer waits for the flight, canceling
+// the flight if no one else does. It must be called holding goldFlightsMu,
+// so that no one joins a flight being canceled.
+func (f *goldFlight) leave(r progressReporter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, reporter := range f.reporters {
+		if reporter == r {
+			f.reporters = append(f.reporters[:i], f.reporters[i+1:]...)
+			break
+		}
+	}
+
+	if len(f.reporters) > 0 {
+		return
+	}
+
+	log.Printf("[DEBUG] No one waits for gold image %s anymore, canceling its preparation", f.checksum)
+	if goldFlights[f.checksum] == f {
+		delete(goldFlights, f.checksum)
+	}
+	f.cancel()
+}
+
+// Context returns the context the preparation stops with.
+func (f *goldFlight) Context() context.Context {
+	return f.ctx
+}
+
+// SetPhase notifies all the reporters that joined the flight.
+func (f *goldFlight) SetPhase(phase operations.Phase) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.phase = phase
+	for _, r := range f.reporters {
+		r.SetPhase(phase)
+	}
+}
+
+// SetProgressRate notifies all the reporters that joined the flight.
+func (f *goldFlight) SetProgressRate(progress int, bytesPerSecond int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, r := range f.reporters {
+		r.SetProgressRate(progress, bytesPerSecond)
+	}
+}
+
+var (
+	goldFlightsMu sync.Mutex
+	goldFlights   = make(map[string]*goldFlight)
+)
+
+// prepareGoldImage makes sure the gold image is downloaded and unpacked,
+// returning its path. Only one preparation runs per image checksum at a
+// time, callers asking for an image being prepared wait for it and get the
+// same result. A lock file is held while preparing the image so that other
+// processes sharing config.GoldImgsPath do not step on each other either.
+// Callers whose context is done stop waiting right away, with its error.
+func prepareGoldImage(image Image, r progressReporter) (string, error) {
+	goldFlightsMu.Lock()
+	f, ok := goldFlights[image.Checksum]
+	if ok {
+		log.Printf("[DEBUG] Gold image %s is already being prepared, waiting for it...", image.Checksum)
+	} else {
+		ctx, cancel := context.WithCancel(context.Background())
+		f = &goldFlight{
+			checksum: image.Checksum,
+			done:     make(chan struct{}),
+			ctx:      ctx,
+			cancel:   cancel,
+		}
+		goldFlights[image.Checksum] = f
+		go f.run(image)
+	}
+	f.join(r)
+	goldFlightsMu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.path, f.err
+	case <-r.Context().Done():
+		goldFlightsMu.Lock()
+		f.leave(r)
+		goldFlightsMu.Unlock()
+		return "", r.Context().Err()
+	}
+}
+
+// run prepares the gold image, reporting to everyone who joined the flight.
+func (f *goldFlight) run(image Image) {
+	f.path, f.err = lockAndUnpackGoldImage(image, f)
+
+	goldFlightsMu.Lock()
+	if goldFlights[f.checksum] == f {
+		delete(goldFlights, f.checksum)
+	}
+	goldFlightsMu.Unlock()
+
+	f.cancel()
+	close(f.done)
+}
+
+// lockAndUnpackGoldImage unpacks the gold image holding its lock file.
+func lockAndUnpackGoldImage(image Image, r progressReporter) (string, error) {
+	if !isChecksum(image.Checksum) {
+		return "", fmt.Errorf("Invalid image checksum: %q", image.Checksum)
+	}
+
+	if err := os.MkdirAll(config.GoldImgsPath, 0740); err != nil {
+		return "", err
+	}
+
+	lockPath := filepath.Join(config.GoldImgsPath, image.Checksum+".lock")
+	lock, err := lockfile.Acquire(lockPath)
+	if err != nil {
+		return "", err
+	}
+	defer lock.Release()
+
+	return unpackGoldImage(image, r)
+}
+
+// Name of the file, inside a gold image directory, describing what was
+// unpacked into it. The file is written last, so gold images without it are
+// incomplete.
+const goldManifestFile = ".osx-builder-manifest.json"
+
+// goldManifest records the contents of a gold image once it is unpacked.
+type goldManifest struct {
+	// Checksum of the image the gold image was unpacked from
+	Checksum string `json:"checksum"`
+	// Algorithm used to compute the checksum
+	ChecksumType string `json:"checksum_type"`
+	// When the image was unpacked
+	UnpackedAt time.Time `json:"unpacked_at"`
+	// Regular files unpacked, along with their sizes
+	Files []goldFile `json:"files"`
+	// Path of the VMX file virtual machines are cloned from, relative to
+	// the gold image directory. Gold images unpacked by older versions do
+	// not record it.
+	VMX string `json:"vmx,omitempty"`
+	// Signed manifest of the image, if it was described by one. It is kept
+	// as is, since reformatting it would invalidate its signature.
+	ImageManifest []byte `json:"image_manifest,omitempty"`
+	// Ed25519 signature of ImageManifest
+	ImageSignature []byte `json:"image_signature,omitempty"`
+}
+
+// goldFile is a file unpacked from an image.
+type goldFile struct {
+	// Path relative to the gold image directory
+	Path string `json:"path"`
+	// Size in bytes
+	Size int64 `json:"size"`
+}
+
+// Extensions of the files VMware rewrites in gold images, i.e.: when taking
+// the snapshot linked clones are made from. Their sizes are not checked.
+var goldMutableExts = map[string]bool{
+	".vmx":   true,
+	".vmxf":  true,
+	".vmsd":  true,
+	".nvram": true,
+	".log":   true,
+}
+
+// writeGoldManifest lists the files in goldPath and writes the manifest
+// describing them, along with the path of its VMX file, relative to goldPath.
+func writeGoldManifest(goldPath string, image Image, vmx string) error {
+	manifest := goldManifest{
+		Checksum:     image.Checksum,
+		ChecksumType: image.ChecksumType,
+		UnpackedAt:   time.Now().UTC(),
+		Files:        []goldFile{},
+		VMX:          vmx,
+	}
+
+	if image.manifest != nil {
+		manifest.ImageManifest = image.manifest
+		manifest.ImageSignature = image.signature
+	}
+
+	err := filepath.Walk(goldPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		relPath, err := filepath.Rel(goldPath, path)
+		if err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, goldFile{
+			Path: relPath,
+			Size: info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(goldPath, goldManifestFile), data, 0640)
+}
+
+// readGoldManifest reads the manifest of the gold image at goldPath.
+func readGoldManifest(goldPath string) (*goldManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(goldPath, goldManifestFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Gold image %s has no manifest, it was not completely unpacked", goldPath)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest goldManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Gold image %s has a corrupt manifest: %s", goldPath, err)
+	}
+
+	return &manifest, nil
+}
+
+// goldImageInUse tells whether virtual machines were cloned, or are being
+// cloned, from the gold image of the given checksum.
+func goldImageInUse(checksum string) (bool, error) {
+	if isImagePinned(checksum) {
+		return true, nil
+	}
+
+	refs, err := imageReferences()
+	if err != nil {
+		return false, err
+	}
+	return len(refs.vms(checksum)) > 0, nil
+}
+
+// adoptGoldImage keeps an invalid gold image virtual machines were cloned
+// from. Gold images unpacked before manifests were written have none, they
+// get one listing their files as they are. Any other invalid gold image is
+// left alone and validationErr is returned.
+func adoptGoldImage(goldPath string, image Image, validationErr error) (string, error) {
+	_, err := os.Stat(filepath.Join(goldPath, goldManifestFile))
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("Gold image %s is in use, so it is kept even though it is invalid: %s",
+			goldPath, validationErr)
+	}
+
+	log.Printf("[WARN] Gold image %s has no manifest but is in use, writing one for it", goldPath)
+	if err := writeGoldManifest(goldPath, image, ""); err != nil {
+		return "", err
+	}
+
+	if err := validateGoldImage(goldPath, image); err != nil {
+		return "", err
+	}
+	return goldPath, nil
+}
+
+// goldVMXPath returns the path of the VMX file of the gold image at goldPath,
+// as recorded in its manifest.
+func goldVMXPath(goldPath string) (string, error) {
+	manifest, err := readGoldManifest(goldPath)
+	if err != nil {
+		return "", err
+	}
+
+	if manifest.VMX != "" {
+		return filepath.Join(goldPath, filepath.FromSlash(manifest.VMX)), nil
+	}
+
+	// Gold images unpacked by older versions only list their files.
+	for _, file := range manifest.Files {
+		if strings.EqualFold(filepath.Ext(file.Path), ".vmx") {
+			return filepath.Join(goldPath, file.Path), nil
+		}
+	}
+	return "", fmt.Errorf("[ERROR] Gold vmx file was not found in %s", goldPath)
+}
+
+// untrustedGoldError is returned when a gold image was not unpacked from an
+// image with a signed manifest, while image signing keys are configured.
+// Such gold images are kept, virtual machines may have been cloned from them
+// before the keys were configured, but nothing new is cloned from them.
+type untrustedGoldError struct {
+	Path   string
+	Reason string
+}
+
+// Implements Error interface.
+func (e *untrustedGoldError) Error() string {
+	return fmt.Sprintf("Gold image %s is not trusted: %s", e.Path, e.Reason)
+}
+
+// validateGoldImage verifies that the gold image at goldPath was completely
+// unpacked from the given image and that none of its files went missing or
+// were truncated since. If image signing keys are configured, the gold image
+// must also have been unpacked from an image with a signed manifest. It
+// returns an error satisfying os.IsNotExist if there is no gold image at all.
+func validateGoldImage(goldPath string, image Image) error {
+	if _, err := os.Stat(goldPath); err != nil {
+		return err
+	}
+
+	manifest, err := readGoldManifest(goldPath)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Checksum != image.Checksum {
+		return fmt.Errorf("Gold image %s was unpacked from %s instead of %s",
+			goldPath, manifest.Checksum, image.Checksum)
+	}
+
+	if len(config.ImageSigningKeys) > 0 {
+		if !verifyManifestSignature(manifest.ImageManifest, manifest.ImageSignature) {
+			return &untrustedGoldError{goldPath, "it was not unpacked from an image with a trusted manifest"}
+		}
+
+		imgManifest, err := parseManifest(manifest.ImageManifest)
+		if err != nil || !strings.EqualFold(imgManifest.SHA256, image.Checksum) {
+			return &untrustedGoldError{goldPath, "its manifest does not describe image " + image.Checksum}
+		}
+	}
+
+	for _, file := range manifest.Files {
+		finfo, err := os.Stat(filepath.Join(goldPath, file.Path))
+		if err != nil {
+			return fmt.Errorf("Gold image %s is missing %s: %s", goldPath, file.Path, err)
+		}
+
+		if goldMutableExts[strings.ToLower(filepath.Ext(file.Path))] {
+			continue
+		}
+
+		if finfo.Size() != file.Size {
+			return fmt.Errorf("Gold image file %s has %d bytes instead of %d",
+				file.Path, finfo.Size(), file.Size)
+		}
+	}
+
+	return nil
+}
+
+// newStagingDir creates a directory to unpack the image into, next to where
+// its gold image goes.
+func newStagingDir(image Image) (string, error) {
+	stagingPath, err := ioutil.TempDir(config.GoldImgsPath, image.Checksum+".staging-")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(stagingPath, 0740); err != nil {
+		os.RemoveAll(stagingPath)
+		return "", err
+	}
+	return stagingPath, nil
+}
+
+// canStream tells whether the image can be unpacked while downloading it,
+// which is only the case for images to be downloaded through HTTP.
+func canStream(image Image, imgPath string) bool {
+	if _, ok := localPath(image.URL); ok {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(imgPath, image.cacheName()))
+	return os.IsNotExist(err)
+}
+
+// streamGoldImage downloads the image and unpacks it into stagingPath in a
+// single pass, returning what was unpacked. The unpacked image must not be
+// used unless no error is returned, as it is only then that the downloaded
+// data is known to match the image checksum. Errors caused by streaming are
+// returned as a *streamError, in which case the image can still be unpacked
+// once downloaded, resuming any partial download left behind.
+func streamGoldImage(image *Image, imgPath, stagingPath string, r progressReporter) (*unzipit.Result, error) {
+	pr, pw := io.Pipe()
+
+	var result *unzipit.Result
+	unpacked := make(chan error, 1)
+	go func() {
+		log.Printf("[DEBUG] Unpacking gold virtual machine into %s while downloading it\n", stagingPath)
+		var err error
+		result, err = unzipit.ExtractStream(r.Context(), pr, stagingPath, unzipit.Options{
+			Limits: unpackLimits(),
+		})
+		if err == nil {
+			// Archives may be followed by padding the unpacker does not read.
+			_, err = io.Copy(ioutil.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		unpacked <- err
+	}()
+
+	r.SetPhase(operations.PhaseDownloading)
+	image.tee = pw
+	err := image.Download(imgPath, func(p DownloadProgress) {
+		r.SetProgressRate(p.Percent(), p.BytesPerSecond)
+	})
+	image.tee = nil
+	pw.CloseWithError(err)
+
+	unpackErr := <-unpacked
+	if _, ok := err.(*streamError); ok && unpackErr != nil {
+		return nil, &streamError{unpackErr}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	image.file.Close()
+
+	// The image matches its checksum, so unpacking it again would be
+	// refused all the same.
+	if unsafeArchive(unpackErr) {
+		return nil, unpackErr
+	}
+
+	if unpackErr != nil {
+		return nil, &streamError{unpackErr}
+	}
+	return result, nil
+}
+
+// goldVMX returns the path, relative to goldPath, of the VMX file extracted
+// into it. Gold images packaged as OVF, such as OVA files, have none, so it
+// is generated out of their OVF descriptor. It returns an empty path if there
+// is neither.
+func goldVMX(goldPath string, result *unzipit.Result) (string, error) {
+	var ovf string
+	for _, entry := range result.Entries {
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+
+		switch strings.ToLower(path.Ext(entry.Path)) {
+		case ".vmx":
+			return entry.Path, nil
+		case ".ovf":
+			if ovf == "" {
+				ovf = entry.Path
+			}
+		}
+	}
+
+	if ovf == "" {
+		return "", nil
+	}
+
+	vmx := strings.TrimSuffix(ovf, path.Ext(ovf)) + ".vmx"
+	log.Printf("[DEBUG] Generating gold vmx file %s out of %s", vmx, ovf)
+
+	ovfPath := filepath.Join(goldPath, filepath.FromSlash(ovf))
+	if err := vmware.ImportOVF(ovfPath, filepath.Join(goldPath, filepath.FromSlash(vmx))); err != nil {
+		return "", err
+	}
+	return vmx, nil
+}
+
+// unpackLimits returns the limits images are unpacked with, as configured.
+func unpackLimits() unzipit.Limits {
+	return unzipit.Limits{
+		MaxBytes:   config.UnpackMaxBytes,
+		MaxEntries: config.UnpackMaxEntries,
+		MaxRatio:   config.UnpackMaxRatio,
+	}
+}
+
+// unpackProgress returns a function reporting how much of an image of the
+// given size was unpacked, at most once per progressInterval.
+func unpackProgress(size int64, r progressReporter) func(unzipit.Progress) {
+	start := time.Now()
+	var reportedAt time.Time
+
+	return func(p unzipit.Progress) {
+		if size <= 0 || time.Since(reportedAt) < progressInterval {
+			return
+		}
+		reportedAt = time.Now()
+
+		var bytesPerSecond int64
+		if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+			bytesPerSecond = int64(float64(p.BytesRead) / elapsed)
+		}
+		r.SetProgressRate(int(p.BytesRead*100/size), bytesPerSecond)
+	}
+}
+
+// unsafeArchive tells whether unpacking an image failed because the image
+// archive was refused.
+func unsafeArchive(err error) bool {
+	switch err.(type) {
+	case *unzipit.UnsafePathError, *unzipit.LimitError:
+		return true
+	}
+	return false
+}
+
+// prepareError returns the error reported when preparing an image fails,
+// telling callers when the image archive was refused, its OVF descriptor
+// could not be imported or its gold image is not trusted, rather than giving
+// them appErr.
+func prepareError(err error, appErr apperror.Error) *apperror.Error {
+	if unsafeArchive(err) {
+		appErr = ErrUnsafeImage
+		appErr.Message = err.Error()
+	}
+
+	if _, ok := err.(*vmware.OVFError); ok {
+		appErr = ErrInvalidOVF
+		appErr.Message = err.Error()
+	}
+
+	if _, ok := err.(*untrustedGoldError); ok {
+		appErr = ErrUntrustedGoldImage
+		appErr.Message = err.Error() + ". " + ErrUntrustedGoldImage.Message
+	}
+
+	if err == context.Canceled {
+		appErr = operations.ErrCanceled
+	}
+	return &appErr
+}
+
+// unpackGoldImage fetches and decompresses the Gold OS image, unless a valid
+// gold image exists already. The image is unpacked into a staging directory
+// which is only moved into place once completely unpacked.
+func unpackGoldImage(image Image, r progressReporter) (string, error) {
+	// The checksum names the gold image directory, which is removed if
+	// found invalid, as well as the directory the image is downloaded into.
+	if !isChecksum(image.Checksum) {
+		return "", fmt.Errorf("Invalid image checksum: %q", image.Checksum)
+	}
+	goldPath := filepath.Join(config.GoldImgsPath, image.Checksum)
+
+	err := validateGoldImage(goldPath, image)
+	if err == nil {
+		touchGoldImage(goldPath)
+		return goldPath, nil
+	}
+
+	if _, ok := err.(*untrustedGoldError); ok {
+		return "", err
+	}
+
+	if os.IsNotExist(err) {
+		log.Println("[DEBUG] Gold virtual machine does not exist")
+	} else {
+		inUse, ierr := goldImageInUse(image.Checksum)
+		if ierr != nil {
+			return "", ierr
+		}
+
+		// Linked clones need their gold image, whatever state it is in.
+		if inUse {
+			return adoptGoldImage(goldPath, image, err)
+		}
+
+		log.Printf("[WARN] Discarding gold virtual machine: %s", err)
+		if err := os.RemoveAll(goldPath); err != nil {
+			return "", err
+		}
+	}
+
+	// Leftovers from preparations that crashed. No one else can be using
+	// them since the image lock is held.
+	stale, _ := filepath.Glob(filepath.Join(config.GoldImgsPath, image.Checksum+".staging-*"))
+	for _, path := range stale {
+		os.RemoveAll(path)
+	}
+
+	stagingPath, err := newStagingDir(image)
+	if err != nil {
+		return "", err
+	}
+	// The staging directory is replaced if streaming fails.
+	defer func() {
+		os.RemoveAll(stagingPath)
+	}()
+
+	imgPath := filepath.Join(config.ImagesPath, image.Checksum)
+	var result *unzipit.Result
+	if config.StreamUnpack && canStream(image, imgPath) {
+		result, err = streamGoldImage(&image, imgPath, stagingPath, r)
+		if _, ok := err.(*streamError); err != nil && !ok {
+			return "", err
+		}
+
+		// Canceling the unpacking aborts the download as well, there is
+		// no point in downloading the image again.
+		if err := r.Context().Err(); err != nil {
+			return "", err
+		}
+
+		if err != nil {
+			log.Printf("[WARN] Unable to unpack image while downloading it, unpacking it once downloaded instead: %s", err)
+
+			os.RemoveAll(stagingPath)
+			if stagingPath, err = newStagingDir(image); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if result == nil {
+		r.SetPhase(operations.PhaseDownloading)
+		err = image.Download(imgPath, func(p DownloadProgress) {
+			r.SetProgressRate(p.Percent(), p.BytesPerSecond)
+		})
+		if err != nil {
+			return "", err
+		}
+		defer image.file.Close()
+
+		// Makes sure file cursor is in the right position.
+		if _, err := image.file.Seek(0, 0); err != nil {
+			return "", err
+		}
+
+		finfo, err := image.file.Stat()
+		if err != nil {
+			return "", err
+		}
+
+		r.SetPhase(operations.PhaseUnpacking)
+		log.Printf("[DEBUG] Unpacking gold virtual machine into %s\n", stagingPath)
+		opts := unzipit.Options{
+			Limits:     unpackLimits(),
+			OnProgress: unpackProgress(finfo.Size(), r),
+		}
+		result, err = unzipit.Extract(r.Context(), image.file, stagingPath, opts)
+		if err != nil {
+			debug.PrintStack()
+			log.Printf("[ERROR] Unpacking gold image %s\n", image.file.Name())
+			return "", err
+		}
+	}
+
+	vmx, err := goldVMX(stagingPath, result)
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeGoldManifest(stagingPath, image, vmx); err != nil {
+		return "", err
+	}
+
+	log.Printf("[DEBUG] Moving gold virtual machine into %s\n", goldPath)
+	if err := os.Rename(stagingPath, goldPath); err != nil {
+		return "", err
+	}
+
+	return goldPath, nil
+}
@@ -0,0 +1,257 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/lockfile"
+)
+
+func TestPrepareGoldImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var op *operations.Operation
+	goldPath, err := prepareGoldImage(env.image, op)
+	ok(t, err)
+	equals(t, filepath.Join(config.GoldImgsPath, env.image.Checksum), goldPath)
+
+	data, err := ioutil.ReadFile(filepath.Join(goldPath, goldManifestFile))
+	ok(t, err)
+
+	var manifest goldManifest
+	ok(t, json.Unmarshal(data, &manifest))
+	equals(t, env.image.Checksum, manifest.Checksum)
+	equals(t, []goldFile{{"osx.vmdk", 9}, {"osx.vmx", 75}}, manifest.Files)
+	equals(t, "osx.vmx", manifest.VMX)
+
+	staging, err := filepath.Glob(filepath.Join(config.GoldImgsPath, "*.staging-*"))
+	ok(t, err)
+	equals(t, 0, len(staging))
+
+	// VMware rewrites the VMX file when cloning, that is fine.
+	ok(t, ioutil.WriteFile(filepath.Join(goldPath, "osx.vmx"), []byte("snapshot.action = \"keep\"\n"), 0640))
+	ok(t, validateGoldImage(goldPath, env.image))
+
+	_, err = prepareGoldImage(env.image, op)
+	ok(t, err)
+	equals(t, int32(1), atomic.LoadInt32(&env.downloads))
+}
+
+func TestGoldVMXPath(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var op *operations.Operation
+	goldPath, err := prepareGoldImage(env.image, op)
+	ok(t, err)
+
+	vmx, err := goldVMXPath(goldPath)
+	ok(t, err)
+	equals(t, filepath.Join(goldPath, "osx.vmx"), vmx)
+
+	// Gold images unpacked by older versions only list their files.
+	manifest, err := readGoldManifest(goldPath)
+	ok(t, err)
+	manifest.VMX = ""
+	data, err := json.Marshal(manifest)
+	ok(t, err)
+	ok(t, ioutil.WriteFile(filepath.Join(goldPath, goldManifestFile), data, 0640))
+
+	vmx, err = goldVMXPath(goldPath)
+	ok(t, err)
+	equals(t, filepath.Join(goldPath, "osx.vmx"), vmx)
+
+	manifest.Files = []goldFile{{"osx.vmdk", 9}}
+	data, err = json.Marshal(manifest)
+	ok(t, err)
+	ok(t, ioutil.WriteFile(filepath.Join(goldPath, goldManifestFile), data, 0640))
+
+	_, err = goldVMXPath(goldPath)
+	assert(t, err != nil, "gold image without vmx file should fail")
+}
+
+func TestPrepareGoldImageIncomplete(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	goldPath := filepath.Join(config.GoldImgsPath, env.image.Checksum)
+
+	var tests = []struct {
+		name  string
+		setup func()
+	}{
+		{"interrupted unpacking", func() {
+			os.Remove(filepath.Join(goldPath, goldManifestFile))
+			os.Remove(filepath.Join(goldPath, "osx.vmdk"))
+		}},
+		{"truncated disk", func() {
+			ok(t, ioutil.WriteFile(filepath.Join(goldPath, "osx.vmdk"), []byte("fake"), 0640))
+		}},
+		{"missing disk", func() {
+			os.Remove(filepath.Join(goldPath, "osx.vmdk"))
+		}},
+		{"corrupt manifest", func() {
+			ok(t, ioutil.WriteFile(filepath.Join(goldPath, goldManifestFile), []byte("{"), 0640))
+		}},
+	}
+
+	var op *operations.Operation
+	for _, test := range tests {
+		_, err := prepareGoldImage(env.image, op)
+		ok(t, err)
+
+		test.setup()
+		assert(t, validateGoldImage(goldPath, env.image) != nil, "%s: gold image should be invalid", test.name)
+
+		// Leftovers from a crash while unpacking.
+		ok(t, os.MkdirAll(filepath.Join(config.GoldImgsPath, env.image.Checksum+".staging-123"), 0740))
+
+		_, err = prepareGoldImage(env.image, op)
+		ok(t, err)
+		ok(t, validateGoldImage(goldPath, env.image))
+
+		data, err := ioutil.ReadFile(filepath.Join(goldPath, "osx.vmdk"))
+		ok(t, err)
+		equals(t, "fake disk", string(data))
+
+		staging, err := filepath.Glob(filepath.Join(config.GoldImgsPath, "*.staging-*"))
+		ok(t, err)
+		assert(t, len(staging) == 0, "%s: staging directories should have been removed: %v", test.name, staging)
+	}
+}
+
+func TestPrepareGoldImageInUse(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.createVM(t, VMConfig{OSImage: env.image})
+	goldPath := filepath.Join(config.GoldImgsPath, env.image.Checksum)
+
+	// Gold images unpacked before manifests were written are adopted.
+	ok(t, os.Remove(filepath.Join(goldPath, goldManifestFile)))
+	ok(t, ioutil.WriteFile(filepath.Join(goldPath, "osx.vmdk"), []byte("cloned from"), 0640))
+
+	var op *operations.Operation
+	_, err := prepareGoldImage(env.image, op)
+	ok(t, err)
+	ok(t, validateGoldImage(goldPath, env.image))
+
+	data, err := ioutil.ReadFile(filepath.Join(goldPath, "osx.vmdk"))
+	ok(t, err)
+	equals(t, "cloned from", string(data))
+
+	// Any other invalid gold image is kept as is.
+	ok(t, ioutil.WriteFile(filepath.Join(goldPath, "osx.vmdk"), []byte("truncated"), 0640))
+	_, err = prepareGoldImage(env.image, op)
+	assert(t, err != nil, "invalid gold image in use should fail")
+
+	data, err = ioutil.ReadFile(filepath.Join(goldPath, "osx.vmdk"))
+	ok(t, err)
+	equals(t, "truncated", string(data))
+	equals(t, int32(1), atomic.LoadInt32(&env.downloads))
+}
+
+func TestPrepareGoldImageStreaming(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	config.StreamUnpack = true
+	var op *operations.Operation
+
+	// Nothing is committed unless the data streamed matches the checksum.
+	corrupt := env.image
+	corrupt.Checksum = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	_, err := prepareGoldImage(corrupt, op)
+	assert(t, err != nil, "corrupt image should fail")
+
+	entries, err := ioutil.ReadDir(config.GoldImgsPath)
+	ok(t, err)
+	for _, entry := range entries {
+		assert(t, !entry.IsDir(), "nothing should be left in the gold images directory: %s", entry.Name())
+	}
+
+	goldPath, err := prepareGoldImage(env.image, op)
+	ok(t, err)
+	ok(t, validateGoldImage(goldPath, env.image))
+
+	data, err := ioutil.ReadFile(filepath.Join(goldPath, "osx.vmdk"))
+	ok(t, err)
+	equals(t, "fake disk", string(data))
+
+	_, err = os.Stat(filepath.Join(config.ImagesPath, env.image.Checksum, env.image.cacheName()))
+	ok(t, err)
+}
+
+func TestPrepareGoldImageCanceled(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var tests = []struct {
+		desc   string
+		stream bool
+	}{
+		{"unpacking", false},
+		{"streaming", true},
+	}
+
+	for _, test := range tests {
+		config.StreamUnpack = test.stream
+		downloads := atomic.LoadInt32(&env.downloads)
+		release := env.holdDownloads(env.image)
+		defer release()
+
+		op, err := operations.New(operations.TypePrepareImage, env.image.Checksum)
+		ok(t, err)
+
+		prepared := make(chan error, 1)
+		go func() {
+			_, err := prepareGoldImage(env.image, op)
+			prepared <- err
+		}()
+
+		deadline := time.Now().Add(10 * time.Second)
+		for op.Snapshot().Phase != operations.PhaseDownloading {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: image download never started", test.desc)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert(t, op.Cancel(), "%s: operation should be canceled", test.desc)
+		equals(t, context.Canceled, <-prepared)
+
+		// The preparation stops once the download it waits for is done.
+		release()
+		lock, err := lockfile.Acquire(filepath.Join(config.GoldImgsPath, env.image.Checksum+".lock"))
+		ok(t, err)
+		ok(t, lock.Release())
+
+		_, err = os.Stat(filepath.Join(config.GoldImgsPath, env.image.Checksum))
+		assert(t, os.IsNotExist(err), "%s: gold image should not exist", test.desc)
+
+		staging, err := filepath.Glob(filepath.Join(config.GoldImgsPath, "*.staging-*"))
+		ok(t, err)
+		assert(t, len(staging) == 0, "%s: staging directories should have been removed: %v", test.desc, staging)
+
+		// Streamed images are not downloaded again once canceled.
+		equals(t, downloads+1, atomic.LoadInt32(&env.downloads))
+		ok(t, os.RemoveAll(config.ImagesPath))
+	}
+
+	var op *operations.Operation
+	goldPath, err := prepareGoldImage(env.image, op)
+	ok(t, err)
+	ok(t, validateGoldImage(goldPath, env.image))
+}
@@ -20,25 +20,84 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // A virtual machine image definition.
 type Image struct {
-	// Image URL where to download from
+	// Image URL where to download from. It can also be a file:// URL or an
+	// absolute path to an image on the local filesystem.
 	URL string `json:"url"`
+	// URLs to download the image from, in order, if it can't be downloaded
+	// from URL
+	Mirrors []string `json:"mirrors,omitempty"`
 	// Checksum of the image, used to check integrity after downloading it
 	Checksum string `json:"checksum"`
 	// Algorithm use to check the checksum
 	ChecksumType string `json:"checksum_type"`
+	// URL of a signed ImageManifest describing the image. If set, the image
+	// URL, size and checksum are taken from the manifest instead.
+	ManifestURL string `json:"manifest_url,omitempty"`
+	// Size of the image in bytes, checked after downloading it if set
+	Size int64 `json:"size,omitempty"`
+	// How to bring a local image into config.ImagesPath: LocalModeInPlace,
+	// LocalModeLink or LocalModeCopy
+	LocalMode string `json:"local_mode,omitempty"`
 	// Password to decrypt the virtual machine if it is encrypted. This is used by
 	// VIX to be able to open the virtual machine
 	Password string `json:"-"`
 	// Internal file reference
 	file *os.File
+	// If set, data downloaded is also written to it, i.e.: to unpack the
+	// image while downloading it
+	tee io.Writer
+	// Signed manifest the image was described by, and its signature
+	manifest  []byte
+	signature []byte
 }
 
-// Downloads and a virtual machine image.
-func (img *Image) Download(destPath string) error {
+// How many times a download is attempted before giving up, and how long to
+// wait before the first retry. The wait doubles after every failed attempt.
+var (
+	downloadAttempts = 5
+	downloadBackoff  = time.Second
+)
+
+// How often download progress is reported.
+const progressInterval = 500 * time.Millisecond
+
+// DownloadProgress describes how far along an image download is.
+type DownloadProgress struct {
+	// Bytes downloaded so far, including those from interrupted attempts
+	Written int64
+	// Size of the image in bytes, or -1 if unknown
+	Total int64
+	// Average download speed since the current attempt started
+	BytesPerSecond int64
+}
+
+// Percent returns the percentage of the image downloaded, or 0 if the size of
+// the image is unknown.
+func (p DownloadProgress) Percent() int {
+	if p.Total <= 0 {
+		return 0
+	}
+	return int(p.Written * 100 / p.Total)
+}
+
+// Downloads and a virtual machine image, trying its mirrors in order if it
+// can't be downloaded from its URL. Data is downloaded into a .partial file
+// which is only renamed once its checksum is verified, so that interrupted
+// downloads are resumed using HTTP range requests instead of starting over,
+// even from a different mirror. Images on the local filesystem are verified
+// the same way, without going through the network. Images are stored in
+// destPath under a name derived from their checksum, so that images with the
+// same file name never collide. If progress is not nil, it is called
+// periodically while downloading. Data is hashed as it is downloaded, so that
+// it does not need to be read again to verify it.
+func (img *Image) Download(destPath string, progress func(DownloadProgress)) error {
 	if img.URL == "" {
 		return errors.New("Image URL is required")
 	}
@@ -47,6 +106,12 @@ func (img *Image) Download(destPath string) error {
 		return errors.New("Image checksum is required")
 	}
 
+	// The checksum names the file the image is stored in, along with its
+	// type, which newHash only accepts if known.
+	if !isChecksum(img.Checksum) {
+		return fmt.Errorf("Invalid image checksum: %q", img.Checksum)
+	}
+
 	if img.ChecksumType == "" {
 		return errors.New("Image checksum type is required")
 	}
@@ -55,99 +120,399 @@ func (img *Image) Download(destPath string) error {
 		destPath = os.TempDir()
 	}
 
-	u, err := url.Parse(img.URL)
+	hasher, err := newHash(img.ChecksumType)
 	if err != nil {
 		return err
 	}
+	d := &digester{hash: hasher, tee: img.tee}
 
-	_, filename := path.Split(u.Path)
-	if filename == "" {
-		filename = "unnamed"
+	for i, source := range img.sources() {
+		if i > 0 {
+			log.Printf("[WARN] Trying mirror %s...", source)
+		}
+
+		if err = img.downloadFrom(source, destPath, d, progress); err == nil {
+			return nil
+		}
+		log.Printf("[WARN] Unable to get image from %s: %s", source, err)
+
+		if _, ok := err.(*streamError); ok {
+			return err
+		}
+	}
+
+	return err
+}
+
+// sources returns the image URL followed by its mirrors.
+func (img *Image) sources() []string {
+	return append([]string{img.URL}, img.Mirrors...)
+}
+
+// cacheName returns the name the image is stored under, which only depends on
+// its content.
+func (img *Image) cacheName() string {
+	return img.ChecksumType + "-" + strings.ToLower(img.Checksum)
+}
+
+// downloadFrom downloads the image from the given source URL into destPath.
+func (img *Image) downloadFrom(source, destPath string, d *digester, progress func(DownloadProgress)) error {
+	if srcPath, ok := localPath(source); ok {
+		if d.tee != nil {
+			return &streamError{errors.New("Local images can't be streamed")}
+		}
+		return img.openLocal(srcPath, destPath, progress)
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return err
 	}
 
 	os.MkdirAll(destPath, 0740)
 
-	filePath := filepath.Join(destPath, filename)
+	filePath := filepath.Join(destPath, img.cacheName())
+	partialPath := filePath + ".partial"
 
-	fetchAndWrite := func() error {
-		data, err := img.fetch(img.URL)
-		if err != nil {
+	// Images used to be stored under the file name in their URL.
+	if legacyName := legacyFileName(u.Path); legacyName != "" {
+		img.migrateLegacyFile(filepath.Join(destPath, legacyName), filePath)
+	}
+
+	log.Printf("[DEBUG] Opening %s...", filePath)
+	img.file, err = os.Open(filePath)
+	if err == nil {
+		if err = img.verify(); err == nil {
+			return nil
+		}
+		img.file.Close()
+
+		log.Printf("[DEBUG] File on disk does not match current checksum. Downloading it again...")
+
+		// Incomplete downloads used to be written straight to filePath, so
+		// its data is reused if there is nothing better to resume from.
+		// Files hard linked from local images are left alone, resuming
+		// into them would write into the original image.
+		finfo, statErr := os.Stat(filePath)
+		if _, err := os.Stat(partialPath); os.IsNotExist(err) && statErr == nil && hardLinks(finfo) == 1 {
+			os.Rename(filePath, partialPath)
+		} else {
+			os.Remove(filePath)
+		}
+	} else {
+		log.Printf("[DEBUG] %s file does not exist. Downloading it...", filePath)
+	}
+
+	finfo, err := os.Stat(partialPath)
+	resumed := err == nil && finfo.Size() > 0
+
+	for {
+		if err := img.fetchWithRetries(source, partialPath, d, progress); err != nil {
 			return err
 		}
 
-		img.file, err = img.write(data, filePath)
+		img.file, err = os.Open(partialPath)
 		if err != nil {
 			return err
 		}
-		data.Close()
 
-		return nil
+		err = img.verifyDigest(d)
+		if err == nil {
+			break
+		}
+		img.file.Close()
+		os.Remove(partialPath)
+
+		// The data resumed from may have been stale or corrupt, in which
+		// case downloading the image from scratch can still succeed.
+		if !resumed {
+			return err
+		}
+		log.Printf("[DEBUG] Resumed download does not match checksum. Downloading it from scratch...")
+		resumed = false
+	}
+
+	img.file.Close()
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return err
 	}
 
-	log.Printf("[DEBUG] Opening %s...", filePath)
 	img.file, err = os.Open(filePath)
+	return err
+}
+
+// legacyFileName returns the name images downloaded from the given URL path
+// used to be stored under, or an empty string if it is not a usable file
+// name.
+func legacyFileName(urlPath string) string {
+	_, name := path.Split(urlPath)
+	if name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return ""
+	}
+	return name
+}
+
+// migrateLegacyFile moves the image stored under its legacy name to its new
+// name, unless there is a file with the new name already. Images with the
+// same file name in their URL shared their legacy name, so the file is only
+// moved if it matches the image, otherwise it is left for images to be
+// collected.
+func (img *Image) migrateLegacyFile(legacyPath, newPath string) {
+	if legacyPath == newPath {
+		return
+	}
+
+	finfo, err := os.Stat(legacyPath)
+	if err != nil || !finfo.Mode().IsRegular() {
+		return
+	}
+
+	if _, err := os.Stat(newPath); !os.IsNotExist(err) {
+		return
+	}
+
+	file, err := os.Open(legacyPath)
 	if err != nil {
-		log.Printf("[DEBUG] %s file does not exist. Downloading it...", filename)
+		return
+	}
 
-		if err = fetchAndWrite(); err != nil {
-			return err
-		}
+	legacy := Image{
+		Checksum:     img.Checksum,
+		ChecksumType: img.ChecksumType,
+		Size:         img.Size,
+		file:         file,
 	}
+	err = legacy.verify()
+	file.Close()
 
-	if err = img.verify(); err != nil {
-		log.Printf("[DEBUG] File on disk does not match current checksum.\n Downloading file again...")
+	if err != nil {
+		log.Printf("[DEBUG] Not moving %s, it is not image %s: %s", legacyPath, img.Checksum, err)
+		return
+	}
+
+	log.Printf("[DEBUG] Moving %s to %s", legacyPath, newPath)
+	if err := os.Rename(legacyPath, newPath); err != nil {
+		log.Printf("[WARN] Unable to move %s to %s: %s", legacyPath, newPath, err)
+	}
+}
+
+// statusError is returned when the image server replies with an unexpected
+// HTTP status code.
+type statusError struct {
+	StatusCode int
+}
 
-		if err = fetchAndWrite(); err != nil {
+// Implements Error interface.
+func (e *statusError) Error() string {
+	return fmt.Sprintf("Unable to fetch data, server returned code %d", e.StatusCode)
+}
+
+// streamError is returned when downloaded data could not be streamed to
+// Image.tee. Data can't be streamed twice, so there is no point in retrying.
+type streamError struct {
+	Err error
+}
+
+// Implements Error interface.
+func (e *streamError) Error() string {
+	return fmt.Sprintf("Unable to stream image data: %s", e.Err)
+}
+
+// isRetryable tells whether a failed download attempt is worth retrying.
+// Client errors, such as a 404, are not going to go away by retrying.
+func isRetryable(err error) bool {
+	if _, ok := err.(*streamError); ok {
+		return false
+	}
+
+	if serr, ok := err.(*statusError); ok {
+		return serr.StatusCode >= 500 ||
+			serr.StatusCode == http.StatusRequestTimeout ||
+			serr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// fetchWithRetries calls fetchPartial until it succeeds, backing off between
+// attempts.
+func (img *Image) fetchWithRetries(source, partialPath string, d *digester, progress func(DownloadProgress)) error {
+	backoff := downloadBackoff
+
+	var err error
+	for attempt := 1; attempt <= downloadAttempts; attempt++ {
+		err = img.fetchPartial(source, partialPath, d, progress)
+		if err == nil || !isRetryable(err) {
 			return err
 		}
 
-		if err = img.verify(); err != nil {
-			return err
+		if attempt < downloadAttempts {
+			log.Printf("[WARN] Download attempt %d of %d failed: %s. Retrying in %s...",
+				attempt, downloadAttempts, err, backoff)
+			time.Sleep(backoff)
+			backoff *= 2
 		}
 	}
 
-	return nil
+	return err
 }
 
-// Gets a VM image through HTTP.
-func (img *Image) fetch(URL string) (io.ReadCloser, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: false,
-			},
-		},
+// fetchPartial downloads the image from source into partialPath, resuming
+// from the data already there if the server supports range requests. Data
+// is also written to d as it is downloaded.
+func (img *Image) fetchPartial(source, partialPath string, d *digester, progress func(DownloadProgress)) error {
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	resp, err := client.Get(URL)
+	offset, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	if err := d.catchUp(file, offset); err != nil {
+		return err
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Unable to fetch data, server returned code %d", resp.StatusCode)
+	resp, err := img.fetch(source, offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			// Whatever was downloaded can't be trusted, starts over.
+			file.Truncate(0)
+			return fmt.Errorf("Unexpected Content-Range %q when resuming from byte %d",
+				resp.Header.Get("Content-Range"), offset)
+		}
+		total = size
+		log.Printf("[DEBUG] Resuming download of %s from byte %d", source, offset)
+	case http.StatusOK:
+		// The server does not support range requests, starts over.
+		if offset > 0 {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+
+			if err := d.catchUp(file, offset); err != nil {
+				return err
+			}
+		}
+		total = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// There is nothing left to download.
+		return nil
+	default:
+		return &statusError{resp.StatusCode}
 	}
 
-	return resp.Body, nil
+	log.Printf("[DEBUG] Downloading file data to %s", partialPath)
 
+	pw := &progressWriter{
+		written:      offset,
+		startWritten: offset,
+		total:        total,
+		start:        time.Now(),
+		fn:           progress,
+	}
+
+	written, err := io.Copy(io.MultiWriter(file, d), io.TeeReader(resp.Body, pw))
+	pw.report()
+	log.Printf("[DEBUG] %d bytes written to %s", written, partialPath)
+
+	return err
 }
 
-// Writes the downloading stream down to a file.
-func (img *Image) write(reader io.Reader, filePath string) (*os.File, error) {
-	log.Printf("[DEBUG] Downloading file data to %s", filePath)
+// parseContentRange parses a Content-Range header value such as
+// "bytes 100-199/1000", returning the first byte position and the complete
+// length, which is -1 if the server does not know it.
+func parseContentRange(value string) (int64, int64, error) {
+	var start, end int64
+	var size string
+	if _, err := fmt.Sscanf(value, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, 0, err
+	}
+
+	if size == "*" {
+		return start, -1, nil
+	}
 
-	compressedFile, err := os.Create(filePath)
+	total, err := strconv.ParseInt(size, 10, 64)
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
+	return start, total, nil
+}
 
-	written, err := io.Copy(compressedFile, reader)
+// progressWriter counts the bytes written to it, periodically reporting the
+// progress of the download.
+type progressWriter struct {
+	written      int64
+	startWritten int64
+	total        int64
+	start        time.Time
+	reportedAt   time.Time
+	fn           func(DownloadProgress)
+}
+
+// Implements io.Writer interface.
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	if time.Since(w.reportedAt) >= progressInterval {
+		w.report()
+	}
+	return len(p), nil
+}
+
+// report calls the progress function, if any.
+func (w *progressWriter) report() {
+	if w.fn == nil {
+		return
+	}
+	w.reportedAt = time.Now()
+
+	var bytesPerSecond int64
+	if elapsed := time.Since(w.start).Seconds(); elapsed > 0 {
+		bytesPerSecond = int64(float64(w.written-w.startWritten) / elapsed)
+	}
+
+	w.fn(DownloadProgress{
+		Written:        w.written,
+		Total:          w.total,
+		BytesPerSecond: bytesPerSecond,
+	})
+}
+
+// Gets a VM image through HTTP, starting at the given byte offset.
+func (img *Image) fetch(URL string, offset int64) (*http.Response, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: false,
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", URL, nil)
 	if err != nil {
 		return nil, err
 	}
-	log.Printf("[DEBUG] %d bytes written to %s", written, filePath)
 
-	return compressedFile, nil
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	return client.Do(req)
 }
 
 // Verifies the image package integrity after it is downloaded.
@@ -158,31 +523,118 @@ func (img *Image) verify() error {
 		return err
 	}
 
+	if img.Size > 0 {
+		finfo, err := img.file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if finfo.Size() != img.Size {
+			return fmt.Errorf("[ERROR] Size does not match\n Result: %d\n Expected: %d", finfo.Size(), img.Size)
+		}
+	}
+
 	log.Printf("[DEBUG] Verifying image checksum...")
-	var hasher hash.Hash
+	hasher, err := newHash(img.ChecksumType)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(hasher, img.file)
+	if err != nil {
+		return err
+	}
+
+	return img.checkSum(fmt.Sprintf("%x", hasher.Sum(nil)))
+}
+
+// verifyDigest verifies the image using the checksum computed while it was
+// downloaded, falling back to reading it again if the digester did not see
+// all of it.
+func (img *Image) verifyDigest(d *digester) error {
+	finfo, err := img.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if finfo.Size() != d.n {
+		log.Printf("[DEBUG] Only %d of %d bytes were hashed while downloading", d.n, finfo.Size())
+		return img.verify()
+	}
+
+	if img.Size > 0 && finfo.Size() != img.Size {
+		return fmt.Errorf("[ERROR] Size does not match\n Result: %d\n Expected: %d", finfo.Size(), img.Size)
+	}
+
+	return img.checkSum(d.sum())
+}
 
-	switch img.ChecksumType {
+// checkSum compares the checksum computed for the image with the expected one.
+func (img *Image) checkSum(result string) error {
+	if !strings.EqualFold(result, img.Checksum) {
+		return fmt.Errorf("[ERROR] Checksum does not match\n Result: %s\n Expected: %s", result, img.Checksum)
+	}
+	return nil
+}
+
+// newHash returns the hash function for a checksum type.
+func newHash(checksumType string) (hash.Hash, error) {
+	switch checksumType {
 	case "md5":
-		hasher = md5.New()
+		return md5.New(), nil
 	case "sha1":
-		hasher = sha1.New()
+		return sha1.New(), nil
 	case "sha256":
-		hasher = sha256.New()
+		return sha256.New(), nil
 	case "sha512":
-		hasher = sha512.New()
+		return sha512.New(), nil
 	default:
-		return fmt.Errorf("[ERROR] Crypto algorithm no supported: %s", img.ChecksumType)
+		return nil, fmt.Errorf("[ERROR] Crypto algorithm no supported: %s", checksumType)
 	}
-	_, err = io.Copy(hasher, img.file)
-	if err != nil {
-		return err
+}
+
+// digester hashes image data as it is downloaded, copying it to tee as well
+// if set.
+type digester struct {
+	hash hash.Hash
+	tee  io.Writer
+	// Bytes hashed so far
+	n int64
+}
+
+// Implements io.Writer interface.
+func (d *digester) Write(p []byte) (int, error) {
+	if d.tee != nil {
+		if _, err := d.tee.Write(p); err != nil {
+			return 0, &streamError{err}
+		}
 	}
 
-	result := fmt.Sprintf("%x", hasher.Sum(nil))
+	d.hash.Write(p)
+	d.n += int64(len(p))
+	return len(p), nil
+}
 
-	if result != img.Checksum {
-		return fmt.Errorf("[ERROR] Checksum does not match\n Result: %s\n Expected: %s", result, img.Checksum)
+// catchUp makes the digester account for the first offset bytes of file,
+// downloaded by earlier attempts, before new data is appended to it.
+func (d *digester) catchUp(file *os.File, offset int64) error {
+	if d.n == offset {
+		return nil
 	}
 
-	return nil
+	if d.n > offset {
+		if d.tee != nil {
+			return &streamError{errors.New("The download started over after data was streamed")}
+		}
+		d.hash.Reset()
+		d.n = 0
+	}
+
+	_, err := io.Copy(d, io.NewSectionReader(file, d.n, offset-d.n))
+	return err
+}
+
+// sum returns the hex encoded checksum of the data hashed so far.
+func (d *digester) sum() string {
+	return fmt.Sprintf("%x", d.hash.Sum(nil))
 }
@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c4milo/osx-builder/config"
+)
+
+// Ways of bringing images on the local filesystem into config.ImagesPath.
+const (
+	// The image is verified and unpacked from where it is, nothing is copied.
+	LocalModeInPlace = ""
+	// The image is hard linked, or copied if that is not possible, i.e.: it
+	// is on a different filesystem.
+	LocalModeLink = "link"
+	// The image is copied.
+	LocalModeCopy = "copy"
+)
+
+// localPath returns the path of the file an image URL refers to, if it is a
+// file:// URL or an absolute path, along with whether it is one.
+func localPath(rawURL string) (string, bool) {
+	if strings.HasPrefix(rawURL, "file://") {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Host != "" && u.Host != "localhost") {
+			return "", false
+		}
+		return filepath.FromSlash(u.Path), true
+	}
+
+	if filepath.IsAbs(rawURL) {
+		return filepath.Clean(rawURL), true
+	}
+
+	return "", false
+}
+
+// resolveLocalPath resolves symbolic links in the path of a local image and
+// makes sure the result is within config.LocalImagesPath, so that requests
+// can't read arbitrary files off the build host.
+func resolveLocalPath(path string) (string, error) {
+	if config.LocalImagesPath == "" {
+		return "", errors.New("Local images are disabled, LOCAL_IMAGES_PATH is not set")
+	}
+
+	root, err := filepath.EvalSymlinks(config.LocalImagesPath)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Local image %s is outside of %s", path, config.LocalImagesPath)
+	}
+
+	return resolved, nil
+}
+
+// openLocal verifies an image sitting on the local filesystem, within
+// config.LocalImagesPath. Depending on img.LocalMode, the image is used in
+// place or imported into destPath first.
+func (img *Image) openLocal(srcPath, destPath string, progress func(DownloadProgress)) error {
+	srcPath, err := resolveLocalPath(srcPath)
+	if err != nil {
+		return err
+	}
+
+	switch img.LocalMode {
+	case LocalModeInPlace:
+		log.Printf("[DEBUG] Using local image %s in place", srcPath)
+		img.file, err = os.Open(srcPath)
+		if err != nil {
+			return err
+		}
+
+		if err := img.verify(); err != nil {
+			img.file.Close()
+			return err
+		}
+		return nil
+	case LocalModeLink, LocalModeCopy:
+	default:
+		return fmt.Errorf("Unsupported local image mode: %s", img.LocalMode)
+	}
+
+	if destPath == "" {
+		destPath = os.TempDir()
+	}
+
+	if err := os.MkdirAll(destPath, 0740); err != nil {
+		return err
+	}
+
+	filePath := filepath.Join(destPath, img.cacheName())
+	img.file, err = os.Open(filePath)
+	if err == nil {
+		if err = img.verify(); err == nil {
+			return nil
+		}
+		img.file.Close()
+
+		// It may be a hard link to the source, so it is only unlinked.
+		log.Printf("[DEBUG] File on disk does not match current checksum. Importing it again...")
+		os.Remove(filePath)
+	}
+
+	importPath := filePath + ".importing"
+	os.Remove(importPath)
+
+	linked := false
+	if img.LocalMode == LocalModeLink {
+		if err := os.Link(srcPath, importPath); err != nil {
+			log.Printf("[DEBUG] Unable to hard link %s, copying it instead: %s", srcPath, err)
+		} else {
+			log.Printf("[DEBUG] Hard linked %s into %s", srcPath, importPath)
+			linked = true
+		}
+	}
+
+	if !linked {
+		if err := copyLocal(srcPath, importPath, progress); err != nil {
+			os.Remove(importPath)
+			return err
+		}
+	}
+
+	img.file, err = os.Open(importPath)
+	if err != nil {
+		os.Remove(importPath)
+		return err
+	}
+
+	if err := img.verify(); err != nil {
+		img.file.Close()
+		os.Remove(importPath)
+		return err
+	}
+
+	img.file.Close()
+	if err := os.Rename(importPath, filePath); err != nil {
+		return err
+	}
+
+	img.file, err = os.Open(filePath)
+	return err
+}
+
+// copyLocal copies srcPath into destPath, reporting progress the same way
+// downloads do.
+func copyLocal(srcPath, destPath string, progress func(DownloadProgress)) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	finfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dest, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	log.Printf("[DEBUG] Copying %s into %s", srcPath, destPath)
+
+	pw := &progressWriter{
+		total: finfo.Size(),
+		start: time.Now(),
+		fn:    progress,
+	}
+
+	_, err = io.Copy(dest, io.TeeReader(src, pw))
+	pw.report()
+	if err != nil {
+		return err
+	}
+
+	return dest.Sync()
+}
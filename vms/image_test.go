@@ -5,14 +5,21 @@
 package vms
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
-
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/c4milo/osx-builder/config"
 )
 
 func TestDownload(t *testing.T) {
@@ -39,7 +46,7 @@ func TestDownload(t *testing.T) {
 	ok(t, err)
 	defer os.RemoveAll(destDir)
 
-	err = image.Download(destDir)
+	err = image.Download(destDir, nil)
 	ok(t, err)
 
 	filename := image.file.Name()
@@ -50,3 +57,502 @@ func TestDownload(t *testing.T) {
 	size := finfo.Size()
 	assert(t, size > 0, fmt.Sprintf("Image file is empty: %d", size))
 }
+
+// rangeServer serves data supporting range requests and keeps the Range
+// header of every request received. Responses for the first requests can be
+// overridden through handlers.
+type rangeServer struct {
+	*httptest.Server
+	data     []byte
+	handlers []http.HandlerFunc
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newRangeServer(data []byte, handlers ...http.HandlerFunc) *rangeServer {
+	s := &rangeServer{
+		data:     data,
+		handlers: handlers,
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		n := len(s.ranges)
+		s.mu.Unlock()
+
+		if n <= len(s.handlers) {
+			s.handlers[n-1](w, r)
+			return
+		}
+		http.ServeContent(w, r, "image.tar.gz", time.Time{}, bytes.NewReader(s.data))
+	}))
+	return s
+}
+
+// Ranges returns the Range headers received so far.
+func (s *rangeServer) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// newImageData returns random image data along with its checksum.
+func newImageData(t *testing.T, size int) ([]byte, string) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	ok(t, err)
+	return data, fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// setupDownload creates a destination directory for downloads and makes
+// retries fast. The returned function undoes both.
+func setupDownload(t *testing.T) (string, func()) {
+	destDir, err := ioutil.TempDir(os.TempDir(), "osx-builder-image")
+	ok(t, err)
+
+	backoff := downloadBackoff
+	downloadBackoff = time.Millisecond
+
+	return destDir, func() {
+		downloadBackoff = backoff
+		os.RemoveAll(destDir)
+	}
+}
+
+// checkDownloaded verifies that the image was completely downloaded and
+// that no partial file was left behind.
+func checkDownloaded(t *testing.T, image *Image, data []byte) {
+	defer image.file.Close()
+
+	_, err := image.file.Seek(0, 0)
+	ok(t, err)
+	downloaded, err := ioutil.ReadAll(image.file)
+	ok(t, err)
+	assert(t, bytes.Equal(data, downloaded), "downloaded data does not match")
+
+	_, err = os.Stat(image.file.Name() + ".partial")
+	assert(t, os.IsNotExist(err), "partial file should have been removed")
+}
+
+func TestDownloadResume(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	data, checksum := newImageData(t, 1<<20)
+	ts := newRangeServer(data)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          ts.URL + "/image.tar.gz",
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+
+	half := len(data) / 2
+	partial := filepath.Join(destDir, image.cacheName()+".partial")
+	ok(t, ioutil.WriteFile(partial, data[:half], 0640))
+
+	var last DownloadProgress
+	ok(t, image.Download(destDir, func(p DownloadProgress) {
+		last = p
+	}))
+	checkDownloaded(t, image, data)
+
+	equals(t, []string{fmt.Sprintf("bytes=%d-", half)}, ts.Ranges())
+	equals(t, int64(len(data)), last.Written)
+	equals(t, int64(len(data)), last.Total)
+	equals(t, 100, last.Percent())
+	equals(t, filepath.Join(destDir, image.cacheName()), image.file.Name())
+}
+
+func TestDownloadRetry(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	data, checksum := newImageData(t, 1<<20)
+	half := len(data) / 2
+
+	ts := newRangeServer(data,
+		// Drops the connection halfway through.
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+			w.Write(data[:half])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		},
+	)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          ts.URL + "/image.tar.gz",
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, data)
+
+	resume := fmt.Sprintf("bytes=%d-", half)
+	equals(t, []string{"", resume, resume}, ts.Ranges())
+}
+
+func TestDownloadCorruptPartial(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	data, checksum := newImageData(t, 1<<16)
+	ts := newRangeServer(data)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          ts.URL + "/image.tar.gz",
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+
+	// Leftover from an interrupted download that got corrupt.
+	garbage, _ := newImageData(t, len(data)/2)
+	partial := filepath.Join(destDir, image.cacheName()+".partial")
+	ok(t, ioutil.WriteFile(partial, garbage, 0640))
+
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, data)
+	equals(t, []string{fmt.Sprintf("bytes=%d-", len(garbage)), ""}, ts.Ranges())
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	ts := newRangeServer(nil, http.NotFound)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          ts.URL + "/image.tar.gz",
+		Checksum:     "35fd19dc1bb7e18a365c1c589df2292942c197a4",
+		ChecksumType: "sha1",
+	}
+
+	err := image.Download(destDir, nil)
+	assert(t, err != nil, "an error was expected")
+	equals(t, 1, len(ts.Ranges()))
+}
+
+func TestDownloadTee(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	data, checksum := newImageData(t, 1<<20)
+	half := len(data) / 2
+	quarter := len(data) / 4
+
+	ts := newRangeServer(data,
+		// Drops the connection halfway through.
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)-quarter))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", quarter, len(data)-1, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[quarter:half])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		},
+	)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          ts.URL + "/image.tar.gz",
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+
+	// Data resumed from is streamed too, before the data downloaded.
+	partial := filepath.Join(destDir, image.cacheName()+".partial")
+	ok(t, ioutil.WriteFile(partial, data[:quarter], 0640))
+
+	streamed := new(bytes.Buffer)
+	image.tee = streamed
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, data)
+	assert(t, bytes.Equal(data, streamed.Bytes()), "streamed data does not match")
+
+	// Streams can't start over, downloads from servers without range
+	// support can't be resumed.
+	ts = newRangeServer(data, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+	defer ts.Close()
+
+	ok(t, os.Remove(image.file.Name()))
+	ok(t, ioutil.WriteFile(partial, data[:quarter], 0640))
+	image.URL = ts.URL + "/image.tar.gz"
+	image.tee = new(bytes.Buffer)
+	_, isStreamErr := image.Download(destDir, nil).(*streamError)
+	assert(t, isStreamErr, "a stream error was expected")
+}
+
+func TestDownloadMirrors(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	attempts := downloadAttempts
+	downloadAttempts = 2
+	defer func() { downloadAttempts = attempts }()
+
+	data, checksum := newImageData(t, 1<<16)
+	garbage, _ := newImageData(t, len(data))
+
+	down := newRangeServer(nil)
+	down.Close()
+
+	unavailable := newRangeServer(nil, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	defer unavailable.Close()
+
+	corrupt := newRangeServer(garbage)
+	defer corrupt.Close()
+
+	ts := newRangeServer(data)
+	defer ts.Close()
+
+	image := &Image{
+		URL:          down.URL + "/image.tar.gz",
+		Mirrors:      []string{unavailable.URL + "/image.tar.gz", corrupt.URL + "/image.tar.gz", ts.URL + "/image.tar.gz"},
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, data)
+	equals(t, 2, len(unavailable.Ranges()))
+	equals(t, 1, len(corrupt.Ranges()))
+	equals(t, []string{""}, ts.Ranges())
+
+	image.Mirrors = nil
+	assert(t, image.Download(destDir, nil) == nil, "downloaded image should be reused")
+	image.file.Close()
+}
+
+func TestDownloadSameName(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	var images []*Image
+	for i := 0; i < 2; i++ {
+		data, checksum := newImageData(t, 1<<10)
+		ts := newRangeServer(data)
+		defer ts.Close()
+
+		image := &Image{
+			URL:          ts.URL + "/box.tar.gz",
+			Checksum:     checksum,
+			ChecksumType: "sha1",
+		}
+		ok(t, image.Download(destDir, nil))
+		checkDownloaded(t, image, data)
+		images = append(images, image)
+	}
+
+	assert(t, images[0].file.Name() != images[1].file.Name(), "images should not be stored under the same name")
+	for _, image := range images {
+		ok(t, image.Download(destDir, nil))
+		image.file.Close()
+	}
+}
+
+func TestDownloadLegacyName(t *testing.T) {
+	destDir, cleanup := setupDownload(t)
+	defer cleanup()
+
+	data, checksum := newImageData(t, 1<<10)
+	other, otherChecksum := newImageData(t, 1<<10)
+	legacyPath := filepath.Join(destDir, "osx.tar.gz")
+	ok(t, ioutil.WriteFile(legacyPath, data, 0640))
+
+	ts := newRangeServer(other)
+	defer ts.Close()
+
+	// Another image with the same file name in its URL does not take it.
+	image := &Image{
+		URL:          ts.URL + "/v2/osx.tar.gz",
+		Checksum:     otherChecksum,
+		ChecksumType: "sha1",
+	}
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, other)
+	equals(t, []string{""}, ts.Ranges())
+
+	_, err := os.Stat(legacyPath)
+	ok(t, err)
+
+	image = &Image{
+		URL:          ts.URL + "/v1/osx.tar.gz",
+		Checksum:     checksum,
+		ChecksumType: "sha1",
+	}
+	ok(t, image.Download(destDir, nil))
+	checkDownloaded(t, image, data)
+	equals(t, 1, len(ts.Ranges()))
+
+	_, err = os.Stat(legacyPath)
+	assert(t, os.IsNotExist(err), "legacy file should have been moved")
+
+	for _, urlPath := range []string{"/", "/images/..", "/images/.", `/images/..\..`} {
+		equals(t, "", legacyFileName(urlPath))
+	}
+	equals(t, "osx.tar.gz", legacyFileName("/v1/osx.tar.gz"))
+}
+
+func TestDownloadInvalidChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-download")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	destPath := filepath.Join(dir, "images", "dest")
+	tests := []struct {
+		Checksum, ChecksumType string
+	}{
+		{"../../victim", "sha1"},
+		{"..", "sha1"},
+		{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "../../victim"},
+		{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "sha3"},
+	}
+
+	for _, tt := range tests {
+		image := Image{
+			URL:          "http://127.0.0.1:1/image.tar.gz",
+			Checksum:     tt.Checksum,
+			ChecksumType: tt.ChecksumType,
+		}
+		assert(t, image.Download(destPath, nil) != nil, "%s-%s should be refused", tt.ChecksumType, tt.Checksum)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	ok(t, err)
+	equals(t, 0, len(files))
+}
+
+func TestDownloadLocal(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-local")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("local image data")
+	srcPath := filepath.Join(dir, "src", "image.tar.gz")
+	ok(t, os.MkdirAll(filepath.Dir(srcPath), 0740))
+	ok(t, ioutil.WriteFile(srcPath, data, 0640))
+	checksum := fmt.Sprintf("%x", sha1.Sum(data))
+	config.LocalImagesPath = dir
+
+	tests := []struct {
+		URL, Mode string
+		// Whether the image is expected in the destination directory
+		Imported bool
+	}{
+		{srcPath, LocalModeInPlace, false},
+		{"file://" + srcPath, LocalModeInPlace, false},
+		{srcPath, LocalModeLink, true},
+		{"file://" + srcPath, LocalModeCopy, true},
+	}
+
+	for i, tt := range tests {
+		destPath := filepath.Join(dir, fmt.Sprintf("dest-%d", i))
+		image := Image{
+			URL:          tt.URL,
+			Checksum:     checksum,
+			ChecksumType: "sha1",
+			LocalMode:    tt.Mode,
+		}
+
+		ok(t, image.Download(destPath, nil))
+		finfo, err := image.file.Stat()
+		ok(t, err)
+		image.file.Close()
+
+		srcInfo, err := os.Stat(srcPath)
+		ok(t, err)
+
+		if !tt.Imported {
+			resolvedPath, err := filepath.EvalSymlinks(srcPath)
+			ok(t, err)
+			equals(t, resolvedPath, image.file.Name())
+			_, err = os.Stat(destPath)
+			assert(t, os.IsNotExist(err), "%s: nothing should be imported", tt.URL)
+			continue
+		}
+
+		equals(t, filepath.Join(destPath, image.cacheName()), image.file.Name())
+		equals(t, tt.Mode == LocalModeLink, os.SameFile(srcInfo, finfo))
+
+		// Imported images are reused.
+		ok(t, image.Download(destPath, nil))
+		image.file.Close()
+	}
+
+	image := Image{
+		URL:          srcPath,
+		Checksum:     "da39a3ee5e6b4b0d3255bfef95601890afd80709",
+		ChecksumType: "sha1",
+		LocalMode:    LocalModeLink,
+	}
+	destPath := filepath.Join(dir, "mismatch")
+	assert(t, image.Download(destPath, nil) != nil, "checksum mismatch should fail")
+
+	files, err := ioutil.ReadDir(destPath)
+	ok(t, err)
+	equals(t, 0, len(files))
+
+	source, err := ioutil.ReadFile(srcPath)
+	ok(t, err)
+	equals(t, data, source)
+
+	image.URL = filepath.Join(dir, "missing.tar.gz")
+	assert(t, os.IsNotExist(image.Download(destPath, nil)), "missing local images should fail")
+}
+
+func TestDownloadLocalOutsideRoot(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-local")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	data := []byte("local image data")
+	outsidePath := filepath.Join(dir, "outside", "image.tar.gz")
+	ok(t, os.MkdirAll(filepath.Dir(outsidePath), 0740))
+	ok(t, ioutil.WriteFile(outsidePath, data, 0640))
+
+	root := filepath.Join(dir, "root")
+	ok(t, os.MkdirAll(root, 0740))
+	ok(t, os.Symlink(outsidePath, filepath.Join(root, "link.tar.gz")))
+
+	tests := []struct {
+		URL, Root string
+	}{
+		{outsidePath, root},
+		{filepath.Join(root, "..", "outside", "image.tar.gz"), root},
+		{"file://" + filepath.Join(root, "link.tar.gz"), root},
+		{outsidePath, ""},
+	}
+
+	for _, tt := range tests {
+		config.LocalImagesPath = tt.Root
+		image := Image{
+			URL:          tt.URL,
+			Checksum:     fmt.Sprintf("%x", sha1.Sum(data)),
+			ChecksumType: "sha1",
+			LocalMode:    LocalModeCopy,
+		}
+
+		destPath := filepath.Join(dir, "dest")
+		assert(t, image.Download(destPath, nil) != nil, "%s should be refused with root %q", tt.URL, tt.Root)
+
+		files, _ := ioutil.ReadDir(destPath)
+		equals(t, 0, len(files))
+	}
+}
@@ -0,0 +1,16 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package vms
+
+import "os"
+
+// hardLinks returns the number of hard links to a file. It is not known on
+// this platform, so files are assumed to have only one.
+func hardLinks(finfo os.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,202 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/c4milo/osx-builder/config"
+)
+
+// ImageManifest describes an image released by whoever holds one of the keys
+// in config.ImageSigningKeys. Manifests are served as JSON, along with an
+// Ed25519 signature of the JSON document at the same URL plus ".sig".
+type ImageManifest struct {
+	// Image URL where to download from
+	URL string `json:"url"`
+	// URLs to download the image from, in order, if it can't be downloaded
+	// from URL
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Size of the image in bytes
+	Size int64 `json:"size"`
+	// SHA-256 checksum of the image
+	SHA256 string `json:"sha256"`
+	// Version of OS X installed in the image, i.e.: 10.11.1
+	OSVersion string `json:"os_version"`
+	// VMware virtual hardware version of the image, i.e.: 12
+	HardwareVersion int `json:"hardware_version"`
+}
+
+// Manifests and signatures are tiny, anything bigger than this is refused.
+const maxManifestSize = 1 << 20
+
+// ManifestError is returned when an image manifest cannot be fetched, is not
+// signed by a trusted key or is invalid.
+type ManifestError struct {
+	URL    string
+	Reason string
+}
+
+// Implements Error interface.
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("Image manifest %s: %s", e.URL, e.Reason)
+}
+
+// ApplyManifest fetches the manifest of the image and verifies its signature
+// against config.ImageSigningKeys, before anything is downloaded. The image
+// URL, size and checksum are then taken from the manifest, which is kept to
+// be recorded alongside the gold image. It does nothing if the image has no
+// manifest URL.
+func (img *Image) ApplyManifest() error {
+	if img.ManifestURL == "" {
+		return nil
+	}
+
+	if len(config.ImageSigningKeys) == 0 {
+		return &ManifestError{img.ManifestURL, "no image signing keys are configured to verify it"}
+	}
+
+	data, err := fetchSmall(img.ManifestURL)
+	if err != nil {
+		return &ManifestError{img.ManifestURL, err.Error()}
+	}
+
+	sigData, err := fetchSmall(img.ManifestURL + ".sig")
+	if err != nil {
+		return &ManifestError{img.ManifestURL, "unable to fetch signature: " + err.Error()}
+	}
+
+	signature, err := decodeSignature(sigData)
+	if err != nil {
+		return &ManifestError{img.ManifestURL, err.Error()}
+	}
+
+	if !verifyManifestSignature(data, signature) {
+		return &ManifestError{img.ManifestURL, "signature was not made by any of the trusted keys"}
+	}
+
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return &ManifestError{img.ManifestURL, err.Error()}
+	}
+
+	if img.Checksum != "" && !strings.EqualFold(img.Checksum, manifest.SHA256) {
+		return &ManifestError{img.ManifestURL, "checksum given does not match the one in the manifest"}
+	}
+
+	log.Printf("[DEBUG] Image manifest %s verified: OS X %s, hardware version %d",
+		img.ManifestURL, manifest.OSVersion, manifest.HardwareVersion)
+
+	img.URL = manifest.URL
+	img.Mirrors = manifest.Mirrors
+	img.Size = manifest.Size
+	img.Checksum = strings.ToLower(manifest.SHA256)
+	img.ChecksumType = "sha256"
+	img.manifest = data
+	img.signature = signature
+
+	return nil
+}
+
+// parseManifest decodes a manifest and makes sure it has everything needed
+// to download and verify the image.
+func parseManifest(data []byte) (*ImageManifest, error) {
+	var manifest ImageManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %s", err)
+	}
+
+	if manifest.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	if manifest.Size <= 0 {
+		return nil, fmt.Errorf("size is required")
+	}
+
+	if len(manifest.SHA256) != 64 || !isChecksum(manifest.SHA256) {
+		return nil, fmt.Errorf("sha256 must be a hex encoded SHA-256 checksum")
+	}
+
+	return &manifest, nil
+}
+
+// decodeSignature accepts signatures either raw or base64 encoded.
+func decodeSignature(data []byte) ([]byte, error) {
+	if len(data) == ed25519.SignatureSize {
+		return data, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("signature is not a raw or base64 encoded Ed25519 signature")
+	}
+	return signature, nil
+}
+
+// verifyManifestSignature tells whether the signature of the manifest was
+// made by any of the keys in config.ImageSigningKeys.
+func verifyManifestSignature(manifest, signature []byte) bool {
+	for _, key := range config.ImageSigningKeys {
+		if ed25519.Verify(key, manifest, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSmall gets a document of up to maxManifestSize bytes through HTTP or
+// from config.LocalImagesPath.
+func fetchSmall(URL string) ([]byte, error) {
+	if path, ok := localPath(URL); ok {
+		path, err := resolveLocalPath(path)
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		return readSmall(file)
+	}
+
+	resp, err := http.Get(URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode}
+	}
+
+	return readSmall(resp.Body)
+}
+
+// readSmall reads up to maxManifestSize bytes, failing if there are more.
+func readSmall(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxManifestSize {
+		return nil, fmt.Errorf("document is bigger than %d bytes", maxManifestSize)
+	}
+	return data, nil
+}
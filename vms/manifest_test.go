@@ -0,0 +1,183 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+)
+
+// serveManifest serves a manifest for the image at path, signed with key,
+// returning the manifest URL. Signatures alternate between raw and base64
+// encoded, since both are accepted.
+func (e *testEnv) serveManifest(t *testing.T, key ed25519.PrivateKey, name string, manifest ImageManifest) string {
+	data, err := json.Marshal(manifest)
+	ok(t, err)
+
+	signature := ed25519.Sign(key, data)
+	path := "/" + name + ".json"
+
+	e.mu.Lock()
+	e.served[path] = data
+	if len(e.served)%2 == 0 {
+		e.served[path+".sig"] = signature
+	} else {
+		e.served[path+".sig"] = []byte(base64.StdEncoding.EncodeToString(signature) + "\n")
+	}
+	e.mu.Unlock()
+
+	return e.images.URL + path
+}
+
+// imageManifest returns a valid manifest for an image served by the
+// environment.
+func (e *testEnv) imageManifest(t *testing.T, imagePath string) ImageManifest {
+	e.mu.Lock()
+	data := e.served[imagePath]
+	e.mu.Unlock()
+
+	return ImageManifest{
+		URL:             e.images.URL + imagePath,
+		Size:            int64(len(data)),
+		SHA256:          fmt.Sprintf("%x", sha256.Sum256(data)),
+		OSVersion:       "10.11.1",
+		HardwareVersion: 12,
+	}
+}
+
+func TestImageManifest(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	manifest := env.imageManifest(t, "/gold.tar.gz")
+	manifestURL := env.serveManifest(t, key, "gold", manifest)
+
+	// Without signing keys, manifests can't be trusted.
+	var appErr apperror.Error
+	status := env.do(t, "POST", "/images", Image{ManifestURL: manifestURL}, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrInvalidManifest.Code, appErr.Code)
+
+	config.ImageSigningKeys = []ed25519.PublicKey{pub}
+
+	// With signing keys, bare checksums are not trusted.
+	status = env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: env.image}}, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrUnsignedImage.Code, appErr.Code)
+
+	status = env.do(t, "POST", "/images", env.image, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrUnsignedImage.Code, appErr.Code)
+
+	forged := env.serveManifest(t, otherKey, "forged", manifest)
+	tampered := manifest
+	tampered.URL = env.images.URL + "/tampered.tar.gz"
+	tamperedURL := env.serveManifest(t, key, "tampered", manifest)
+	env.mu.Lock()
+	env.served["/tampered.json"], _ = json.Marshal(tampered)
+	env.mu.Unlock()
+
+	invalid := []Image{
+		{ManifestURL: forged},
+		{ManifestURL: tamperedURL},
+		{ManifestURL: env.images.URL + "/missing.json"},
+		{ManifestURL: manifestURL, Checksum: env.image.Checksum},
+	}
+	for _, image := range invalid {
+		status = env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: image}}, &appErr)
+		equals(t, http.StatusBadRequest, status)
+		equals(t, ErrInvalidManifest.Code, appErr.Code)
+	}
+
+	vm := env.createVM(t, VMConfig{OSImage: Image{ManifestURL: manifestURL}})
+	equals(t, manifest.SHA256, vm.OSImage.Checksum)
+	equals(t, "sha256", vm.OSImage.ChecksumType)
+	equals(t, manifest.URL, vm.OSImage.URL)
+	equals(t, manifestURL, vm.OSImage.ManifestURL)
+
+	var list ListImagesResult
+	status = env.do(t, "GET", "/images", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(list.Images))
+	equals(t, &manifest, list.Images[0].Manifest)
+
+	// Gold images not unpacked from a signed manifest are not trusted.
+	goldPath := filepath.Join(config.GoldImgsPath, manifest.SHA256)
+	image := Image{Checksum: manifest.SHA256}
+	ok(t, validateGoldImage(goldPath, image))
+
+	config.ImageSigningKeys = []ed25519.PublicKey{otherKey.Public().(ed25519.PublicKey)}
+	assert(t, validateGoldImage(goldPath, image) != nil, "gold image signed by an untrusted key should be invalid")
+}
+
+func TestUntrustedGoldImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+
+	manifest := env.imageManifest(t, "/gold.tar.gz")
+	manifestURL := env.serveManifest(t, key, "gold", manifest)
+
+	// Unpacked before signing keys were configured.
+	env.createVM(t, VMConfig{OSImage: Image{
+		URL:          manifest.URL,
+		Checksum:     manifest.SHA256,
+		ChecksumType: "sha256",
+	}})
+
+	config.ImageSigningKeys = []ed25519.PublicKey{pub}
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: Image{ManifestURL: manifestURL}}}, &created)
+	equals(t, http.StatusAccepted, status)
+
+	op := env.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusFailed, op.Status)
+	equals(t, ErrUntrustedGoldImage.Code, op.Error.Code)
+
+	goldPath := filepath.Join(config.GoldImgsPath, manifest.SHA256)
+	_, err = os.Stat(filepath.Join(goldPath, "osx.vmdk"))
+	ok(t, err)
+}
+
+func TestImageManifestSizeMismatch(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	ok(t, err)
+	config.ImageSigningKeys = []ed25519.PublicKey{pub}
+
+	manifest := env.imageManifest(t, "/gold.tar.gz")
+	manifest.Size++
+	manifestURL := env.serveManifest(t, key, "gold", manifest)
+
+	var op operations.Operation
+	status := env.do(t, "POST", "/images", Image{ManifestURL: manifestURL}, &op)
+	equals(t, http.StatusAccepted, status)
+
+	finished := env.waitOperation(t, op.ID)
+	equals(t, operations.StatusFailed, finished.Status)
+	equals(t, operations.PhaseDownloading, finished.Phase)
+}
@@ -5,6 +5,7 @@
 package vms
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -12,10 +13,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"runtime/debug"
+	"strings"
+	"time"
 
 	"github.com/c4milo/osx-builder/config"
-	"github.com/c4milo/osx-builder/pkg/unzipit"
+	"github.com/c4milo/osx-builder/operations"
 	"github.com/c4milo/osx-builder/pkg/vmware"
 )
 
@@ -35,25 +37,130 @@ type VMConfig struct {
 	Headless bool `json:"headless"`
 }
 
+// Power status of a virtual machine.
+const (
+	StatusRunning   = "running"
+	StatusStopped   = "stopped"
+	StatusSuspended = "suspended"
+	// The state could not be read from VMware, most likely due to a lock
+	StatusUnknown = "unknown"
+)
+
+// Limits enforced when reconfiguring virtual machines.
+const (
+	minMemory = 512
+	maxCPUs   = 32
+)
+
+// How long to wait for a newly created virtual machine to get an IP address,
+// and how often to ask VMware for it in the meantime.
+var (
+	ipWaitTimeout  = 2 * time.Minute
+	ipPollInterval = 2 * time.Second
+)
+
+// VMConfigPatch defines a partial VMConfig where only the properties set are
+// changed.
+type VMConfigPatch struct {
+	// Number of virtual cpus
+	CPUs *int `json:"cpus"`
+	// Memory size in megabytes.
+	Memory *int `json:"memory"`
+	// Network adapters
+	Network *vmware.NetworkType `json:"network_type"`
+	// Whether to launch the VM with graphical environment
+	Headless *bool `json:"headless"`
+}
+
+// ValidationError is returned when a virtual machine property has an invalid value.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+// Implements Error interface.
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Field, e.Message)
+}
+
+// Validate verifies that the properties set have valid values.
+func (p VMConfigPatch) Validate() error {
+	if p.CPUs != nil && (*p.CPUs < 1 || *p.CPUs > maxCPUs) {
+		return &ValidationError{"cpus", fmt.Sprintf("it must be between 1 and %d", maxCPUs)}
+	}
+
+	if p.Memory != nil && *p.Memory < minMemory {
+		return &ValidationError{"memory", fmt.Sprintf("it must be at least %d megabytes", minMemory)}
+	}
+
+	if p.Network != nil {
+		switch *p.Network {
+		case vmware.NetworkBridged, vmware.NetworkNAT, vmware.NetworkHostOnly:
+		default:
+			return &ValidationError{"network_type", "it must be one of bridged, nat or hostonly"}
+		}
+	}
+
+	return nil
+}
+
+// Apply sets the properties present in the patch onto the given configuration.
+func (p VMConfigPatch) Apply(c *VMConfig) {
+	if p.CPUs != nil {
+		c.CPUs = *p.CPUs
+	}
+
+	if p.Memory != nil {
+		c.Memory = *p.Memory
+	}
+
+	if p.Network != nil {
+		c.Network = *p.Network
+	}
+
+	if p.Headless != nil {
+		c.Headless = *p.Headless
+	}
+}
+
 // VM defines the properties of a virtual machine.
 type VM struct {
 	VMConfig
 	// Underlined VMWare virtual machine
 	vmwareVM vmware.VirtualMachine
+	// Hypervisor driver managing the virtual machine
+	driver vmware.Driver
 	// VM IP address as reported by VMWare
 	IPAddress string `json:"ip_address"`
 	// Power status
 	Status string `json:"status"`
 }
 
-// NewVM creates a new instance of VM.
-func NewVM(c VMConfig) *VM {
+// NewVM creates a new instance of VM, managed by the hypervisor driver set
+// in config.Driver.
+func NewVM(c VMConfig) (*VM, error) {
+	driver, err := vmware.Lookup(config.Driver)
+	if err != nil {
+		return nil, err
+	}
+
 	vmxfile := filepath.Join(config.VMSPath, c.ID, c.ID+".vmx")
+	vmwareVM, err := driver.NewVM(vmxfile)
+	if err != nil {
+		return nil, err
+	}
 
 	return &VM{
 		VMConfig: c,
-		vmwareVM: vmware.NewFusion7VM(vmxfile),
-	}
+		vmwareVM: vmwareVM,
+		driver:   driver,
+	}, nil
+}
+
+// Capabilities returns the features supported by the hypervisor driver
+// managing this virtual machine.
+func (v *VM) Capabilities() vmware.Capabilities {
+	return v.driver.Capabilities()
 }
 
 // setDefaults assigns defalt values for some VM properties.
@@ -62,66 +169,42 @@ func (v *VM) setDefaults() {
 		v.CPUs = 2
 	}
 
-	if v.Memory < 512 {
-		v.Memory = 512
-	}
-}
-
-// unpackGoldImage fetches and decompresses the Gold OS image.
-func (v *VM) unpackGoldImage() (string, error) {
-	image := v.OSImage
-	goldPath := filepath.Join(config.GoldImgsPath, image.Checksum)
-
-	_, err := os.Stat(goldPath)
-	finfo, _ := ioutil.ReadDir(goldPath)
-	goldPathEmpty := len(finfo) == 0
-
-	if os.IsNotExist(err) || goldPathEmpty {
-		log.Println("[DEBUG] Gold virtual machine does not exist or is empty")
-
-		imgPath := filepath.Join(config.ImagesPath, image.Checksum)
-		if err = image.Download(imgPath); err != nil {
-			return "", err
-		}
-		defer image.file.Close()
-
-		// Makes sure file cursor is in the right position.
-		_, err := image.file.Seek(0, 0)
-		if err != nil {
-			return "", err
-		}
-
-		log.Printf("[DEBUG] Unpacking gold virtual machine into %s\n", goldPath)
-		_, err = unzipit.Unpack(image.file, goldPath)
-		if err != nil {
-			debug.PrintStack()
-			log.Printf("[ERROR] Unpacking gold image %s\n", image.file.Name())
-			return "", err
-		}
+	if v.Memory < minMemory {
+		v.Memory = minMemory
 	}
-
-	return goldPath, nil
 }
 
-// Create creates and launches a virtual machine.
-func (v *VM) Create() error {
+// Create creates and launches a virtual machine, waiting for it to get an IP
+// address. Progress is reported to op, which may be nil.
+func (v *VM) Create(op *operations.Operation) error {
 	log.Printf("[DEBUG] Creating VM %s", v.ID)
 
-	goldPath, err := v.unpackGoldImage()
+	goldPath, err := prepareGoldImage(v.OSImage, op)
 	if err != nil {
 		return err
 	}
 
-	pattern := filepath.Join(goldPath, "**.vmx")
+	// Keeps the gold image from being removed until the VM is cloned.
+	// Pinned images are never discarded, even if invalid, so the image is
+	// only pinned once prepared and checked again in case it was removed
+	// in between.
+	pinImage(v.OSImage.Checksum)
+	defer unpinImage(v.OSImage.Checksum)
 
-	log.Printf("[DEBUG] Finding gold vmx file in %s", pattern)
-	files, _ := filepath.Glob(pattern)
+	if err := validateGoldImage(goldPath, v.OSImage); err != nil {
+		return err
+	}
 
-	if len(files) == 0 {
-		return fmt.Errorf("[ERROR] Gold vmx file was not found: %s", pattern)
+	// The gold image may have been prepared just as the operation got
+	// canceled.
+	if err := op.Context().Err(); err != nil {
+		return err
 	}
 
-	goldvmx := files[0]
+	goldvmx, err := goldVMXPath(goldPath)
+	if err != nil {
+		return err
+	}
 	log.Printf("[DEBUG] Gold vmx file found at %v", goldvmx)
 
 	vmexists, err := v.vmwareVM.Exists()
@@ -130,21 +213,58 @@ func (v *VM) Create() error {
 	}
 
 	if !vmexists {
-		err := v.vmwareVM.CloneFrom(goldvmx, vmware.CloneLinked)
+		op.SetPhase(operations.PhaseCloning)
+		ctype := vmware.CloneLinked
+		if !v.Capabilities().LinkedClones {
+			log.Printf("[INFO] Driver does not support linked clones, making a full clone instead")
+			ctype = vmware.CloneFull
+		}
+
+		err := v.vmwareVM.CloneFrom(goldvmx, ctype)
 		if err != nil {
 			return err
 		}
 	}
 
-	if err = v.Update(); err != nil {
+	if err = v.Update(op); err != nil {
 		return err
 	}
 
-	return nil
+	op.SetPhase(operations.PhaseWaitingForIP)
+	if err := v.waitForIP(op.Context()); err != nil {
+		return err
+	}
+
+	return v.Refresh()
+}
+
+// waitForIP polls VMware until the virtual machine reports an IP address or
+// ipWaitTimeout elapses. Not getting one is not an error, VMware Tools may
+// simply not be installed in the guest OS. It returns ctx.Err() if ctx is
+// done first.
+func (v *VM) waitForIP(ctx context.Context) error {
+	deadline := time.NewTimer(ipWaitTimeout)
+	defer deadline.Stop()
+
+	for {
+		v.IPAddress, _ = v.vmwareVM.IPAddress()
+		if v.IPAddress != "" {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			log.Printf("[WARN] VM %s did not get an IP address after %s", v.ID, ipWaitTimeout)
+			return nil
+		case <-time.After(ipPollInterval):
+		}
+	}
 }
 
-// Updates a virtual machine.
-func (v *VM) Update() error {
+// Updates a virtual machine. Progress is reported to op, which may be nil.
+func (v *VM) Update(op *operations.Operation) error {
 	v.setDefaults()
 
 	running, err := v.vmwareVM.IsRunning()
@@ -153,19 +273,39 @@ func (v *VM) Update() error {
 	}
 
 	if running {
+		op.SetPhase(operations.PhaseStopping)
 		log.Printf("[INFO] Virtual machine seems to be running, we need to " +
 			"power it off in order to make changes.")
-		err = v.vmwareVM.Stop()
+		err = v.vmwareVM.Stop(vmware.PowerSoft)
 		if err != nil {
 			return err
 		}
 	}
 
+	op.SetPhase(operations.PhaseConfiguring)
+	if err = v.configure(); err != nil {
+		return err
+	}
+
+	op.SetPhase(operations.PhaseBooting)
+	log.Println("[INFO] Powering virtual machine on...")
+	err = v.vmwareVM.Start(v.Headless)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// configure stores the virtual machine configuration in VMware. The virtual
+// machine must be powered off.
+func (v *VM) configure() error {
 	info := &vmware.VMInfo{
 		//hacky way of making sure it is a multiple of 4 megabytes
 		MemorySize: (v.Memory + 3) & ^0x03,
 		CPUs:       v.CPUs,
 		Name:       v.ID,
+		Headless:   v.Headless,
 	}
 
 	imageJSON, err := json.Marshal(v.OSImage)
@@ -180,35 +320,81 @@ func (v *VM) Update() error {
 	log.Printf("[DEBUG] Adding network adapter...")
 	info.NetworkType = v.Network
 
-	err = v.vmwareVM.SetInfo(info)
+	return v.vmwareVM.SetInfo(info)
+}
+
+// decodeImageAnnotation returns the image stored by configure in the VMX
+// annotation.
+func decodeImageAnnotation(annotation string) (Image, error) {
+	var image Image
+
+	imageJSON, err := base64.StdEncoding.DecodeString(annotation)
 	if err != nil {
-		return err
+		return image, err
 	}
 
-	log.Println("[INFO] Powering virtual machine on...")
-	err = v.vmwareVM.Start(v.Headless)
-	if err != nil {
+	err = json.Unmarshal(imageJSON, &image)
+	return image, err
+}
+
+// Reconfigure applies the current configuration to an existing virtual machine.
+// The VM status is expected to be up to date, as returned by FindVM. Running
+// virtual machines have to be powered off in order to make changes, so they
+// are only reconfigured if restart is true, in which case they are started
+// again afterwards. Stopped virtual machines are left stopped. Progress is
+// reported to op, which may be nil.
+func (v *VM) Reconfigure(restart bool, op *operations.Operation) error {
+	if err := v.CanReconfigure(restart); err != nil {
 		return err
 	}
 
-	return nil
+	if v.Status == StatusRunning {
+		if err := v.Update(op); err != nil {
+			return err
+		}
+	} else {
+		op.SetPhase(operations.PhaseConfiguring)
+		v.setDefaults()
+		if err := v.configure(); err != nil {
+			return err
+		}
+	}
+
+	return v.Refresh()
+}
+
+// CanReconfigure returns a TransitionError if the virtual machine cannot be
+// reconfigured in its current status.
+func (v *VM) CanReconfigure(restart bool) error {
+	if v.Status == StatusStopped || (v.Status == StatusRunning && restart) {
+		return nil
+	}
+
+	return &TransitionError{
+		Action: ActionReconfigure,
+		Status: v.Status,
+	}
 }
 
-// Destroy removes a virtual machine.
-func (v *VM) Destroy() error {
+// Destroy removes a virtual machine. Progress is reported to op, which may
+// be nil.
+func (v *VM) Destroy(op *operations.Operation) error {
 	running, err := v.vmwareVM.IsRunning()
 	if err != nil {
 		return err
 	}
 
 	if running {
+		op.SetPhase(operations.PhaseStopping)
 		log.Printf("[DEBUG] Stopping %s...", v.ID)
-		if err = v.vmwareVM.Stop(); err != nil {
+		if err = v.vmwareVM.Stop(vmware.PowerSoft); err != nil {
 			return err
 		}
 		log.Printf("[DEBUG] %s stopped", v.ID)
 	}
 
+	op.SetPhase(operations.PhaseDeleting)
+
 	// We are not handling errors here on purpose and due to vmrun limitations
 	v.vmwareVM.Delete()
 
@@ -221,9 +407,12 @@ func (v *VM) Destroy() error {
 
 // FindVM finds a virtual machine by ID.
 func FindVM(id string) (*VM, error) {
-	vm := NewVM(VMConfig{
+	vm, err := NewVM(VMConfig{
 		ID: id,
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	exists, err := vm.vmwareVM.Exists()
 	if err != nil {
@@ -242,6 +431,80 @@ func FindVM(id string) (*VM, error) {
 	return vm, nil
 }
 
+// VMFilter defines the criteria to select virtual machines with FindVMs.
+type VMFilter struct {
+	// Power status, i.e.: running or stopped. Empty matches any status.
+	Status string
+	// Checksum of the image the VM was created from. Empty matches any image.
+	ImageChecksum string
+	// Only virtual machines whose ID sorts after this one are considered.
+	AfterID string
+	// Maximum number of virtual machines to return. Zero means no limit.
+	Limit int
+}
+
+// FindVMs walks config.VMSPath and returns, sorted by ID, the virtual machines
+// matching the given filter along with their state refreshed. If more virtual
+// machines could have been returned but Limit was reached, the ID of the last
+// virtual machine returned is also returned so that it can be used as AfterID
+// for the next page.
+func FindVMs(f VMFilter) ([]*VM, string, error) {
+	entries, err := ioutil.ReadDir(config.VMSPath)
+	if os.IsNotExist(err) {
+		return []*VM{}, "", nil
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	// ioutil.ReadDir sorts entries by name already.
+	vms := []*VM{}
+	for _, entry := range entries {
+		id := entry.Name()
+		if !entry.IsDir() || id <= f.AfterID {
+			continue
+		}
+
+		vm, err := NewVM(VMConfig{
+			ID: id,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+
+		exists, err := vm.vmwareVM.Exists()
+		if err != nil || !exists {
+			continue
+		}
+
+		if err := vm.Refresh(); err != nil {
+			// VMware may be holding a lock on the VMX file, the VM is still
+			// reported so that callers know it exists.
+			log.Printf("[WARN] Unable to refresh VM %s: %s", id, err)
+			vm = &VM{
+				VMConfig: VMConfig{ID: id},
+				Status:   StatusUnknown,
+			}
+		}
+
+		if f.Status != "" && vm.Status != f.Status {
+			continue
+		}
+
+		if f.ImageChecksum != "" && !strings.EqualFold(vm.OSImage.Checksum, f.ImageChecksum) {
+			continue
+		}
+
+		if f.Limit > 0 && len(vms) == f.Limit {
+			return vms, vms[len(vms)-1].ID, nil
+		}
+		vms = append(vms, vm)
+	}
+
+	return vms, "", nil
+}
+
 // Refresh synchronizes VM state against VMware.
 func (v *VM) Refresh() error {
 	log.Printf("[DEBUG] Refreshing state with VMWare...")
@@ -256,31 +519,113 @@ func (v *VM) Refresh() error {
 
 	v.IPAddress, _ = v.vmwareVM.IPAddress()
 
-	imageJSONBase64 := info.Annotation
-	imageJSON, err := base64.StdEncoding.DecodeString(imageJSONBase64)
+	image, err := decodeImageAnnotation(info.Annotation)
 	if err != nil {
 		return err
 	}
+	v.OSImage = image
+	v.Network = info.NetworkType
+	v.Headless = info.Headless
 
-	var image Image
-	err = json.Unmarshal(imageJSON, &image)
+	running, err := v.vmwareVM.IsRunning()
 	if err != nil {
 		return err
 	}
-	v.OSImage = image
-	v.Network = info.NetworkType
 
-	running, err := v.vmwareVM.IsRunning()
+	suspended, err := v.vmwareVM.IsSuspended()
 	if err != nil {
 		return err
 	}
 
-	if running {
-		v.Status = "running"
-	} else {
-		v.Status = "stopped"
+	switch {
+	case running:
+		v.Status = StatusRunning
+	case suspended:
+		v.Status = StatusSuspended
+	default:
+		v.Status = StatusStopped
 	}
 
 	log.Printf("[DEBUG] Finished refreshing state from VMWare")
 	return nil
 }
+
+// Action represents a power operation on a virtual machine.
+type Action string
+
+const (
+	ActionStart   Action = "start"
+	ActionStop    Action = "stop"
+	ActionRestart Action = "restart"
+	ActionSuspend Action = "suspend"
+	ActionResume  Action = "resume"
+	// Only valid for running VMs if they can be restarted
+	ActionReconfigure Action = "reconfigure"
+)
+
+// actionStatus defines the power status a virtual machine has to be in for
+// each action to be valid.
+var actionStatus = map[Action]string{
+	ActionStart:   StatusStopped,
+	ActionStop:    StatusRunning,
+	ActionRestart: StatusRunning,
+	ActionSuspend: StatusRunning,
+	ActionResume:  StatusSuspended,
+}
+
+// TransitionError is returned when an action is not valid for the current
+// power status of a virtual machine.
+type TransitionError struct {
+	Action Action
+	Status string
+}
+
+// Implements Error interface.
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("Unable to %s a virtual machine whose status is %s", e.Action, e.Status)
+}
+
+// RunAction carries out a power action on the virtual machine. The VM status
+// is expected to be up to date, as returned by FindVM. If hard is true, the
+// virtual machine is stopped or restarted right away instead of asking the
+// guest OS to do it.
+func (v *VM) RunAction(action Action, hard bool) error {
+	required, ok := actionStatus[action]
+	if !ok {
+		return fmt.Errorf("Unknown action: %s", action)
+	}
+
+	if v.Status != required {
+		return &TransitionError{
+			Action: action,
+			Status: v.Status,
+		}
+	}
+
+	mode := vmware.PowerSoft
+	if hard {
+		mode = vmware.PowerHard
+	}
+
+	log.Printf("[INFO] Running %s action on %s...", action, v.ID)
+
+	var err error
+	switch action {
+	case ActionStart:
+		err = v.vmwareVM.Start(v.Headless)
+	case ActionStop:
+		err = v.vmwareVM.Stop(mode)
+	case ActionRestart:
+		err = v.vmwareVM.Reset(mode)
+	case ActionSuspend:
+		err = v.vmwareVM.Suspend()
+	case ActionResume:
+		err = v.vmwareVM.Resume(v.Headless)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return v.Refresh()
+}
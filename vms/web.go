@@ -7,23 +7,104 @@ package vms
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"path"
+	"strconv"
+	"strings"
 
 	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
 	"github.com/c4milo/osx-builder/pkg/render"
 )
 
 // Handlers is a map to functions where each function is in charge of handling
 // a HTTP verb or method.
 var Handlers map[string]func(http.ResponseWriter, *http.Request) = map[string]func(http.ResponseWriter, *http.Request){
-	"POST":   CreateVM,
-	"GET":    GetVM,
-	"DELETE": DestroyVM,
+	"POST":   routePOST,
+	"GET":    routeGET,
+	"PATCH":  routePATCH,
+	"DELETE": routeDELETE,
+}
+
+// parseVMPath splits a /vms/:id/:subresource path into the virtual machine ID
+// and the subresource name. Both are empty if the path refers to the
+// collection itself.
+func parseVMPath(urlPath string) (id, subresource string) {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(urlPath, "/vms"), "/"), "/", 2)
+	id = parts[0]
+	if len(parts) > 1 {
+		subresource = parts[1]
+	}
+	return id, subresource
+}
+
+// vmID returns the virtual machine ID from a /vms/:id path, or an empty string
+// if the path refers to the collection itself.
+func vmID(urlPath string) string {
+	id, _ := parseVMPath(urlPath)
+	return id
+}
+
+// notFound replies with a 404 for paths not served by this package.
+func notFound(w http.ResponseWriter, req *http.Request) {
+	log.Printf(`[ERROR] msg="%s" code=%s path=%s\n`,
+		ErrNotFound.Message, ErrNotFound.Code, req.URL.Path)
+
+	render.JSON(w, render.Options{
+		Status: ErrNotFound.HTTPStatus,
+		Data:   ErrNotFound,
+	})
+}
+
+// routeGET dispatches GET requests either to ListVMs or GetVM.
+func routeGET(w http.ResponseWriter, req *http.Request) {
+	id, subresource := parseVMPath(req.URL.Path)
+	switch {
+	case id == "":
+		ListVMs(w, req)
+	case subresource == "":
+		GetVM(w, req)
+	default:
+		notFound(w, req)
+	}
+}
+
+// routePOST dispatches POST requests either to CreateVM or RunVMAction.
+func routePOST(w http.ResponseWriter, req *http.Request) {
+	id, subresource := parseVMPath(req.URL.Path)
+	switch {
+	case id == "":
+		CreateVM(w, req)
+	case subresource == "actions":
+		RunVMAction(w, req)
+	default:
+		notFound(w, req)
+	}
+}
+
+// routeDELETE dispatches DELETE requests to DestroyVM.
+func routeDELETE(w http.ResponseWriter, req *http.Request) {
+	id, subresource := parseVMPath(req.URL.Path)
+	if id == "" || subresource != "" {
+		notFound(w, req)
+		return
+	}
+	DestroyVM(w, req)
+}
+
+// routePATCH dispatches PATCH requests to ReconfigureVM.
+func routePATCH(w http.ResponseWriter, req *http.Request) {
+	id, subresource := parseVMPath(req.URL.Path)
+	if id == "" || subresource != "" {
+		notFound(w, req)
+		return
+	}
+	ReconfigureVM(w, req)
 }
 
 // CreateVMParams defines parameters supported by the CreateVM service.
@@ -60,6 +141,76 @@ func sendResult(url string, value interface{}) {
 	}
 }
 
+// CreateVMResult is the response of the CreateVM service.
+type CreateVMResult struct {
+	*VM
+	// Operation tracking the creation of the virtual machine
+	OperationID string `json:"operation_id"`
+}
+
+// newOperation starts tracking an operation, replying with an internal error
+// if it could not be stored.
+func newOperation(w http.ResponseWriter, t operations.Type, id string) *operations.Operation {
+	op, err := operations.New(t, id)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return nil
+	}
+
+	w.Header().Set("Location", "/operations/"+op.ID)
+	return op
+}
+
+// applyImageManifest applies the signed manifest of the image, if any, and
+// makes sure images without one are allowed, replying with an error and
+// returning false otherwise.
+func applyImageManifest(w http.ResponseWriter, image *Image) bool {
+	if image.ManifestURL == "" && len(config.ImageSigningKeys) > 0 {
+		log.Printf(`[ERROR] msg="%s" code=%s image=%+v\n`,
+			ErrUnsignedImage.Message, ErrUnsignedImage.Code, image)
+
+		render.JSON(w, render.Options{
+			Status: ErrUnsignedImage.HTTPStatus,
+			Data:   ErrUnsignedImage,
+		})
+		return false
+	}
+
+	if err := image.ApplyManifest(); err != nil {
+		appErr := ErrInvalidManifest
+		if merr, ok := err.(*ManifestError); ok {
+			appErr.Message = merr.Error()
+		}
+
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s"\n`, appErr.Message, appErr.Code, err)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return false
+	}
+
+	return true
+}
+
+// checkCapabilities makes sure the hypervisor driver supports what is being
+// requested, so that unsupported requests are refused up front instead of
+// failing halfway through the creation of a virtual machine.
+func checkCapabilities(vm *VM) *apperror.Error {
+	caps := vm.Capabilities()
+	if vm.Headless && !caps.Headless {
+		return &ErrHeadlessUnsupported
+	}
+	return nil
+}
+
 // CreateVM creates a virtual machine using the given parameters.
 func CreateVM(w http.ResponseWriter, req *http.Request) {
 	var params CreateVMParams
@@ -88,6 +239,22 @@ func CreateVM(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !applyImageManifest(w, &params.VMConfig.OSImage) {
+		return
+	}
+	normalizeImage(&params.VMConfig.OSImage)
+
+	if !validImage(params.VMConfig.OSImage) {
+		log.Printf(`[ERROR] msg="%s" code=%s image=%+v\n`,
+			ErrInvalidImage.Message, ErrInvalidImage.Code, params.VMConfig.OSImage)
+
+		render.JSON(w, render.Options{
+			Status: ErrInvalidImage.HTTPStatus,
+			Data:   ErrInvalidImage,
+		})
+		return
+	}
+
 	b := make([]byte, 10)
 	_, err = rand.Read(b)
 	if err != nil {
@@ -104,30 +271,58 @@ func CreateVM(w http.ResponseWriter, req *http.Request) {
 	id := fmt.Sprintf("%x", b)
 	params.VMConfig.ID = id
 
-	vm := NewVM(params.VMConfig)
+	vm, err := NewVM(params.VMConfig)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return
+	}
+
+	if appErr := checkCapabilities(vm); appErr != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s driver=%s\n`,
+			appErr.Message, appErr.Code, config.Driver)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	op := newOperation(w, operations.TypeCreateVM, id)
+	if op == nil {
+		return
+	}
+
+	// The response is rendered before VM creation starts, so that it does
+	// not race with the creation process updating the VM.
+	render.JSON(w, render.Options{
+		Status: http.StatusAccepted,
+		Data:   CreateVMResult{VM: vm, OperationID: op.ID},
+	})
 
 	go func() {
-		err := vm.Create()
+		err := vm.Create(op)
 		if err != nil {
+			appErr := prepareError(err, ErrCreatingVM)
 			log.Printf(`[ERROR] msg="%s" value=%+v code=%s error="%s" stacktrace=%s\n`,
-				ErrCreatingVM.Message, vm, ErrCreatingVM.Code, err.Error(), apperror.GetStacktrace())
+				appErr.Message, vm, appErr.Code, err.Error(), apperror.GetStacktrace())
 
-			sendResult(params.CallbackURL, ErrCreatingVM)
+			op.Finish(appErr)
+			sendResult(params.CallbackURL, appErr)
 			return
 		}
 
-		// One last effort to get an IP...
-		if vm.IPAddress == "" {
-			vm.Refresh()
-		}
-
+		imageCollections.Add(1)
+		op.Finish(nil)
 		sendResult(params.CallbackURL, vm)
+		go collectImagesInBackground()
 	}()
-
-	render.JSON(w, render.Options{
-		Status: http.StatusAccepted,
-		Data:   vm,
-	})
 }
 
 // DestroyVMParams defines parameters supported by the DestroyVM service.
@@ -136,10 +331,70 @@ type DestroyVMParams struct {
 	ID string
 }
 
-// DestroyVM removes virtual machines by its ID.
+// DestroyVM removes virtual machines by its ID. Removal happens in the
+// background and is tracked by the operation returned.
 func DestroyVM(w http.ResponseWriter, req *http.Request) {
 	params := DestroyVMParams{
-		ID: path.Base(req.URL.Path),
+		ID: vmID(req.URL.Path),
+	}
+
+	vm, err := FindVM(params.ID)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrOpeningVM.Message, ErrOpeningVM.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrOpeningVM.HTTPStatus,
+			Data:   ErrOpeningVM,
+		})
+		return
+	}
+
+	if vm == nil {
+		log.Printf(`[ERROR] msg="%s" code=%s\n`,
+			ErrVMNotFound.Message, ErrOpeningVM.Code)
+
+		render.JSON(w, render.Options{
+			Status: ErrVMNotFound.HTTPStatus,
+			Data:   ErrVMNotFound,
+		})
+		return
+	}
+
+	op := newOperation(w, operations.TypeDestroyVM, vm.ID)
+	if op == nil {
+		return
+	}
+
+	go func() {
+		if err := vm.Destroy(op); err != nil {
+			log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+				ErrDestroyingVM.Message, ErrDestroyingVM.Code, err.Error(), apperror.GetStacktrace())
+
+			op.Finish(&ErrDestroyingVM)
+			return
+		}
+
+		imageCollections.Add(1)
+		op.Finish(nil)
+		go collectImagesInBackground()
+	}()
+
+	render.JSON(w, render.Options{
+		Status: http.StatusAccepted,
+		Data:   op.Snapshot(),
+	})
+}
+
+// GetVMParams defines parameters supported by the GetVM service.
+type GetVMParams struct {
+	ID string
+}
+
+// GetVM returns information of a virtual machine given its ID.
+func GetVM(w http.ResponseWriter, req *http.Request) {
+	params := GetVMParams{
+		ID: vmID(req.URL.Path),
 	}
 
 	vm, err := FindVM(params.ID)
@@ -165,7 +420,81 @@ func DestroyVM(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = vm.Destroy()
+	render.JSON(w, render.Options{
+		Status: http.StatusOK,
+		Data:   vm,
+	})
+}
+
+// Default and maximum number of virtual machines returned by ListVMs.
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// ListVMsParams defines parameters supported by the ListVMs service.
+type ListVMsParams struct {
+	// Only returns virtual machines with this power status
+	Status string
+	// Only returns virtual machines created from the image with this checksum
+	ImageChecksum string
+	// Opaque cursor returned by a previous call, to get the next page
+	Cursor string
+	// Maximum number of virtual machines to return
+	Limit int
+}
+
+// ListVMsResult is the response of the ListVMs service.
+type ListVMsResult struct {
+	VMs []*VM `json:"vms"`
+	// Cursor to get the next page. It is empty when there are no more pages.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// ListVMs returns the virtual machines found, optionally filtered by status
+// and image checksum. Results are paginated using cursors.
+func ListVMs(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	params := ListVMsParams{
+		Status:        query.Get("status"),
+		ImageChecksum: query.Get("image_checksum"),
+		Cursor:        query.Get("cursor"),
+		Limit:         defaultListLimit,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		params.Limit, err = strconv.Atoi(limit)
+		if err != nil || params.Limit <= 0 || params.Limit > maxListLimit {
+			log.Printf(`[ERROR] msg="%s" code=%s limit=%s\n`,
+				ErrInvalidListLimit.Message, ErrInvalidListLimit.Code, limit)
+
+			render.JSON(w, render.Options{
+				Status: ErrInvalidListLimit.HTTPStatus,
+				Data:   ErrInvalidListLimit,
+			})
+			return
+		}
+	}
+
+	afterID, err := base64.RawURLEncoding.DecodeString(params.Cursor)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s"\n`,
+			ErrInvalidCursor.Message, ErrInvalidCursor.Code, err.Error())
+
+		render.JSON(w, render.Options{
+			Status: ErrInvalidCursor.HTTPStatus,
+			Data:   ErrInvalidCursor,
+		})
+		return
+	}
+
+	vms, lastID, err := FindVMs(VMFilter{
+		Status:        params.Status,
+		ImageChecksum: params.ImageChecksum,
+		AfterID:       string(afterID),
+		Limit:         params.Limit,
+	})
 	if err != nil {
 		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
 			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
@@ -177,20 +506,68 @@ func DestroyVM(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	result := ListVMsResult{
+		VMs: vms,
+	}
+
+	if lastID != "" {
+		result.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(lastID))
+	}
+
 	render.JSON(w, render.Options{
-		Status: http.StatusNoContent,
+		Status: http.StatusOK,
+		Data:   result,
 	})
 }
 
-// GetVMParams defines parameters supported by the GetVM service.
-type GetVMParams struct {
-	ID string
+// RunVMActionParams defines parameters supported by the RunVMAction service.
+type RunVMActionParams struct {
+	// Virtual machine ID
+	ID string `json:"-"`
+	// Power action to carry out: start, stop, restart, suspend or resume
+	Action Action `json:"action"`
+	// Whether to stop or restart the VM right away instead of asking the guest
+	// OS to do it
+	Hard bool `json:"hard"`
 }
 
-// GetVM returns information of a virtual machine given its ID.
-func GetVM(w http.ResponseWriter, req *http.Request) {
-	params := GetVMParams{
-		ID: path.Base(req.URL.Path),
+// RunVMAction changes the power status of a virtual machine.
+func RunVMAction(w http.ResponseWriter, req *http.Request) {
+	var params RunVMActionParams
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrReadingReqBody.Message, ErrReadingReqBody.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrReadingReqBody.HTTPStatus,
+			Data:   ErrReadingReqBody,
+		})
+		return
+	}
+
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrParsingJSON.Message, ErrParsingJSON.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrParsingJSON.HTTPStatus,
+			Data:   ErrParsingJSON,
+		})
+		return
+	}
+	params.ID = vmID(req.URL.Path)
+
+	if _, ok := actionStatus[params.Action]; !ok {
+		log.Printf(`[ERROR] msg="%s" code=%s action=%s\n`,
+			ErrInvalidAction.Message, ErrInvalidAction.Code, params.Action)
+
+		render.JSON(w, render.Options{
+			Status: ErrInvalidAction.HTTPStatus,
+			Data:   ErrInvalidAction,
+		})
+		return
 	}
 
 	vm, err := FindVM(params.ID)
@@ -207,7 +584,7 @@ func GetVM(w http.ResponseWriter, req *http.Request) {
 
 	if vm == nil {
 		log.Printf(`[ERROR] msg="%s" code=%s\n`,
-			ErrVMNotFound.Message, ErrOpeningVM.Code)
+			ErrVMNotFound.Message, ErrVMNotFound.Code)
 
 		render.JSON(w, render.Options{
 			Status: ErrVMNotFound.HTTPStatus,
@@ -216,8 +593,160 @@ func GetVM(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	err = vm.RunAction(params.Action, params.Hard)
+	if terr, ok := err.(*TransitionError); ok {
+		appErr := ErrInvalidTransition
+		appErr.Message = terr.Error()
+
+		log.Printf(`[ERROR] msg="%s" code=%s\n`, appErr.Message, appErr.Code)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrInternal.Message, ErrInternal.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrInternal.HTTPStatus,
+			Data:   ErrInternal,
+		})
+		return
+	}
+
 	render.JSON(w, render.Options{
 		Status: http.StatusOK,
 		Data:   vm,
 	})
 }
+
+// ReconfigureVMParams defines parameters supported by the ReconfigureVM service.
+type ReconfigureVMParams struct {
+	VMConfigPatch
+	// Virtual machine ID
+	ID string `json:"-"`
+	// Whether to restart the VM if it is running. Otherwise, running VMs are
+	// not reconfigured.
+	Restart bool `json:"restart"`
+}
+
+// ReconfigureVM changes the configuration of an existing virtual machine.
+// Changes are applied in the background and tracked by the operation returned.
+func ReconfigureVM(w http.ResponseWriter, req *http.Request) {
+	var params ReconfigureVMParams
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrReadingReqBody.Message, ErrReadingReqBody.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrReadingReqBody.HTTPStatus,
+			Data:   ErrReadingReqBody,
+		})
+		return
+	}
+
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrParsingJSON.Message, ErrParsingJSON.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrParsingJSON.HTTPStatus,
+			Data:   ErrParsingJSON,
+		})
+		return
+	}
+	params.ID = vmID(req.URL.Path)
+
+	if err := params.Validate(); err != nil {
+		appErr := ErrInvalidConfig
+		appErr.Message = err.Error()
+
+		log.Printf(`[ERROR] msg="%s" code=%s\n`, appErr.Message, appErr.Code)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	vm, err := FindVM(params.ID)
+	if err != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+			ErrOpeningVM.Message, ErrOpeningVM.Code, err.Error(), apperror.GetStacktrace())
+
+		render.JSON(w, render.Options{
+			Status: ErrOpeningVM.HTTPStatus,
+			Data:   ErrOpeningVM,
+		})
+		return
+	}
+
+	if vm == nil {
+		log.Printf(`[ERROR] msg="%s" code=%s\n`,
+			ErrVMNotFound.Message, ErrVMNotFound.Code)
+
+		render.JSON(w, render.Options{
+			Status: ErrVMNotFound.HTTPStatus,
+			Data:   ErrVMNotFound,
+		})
+		return
+	}
+
+	params.Apply(&vm.VMConfig)
+
+	if appErr := checkCapabilities(vm); appErr != nil {
+		log.Printf(`[ERROR] msg="%s" code=%s driver=%s\n`,
+			appErr.Message, appErr.Code, config.Driver)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	err = vm.CanReconfigure(params.Restart)
+	if terr, ok := err.(*TransitionError); ok {
+		appErr := ErrInvalidTransition
+		appErr.Message = terr.Error()
+		if terr.Status == StatusRunning {
+			appErr.Message += ". Set restart to true in order to power it off while making changes."
+		}
+
+		log.Printf(`[ERROR] msg="%s" code=%s\n`, appErr.Message, appErr.Code)
+
+		render.JSON(w, render.Options{
+			Status: appErr.HTTPStatus,
+			Data:   appErr,
+		})
+		return
+	}
+
+	op := newOperation(w, operations.TypeReconfigureVM, vm.ID)
+	if op == nil {
+		return
+	}
+
+	go func() {
+		if err := vm.Reconfigure(params.Restart, op); err != nil {
+			log.Printf(`[ERROR] msg="%s" code=%s error="%s" stacktrace=%s\n`,
+				ErrReconfiguringVM.Message, ErrReconfiguringVM.Code, err.Error(), apperror.GetStacktrace())
+
+			op.Finish(&ErrReconfiguringVM)
+			return
+		}
+		op.Finish(nil)
+	}()
+
+	render.JSON(w, render.Options{
+		Status: http.StatusAccepted,
+		Data:   op.Snapshot(),
+	})
+}
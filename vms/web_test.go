@@ -0,0 +1,962 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, version 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package vms
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c4milo/osx-builder/apperror"
+	"github.com/c4milo/osx-builder/config"
+	"github.com/c4milo/osx-builder/operations"
+	"github.com/c4milo/osx-builder/pkg/lockfile"
+	"github.com/c4milo/osx-builder/pkg/unzipit"
+	"github.com/c4milo/osx-builder/pkg/vmware"
+)
+
+// testEnv is a hermetic environment where the API runs against a fake VMware
+// host and downloads its gold image from a local HTTP server.
+type testEnv struct {
+	dir    string
+	host   *vmware.FakeHost
+	api    *httptest.Server
+	images *httptest.Server
+	image  Image
+	// Number of times the image was downloaded
+	downloads int32
+
+	mu     sync.Mutex
+	served map[string][]byte
+	// Downloads waiting for the channel to be closed, by path
+	held map[string]chan struct{}
+}
+
+// newTestEnv sets up a new testEnv. Close must be called when done with it.
+func newTestEnv(t *testing.T) *testEnv {
+	dir, err := ioutil.TempDir(os.TempDir(), "osx-builder-vms")
+	ok(t, err)
+
+	config.VMSPath = filepath.Join(dir, "vms")
+	config.GoldImgsPath = filepath.Join(dir, "gold")
+	config.ImagesPath = filepath.Join(dir, "images")
+	config.LocalImagesPath = filepath.Join(dir, "local")
+	config.OperationsPath = filepath.Join(dir, "operations")
+	config.ImagesQuota = 0
+	config.ImageSigningKeys = nil
+	config.StreamUnpack = false
+	config.UnpackMaxBytes = unzipit.DefaultLimits.MaxBytes
+	config.UnpackMaxEntries = unzipit.DefaultLimits.MaxEntries
+	config.UnpackMaxRatio = unzipit.DefaultLimits.MaxRatio
+	ok(t, operations.Open(config.OperationsPath))
+
+	env := &testEnv{
+		dir:    dir,
+		host:   vmware.NewFakeHost(filepath.Join(dir, "vmware")),
+		served: make(map[string][]byte),
+		held:   make(map[string]chan struct{}),
+	}
+
+	// Every environment gets its own fake host registered as driver.
+	config.Driver = "fake-" + filepath.Base(dir)
+	vmware.Register(config.Driver, env.host)
+
+	env.images = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.mu.Lock()
+		data, found := env.served[r.URL.Path]
+		gate := env.held[r.URL.Path]
+		env.mu.Unlock()
+
+		if gate != nil {
+			<-gate
+		}
+
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		atomic.AddInt32(&env.downloads, 1)
+		w.Header().Set("Content-Type", "application/x-gzip")
+		w.Write(data)
+	}))
+
+	env.image = env.serveImage(t, "gold", "fake disk")
+
+	env.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handlers := Handlers
+		switch {
+		case strings.HasPrefix(req.URL.Path, "/operations"):
+			handlers = operations.Handlers
+		case strings.HasPrefix(req.URL.Path, "/images"):
+			handlers = ImageHandlers
+		}
+
+		if handlerFn, ok := handlers[req.Method]; ok {
+			handlerFn(w, req)
+			return
+		}
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+
+	return env
+}
+
+// Close shuts down the test servers and removes all the files created.
+func (e *testEnv) Close() {
+	imageCollections.Wait()
+	e.api.Close()
+	e.images.Close()
+	os.RemoveAll(e.dir)
+}
+
+// serveImage serves a gold image, with the given disk contents, from the
+// images server.
+func (e *testEnv) serveImage(t *testing.T, name, disk string) Image {
+	data := newGoldImage(t, disk)
+	path := "/" + name + ".tar.gz"
+
+	e.mu.Lock()
+	e.served[path] = data
+	e.mu.Unlock()
+
+	return Image{
+		URL:          e.images.URL + path,
+		Checksum:     fmt.Sprintf("%x", sha1.Sum(data)),
+		ChecksumType: "sha1",
+	}
+}
+
+// holdDownloads keeps downloads of the given image waiting until the
+// returned function is called, which must be before calling Close.
+func (e *testEnv) holdDownloads(image Image) func() {
+	path := strings.TrimPrefix(image.URL, e.images.URL)
+	gate := make(chan struct{})
+
+	e.mu.Lock()
+	e.held[path] = gate
+	e.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(gate) })
+	}
+}
+
+// newGoldImage returns a gzipped tarball with a minimal VMware virtual machine.
+func newGoldImage(t *testing.T, disk string) []byte {
+	var files = []struct {
+		Name, Body string
+	}{
+		{"osx.vmx", "displayName = \"osx\"\nnumvcpus = \"1\"\nmemsize = \"512\"\nguestOS = \"darwin14-64\"\n"},
+		{"osx.vmdk", disk},
+	}
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name: file.Name,
+			Mode: 0644,
+			Size: int64(len(file.Body)),
+		})
+		ok(t, err)
+
+		_, err = tw.Write([]byte(file.Body))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+	ok(t, gw.Close())
+
+	return buf.Bytes()
+}
+
+// do sends a request to the API and decodes the JSON response into value, if
+// value is not nil.
+func (e *testEnv) do(t *testing.T, method, path string, body interface{}, value interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		ok(t, err)
+	}
+
+	req, err := http.NewRequest(method, e.api.URL+path, bytes.NewReader(data))
+	ok(t, err)
+
+	res, err := http.DefaultClient.Do(req)
+	ok(t, err)
+	defer res.Body.Close()
+
+	if value != nil {
+		ok(t, json.NewDecoder(res.Body).Decode(value))
+	}
+
+	return res.StatusCode
+}
+
+// waitOperation polls the API until the given operation finishes.
+func (e *testEnv) waitOperation(t *testing.T, id string) *operations.Operation {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var op operations.Operation
+		status := e.do(t, "GET", "/operations/"+id, nil, &op)
+		equals(t, http.StatusOK, status)
+
+		if op.Status != operations.StatusRunning {
+			// Images are collected once operations finish.
+			imageCollections.Wait()
+			return &op
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Operation %s did not finish, last phase: %s", id, op.Phase)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// callbackRecorder is a callback URL server keeping what it receives.
+func callbackRecorder() (*httptest.Server, chan []byte) {
+	results := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		results <- data
+	}))
+	return server, results
+}
+
+// createVM creates a virtual machine through the API and waits until the
+// creation process finishes.
+func (e *testEnv) createVM(t *testing.T, c VMConfig) *VM {
+	callback, results := callbackRecorder()
+	defer callback.Close()
+
+	params := CreateVMParams{
+		VMConfig:    c,
+		CallbackURL: callback.URL,
+	}
+
+	var created CreateVMResult
+	status := e.do(t, "POST", "/vms", params, &created)
+	equals(t, http.StatusAccepted, status)
+
+	var vm VM
+	select {
+	case data := <-results:
+		ok(t, json.Unmarshal(data, &vm))
+	case <-time.After(10 * time.Second):
+		t.Fatal("Callback URL was never called")
+	}
+	equals(t, created.ID, vm.ID)
+
+	op := e.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusSucceeded, op.Status)
+
+	return &vm
+}
+
+func TestVMLifecycle(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	callback, results := callbackRecorder()
+	defer callback.Close()
+
+	env.host.SetLatency("start", 50*time.Millisecond)
+
+	params := CreateVMParams{
+		VMConfig: VMConfig{
+			OSImage: env.image,
+			CPUs:    2,
+			Memory:  1024,
+			Network: vmware.NetworkNAT,
+		},
+		CallbackURL: callback.URL,
+	}
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", params, &created)
+	equals(t, http.StatusAccepted, status)
+	assert(t, created.ID != "", "VM ID should not be empty")
+	assert(t, created.OperationID != "", "Operation ID should not be empty")
+
+	var result VM
+	select {
+	case data := <-results:
+		ok(t, json.Unmarshal(data, &result))
+	case <-time.After(10 * time.Second):
+		t.Fatal("Callback URL was never called")
+	}
+	equals(t, created.ID, result.ID)
+	equals(t, "running", result.Status)
+
+	op := env.waitOperation(t, created.OperationID)
+	equals(t, operations.TypeCreateVM, op.Type)
+	equals(t, created.ID, op.ResourceID)
+	equals(t, operations.StatusSucceeded, op.Status)
+	equals(t, operations.PhaseDone, op.Phase)
+	equals(t, 100, op.Progress)
+	assert(t, op.Error == nil, "unexpected operation error: %+v", op.Error)
+	assert(t, op.FinishedAt != nil && !op.FinishedAt.Before(op.CreatedAt), "unexpected finish time %v", op.FinishedAt)
+
+	var vm VM
+	status = env.do(t, "GET", "/vms/"+created.ID, nil, &vm)
+	equals(t, http.StatusOK, status)
+	equals(t, "running", vm.Status)
+	equals(t, 2, vm.CPUs)
+	equals(t, 1024, vm.Memory)
+	equals(t, vmware.NetworkNAT, vm.Network)
+	equals(t, env.image.Checksum, vm.OSImage.Checksum)
+	assert(t, strings.HasPrefix(vm.IPAddress, "192.168."), "unexpected IP address %q", vm.IPAddress)
+
+	var destroy operations.Operation
+	status = env.do(t, "DELETE", "/vms/"+created.ID, nil, &destroy)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.TypeDestroyVM, destroy.Type)
+	equals(t, operations.StatusSucceeded, env.waitOperation(t, destroy.ID).Status)
+
+	status = env.do(t, "GET", "/vms/"+created.ID, nil, nil)
+	equals(t, http.StatusNotFound, status)
+
+	running, err := env.host.Running()
+	ok(t, err)
+	equals(t, 0, len(running))
+}
+
+func TestCreateVMUpperCaseChecksum(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	image := env.image
+	image.Checksum = strings.ToUpper(image.Checksum)
+
+	vm := env.createVM(t, VMConfig{OSImage: image})
+	equals(t, env.image.Checksum, vm.OSImage.Checksum)
+	ok(t, validateGoldImage(filepath.Join(config.GoldImgsPath, env.image.Checksum), env.image))
+
+	// It is the same image as the lower case one.
+	env.createVM(t, VMConfig{OSImage: env.image})
+	equals(t, int32(1), atomic.LoadInt32(&env.downloads))
+
+	var list ListVMsResult
+	status := env.do(t, "GET", "/vms?image_checksum="+image.Checksum, nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 2, len(list.VMs))
+
+	var appErr apperror.Error
+	status = env.do(t, "DELETE", "/images/"+image.Checksum, nil, &appErr)
+	equals(t, http.StatusConflict, status)
+	equals(t, ErrImageInUse.Code, appErr.Code)
+}
+
+func TestCreateVMLocalImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	data := newGoldImage(t, "local disk")
+	path := filepath.Join(env.dir, "local", "gold.tar.gz")
+	ok(t, os.MkdirAll(filepath.Dir(path), 0740))
+	ok(t, ioutil.WriteFile(path, data, 0640))
+
+	image := Image{
+		URL:          "file://" + path,
+		Checksum:     fmt.Sprintf("%x", sha1.Sum(data)),
+		ChecksumType: "sha1",
+		LocalMode:    LocalModeLink,
+	}
+
+	vm := env.createVM(t, VMConfig{OSImage: image})
+	equals(t, StatusRunning, vm.Status)
+	equals(t, int32(0), atomic.LoadInt32(&env.downloads))
+
+	_, err := os.Stat(filepath.Join(config.ImagesPath, image.Checksum, image.cacheName()))
+	ok(t, err)
+}
+
+func TestCreateVMFailure(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	callback, results := callbackRecorder()
+	defer callback.Close()
+
+	env.host.SetFailure("clone", errors.New("no space left on device"))
+
+	params := CreateVMParams{
+		VMConfig: VMConfig{
+			OSImage: env.image,
+		},
+		CallbackURL: callback.URL,
+	}
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", params, &created)
+	equals(t, http.StatusAccepted, status)
+
+	var appErr apperror.Error
+	select {
+	case data := <-results:
+		ok(t, json.Unmarshal(data, &appErr))
+	case <-time.After(10 * time.Second):
+		t.Fatal("Callback URL was never called")
+	}
+	equals(t, ErrCreatingVM.Code, appErr.Code)
+
+	op := env.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusFailed, op.Status)
+	equals(t, operations.PhaseCloning, op.Phase)
+	assert(t, op.Error != nil, "operation error was expected")
+	equals(t, ErrCreatingVM.Code, op.Error.Code)
+
+	status = env.do(t, "GET", "/operations/non-existent", nil, &appErr)
+	equals(t, http.StatusNotFound, status)
+	equals(t, operations.ErrOperationNotFound.Code, appErr.Code)
+
+	status = env.do(t, "GET", "/vms/"+created.ID, nil, nil)
+	equals(t, http.StatusNotFound, status)
+}
+
+func TestCreateVMInvalidImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Would be removed if checksums were taken as paths.
+	victim := filepath.Join(env.dir, "victim")
+	ok(t, os.MkdirAll(victim, 0740))
+
+	for _, checksum := range []string{"..", "../victim", "../../victim", ""} {
+		image := env.image
+		image.Checksum = checksum
+
+		var appErr apperror.Error
+		status := env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: image}}, &appErr)
+		equals(t, http.StatusBadRequest, status)
+		equals(t, ErrInvalidImage.Code, appErr.Code)
+
+		var op *operations.Operation
+		_, err := prepareGoldImage(image, op)
+		assert(t, err != nil, "checksum %q should be refused", checksum)
+	}
+
+	_, err := os.Stat(victim)
+	ok(t, err)
+}
+
+func TestCreateVMUnsafeImage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	ok(t, tw.WriteHeader(&tar.Header{Name: "osx/../../../escaped.vmx", Mode: 0644, Size: 4}))
+	_, err := tw.Write([]byte("evil"))
+	ok(t, err)
+	ok(t, tw.Close())
+	ok(t, gw.Close())
+
+	data := buf.Bytes()
+	env.mu.Lock()
+	env.served["/unsafe.tar.gz"] = data
+	env.mu.Unlock()
+
+	image := Image{
+		URL:          env.images.URL + "/unsafe.tar.gz",
+		Checksum:     fmt.Sprintf("%x", sha1.Sum(data)),
+		ChecksumType: "sha1",
+	}
+
+	for _, stream := range []bool{false, true} {
+		config.StreamUnpack = stream
+
+		var created CreateVMResult
+		status := env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: image}}, &created)
+		equals(t, http.StatusAccepted, status)
+
+		op := env.waitOperation(t, created.OperationID)
+		equals(t, operations.StatusFailed, op.Status)
+		assert(t, op.Error != nil, "operation error was expected")
+		equals(t, ErrUnsafeImage.Code, op.Error.Code)
+	}
+
+	_, err = os.Stat(filepath.Join(env.dir, "escaped.vmx"))
+	assert(t, os.IsNotExist(err), "file was extracted outside of the gold image")
+
+	_, err = os.Stat(filepath.Join(config.GoldImgsPath, image.Checksum))
+	assert(t, os.IsNotExist(err), "gold image should not exist")
+}
+
+// testOVF is a minimal OVF descriptor, for images packaged as OVA files.
+const testOVF = `<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf">
+  <References>
+    <File ovf:href="osx-disk1.vmdk" ovf:id="file1"/>
+  </References>
+  <DiskSection>
+    <Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#monolithicSparse"/>
+  </DiskSection>
+  <VirtualSystem ovf:id="osx">
+    <OperatingSystemSection ovf:id="1" vmw:osType="darwin14_64Guest"/>
+    <VirtualHardwareSection>
+      <Item>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>6</rasd:ResourceType>
+        <rasd:ResourceSubType>lsilogic</rasd:ResourceSubType>
+      </Item>
+      <Item>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>17</rasd:ResourceType>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:Parent>1</rasd:Parent>
+      </Item>
+      <Item>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceType>10</rasd:ResourceType>
+        <rasd:ResourceSubType>VmxNet3</rasd:ResourceSubType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`
+
+// serveOVA serves an OVA image, with the given OVF descriptor, from the
+// images server.
+func (e *testEnv) serveOVA(t *testing.T, name, descriptor string) Image {
+	return e.serveTar(t, "/"+name+".ova", []testFile{
+		{"osx.ovf", descriptor},
+		{"osx-disk1.vmdk", "disk"},
+	})
+}
+
+// testFile is a file in the packages served by serveTar.
+type testFile struct {
+	Name, Body string
+}
+
+// serveTar serves a tarball with the given files, at path, from the images
+// server.
+func (e *testEnv) serveTar(t *testing.T, path string, files []testFile) Image {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, file := range files {
+		ok(t, tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0644, Size: int64(len(file.Body))}))
+		_, err := tw.Write([]byte(file.Body))
+		ok(t, err)
+	}
+	ok(t, tw.Close())
+
+	data := buf.Bytes()
+
+	e.mu.Lock()
+	e.served[path] = data
+	e.mu.Unlock()
+
+	return Image{
+		URL:          e.images.URL + path,
+		Checksum:     fmt.Sprintf("%x", sha1.Sum(data)),
+		ChecksumType: "sha1",
+	}
+}
+
+func TestCreateVMFromOVA(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	image := env.serveOVA(t, "osx", testOVF)
+	vm := env.createVM(t, VMConfig{OSImage: image, CPUs: 2, Memory: 2048})
+	equals(t, StatusRunning, vm.Status)
+
+	vmxPath := filepath.Join(config.GoldImgsPath, image.Checksum, "osx.vmx")
+	_, err := os.Stat(vmxPath)
+	ok(t, err)
+
+	// The clone keeps the network adapter model of the OVF descriptor.
+	data, err := ioutil.ReadFile(filepath.Join(config.VMSPath, vm.ID, vm.ID+".vmx"))
+	ok(t, err)
+	assert(t, strings.Contains(string(data), `ethernet0.virtualdev = "vmxnet3"`), "unexpected VMX file:\n%s", data)
+	assert(t, strings.Contains(string(data), `scsi0:0.filename = "osx-disk1.vmdk"`), "unexpected VMX file:\n%s", data)
+}
+
+func TestCreateVMInvalidOVF(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	image := env.serveOVA(t, "invalid", strings.Replace(testOVF, "osx-disk1.vmdk", "missing.vmdk", 1))
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: image}}, &created)
+	equals(t, http.StatusAccepted, status)
+
+	op := env.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusFailed, op.Status)
+	assert(t, op.Error != nil, "operation error was expected")
+	equals(t, ErrInvalidOVF.Code, op.Error.Code)
+
+	_, err := os.Stat(filepath.Join(config.GoldImgsPath, image.Checksum))
+	assert(t, os.IsNotExist(err), "gold image should not exist")
+}
+
+func TestCreateVMNestedVMX(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	image := env.serveTar(t, "/nested.tar", []testFile{
+		{"osx.vmwarevm/osx.vmdk", "disk"},
+		{"osx.vmwarevm/osx.vmx", "displayName = \"osx\"\nguestOS = \"darwin14-64\"\n"},
+	})
+
+	env.createVM(t, VMConfig{OSImage: image})
+
+	manifest, err := readGoldManifest(filepath.Join(config.GoldImgsPath, image.Checksum))
+	ok(t, err)
+	equals(t, "osx.vmwarevm/osx.vmx", manifest.VMX)
+}
+
+func TestCreateVMSameImageConcurrently(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var ops []string
+	for i := 0; i < 3; i++ {
+		params := CreateVMParams{
+			VMConfig: VMConfig{
+				OSImage: env.image,
+			},
+		}
+
+		var created CreateVMResult
+		status := env.do(t, "POST", "/vms", params, &created)
+		equals(t, http.StatusAccepted, status)
+		ops = append(ops, created.OperationID)
+	}
+
+	for _, id := range ops {
+		op := env.waitOperation(t, id)
+		equals(t, operations.StatusSucceeded, op.Status)
+	}
+	equals(t, int32(1), atomic.LoadInt32(&env.downloads))
+
+	ok(t, validateGoldImage(filepath.Join(config.GoldImgsPath, env.image.Checksum), env.image))
+}
+
+func TestCancelCreateVMWaitingForIP(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	defer func(interval time.Duration) { ipPollInterval = interval }(ipPollInterval)
+	ipPollInterval = 10 * time.Millisecond
+	env.host.SetFailure("getGuestIPAddress", errors.New("VMware Tools are not running"))
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", CreateVMParams{VMConfig: VMConfig{OSImage: env.image}}, &created)
+	equals(t, http.StatusAccepted, status)
+
+	var op operations.Operation
+	deadline := time.Now().Add(10 * time.Second)
+	for op.Phase != operations.PhaseWaitingForIP {
+		if time.Now().After(deadline) {
+			t.Fatalf("VM never waited for an IP address, last phase: %s", op.Phase)
+		}
+		time.Sleep(5 * time.Millisecond)
+		env.do(t, "GET", "/operations/"+created.OperationID, nil, &op)
+	}
+
+	status = env.do(t, "DELETE", "/operations/"+created.OperationID, nil, &op)
+	equals(t, http.StatusAccepted, status)
+
+	start := time.Now()
+	canceled := env.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusFailed, canceled.Status)
+	equals(t, operations.ErrCanceled.Code, canceled.Error.Code)
+	assert(t, time.Since(start) < ipWaitTimeout/2, "canceling took %s", time.Since(start))
+}
+
+func TestCancelCreateVM(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	release := env.holdDownloads(env.image)
+	defer release()
+
+	params := CreateVMParams{
+		VMConfig: VMConfig{
+			OSImage: env.image,
+		},
+	}
+
+	var created CreateVMResult
+	status := env.do(t, "POST", "/vms", params, &created)
+	equals(t, http.StatusAccepted, status)
+
+	// The image lock is held by then.
+	var op operations.Operation
+	deadline := time.Now().Add(10 * time.Second)
+	for op.Phase != operations.PhaseDownloading {
+		if time.Now().After(deadline) {
+			t.Fatalf("Image download never started, last phase: %s", op.Phase)
+		}
+		time.Sleep(5 * time.Millisecond)
+		env.do(t, "GET", "/operations/"+created.OperationID, nil, &op)
+	}
+
+	status = env.do(t, "DELETE", "/operations/"+created.OperationID, nil, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.StatusRunning, op.Status)
+
+	release()
+	canceled := env.waitOperation(t, created.OperationID)
+	equals(t, operations.StatusFailed, canceled.Status)
+	equals(t, operations.ErrCanceled.Code, canceled.Error.Code)
+
+	var appErr apperror.Error
+	status = env.do(t, "DELETE", "/operations/"+created.OperationID, nil, &appErr)
+	equals(t, http.StatusConflict, status)
+	equals(t, operations.ErrOperationFinished.Code, appErr.Code)
+
+	status = env.do(t, "DELETE", "/operations/non-existent", nil, &appErr)
+	equals(t, http.StatusNotFound, status)
+	equals(t, operations.ErrOperationNotFound.Code, appErr.Code)
+
+	// Waits for the image preparation to wind down.
+	lock, err := lockfile.Acquire(filepath.Join(config.GoldImgsPath, env.image.Checksum+".lock"))
+	ok(t, err)
+	ok(t, lock.Release())
+
+	_, err = os.Stat(filepath.Join(config.GoldImgsPath, env.image.Checksum))
+	assert(t, os.IsNotExist(err), "gold image should not exist")
+}
+
+func TestCreateVMHeadlessUnsupported(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.host.Features.Headless = false
+
+	params := CreateVMParams{
+		VMConfig: VMConfig{
+			OSImage:  env.image,
+			Headless: true,
+		},
+	}
+
+	var appErr apperror.Error
+	status := env.do(t, "POST", "/vms", params, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrHeadlessUnsupported.Code, appErr.Code)
+
+	vms, err := ioutil.ReadDir(config.VMSPath)
+	assert(t, os.IsNotExist(err) || len(vms) == 0, "No virtual machine should have been created")
+}
+
+func TestListVMs(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	var list ListVMsResult
+	status := env.do(t, "GET", "/vms", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(list.VMs))
+
+	ids := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		vm := env.createVM(t, VMConfig{OSImage: env.image})
+		ids[vm.ID] = true
+	}
+
+	var stopped string
+	for id := range ids {
+		stopped = id
+		break
+	}
+	ok(t, env.host.VM(filepath.Join(config.VMSPath, stopped, stopped+".vmx")).Stop(vmware.PowerSoft))
+
+	status = env.do(t, "GET", "/vms", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 3, len(list.VMs))
+	equals(t, "", list.NextCursor)
+	for _, vm := range list.VMs {
+		assert(t, ids[vm.ID], "unexpected VM %s", vm.ID)
+		equals(t, 2, vm.CPUs)
+		equals(t, 512, vm.Memory)
+	}
+
+	var page1, page2 ListVMsResult
+	status = env.do(t, "GET", "/vms?limit=2", nil, &page1)
+	equals(t, http.StatusOK, status)
+	equals(t, 2, len(page1.VMs))
+	assert(t, page1.NextCursor != "", "a cursor for the next page was expected")
+
+	status = env.do(t, "GET", "/vms?limit=2&cursor="+page1.NextCursor, nil, &page2)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(page2.VMs))
+	equals(t, "", page2.NextCursor)
+	assert(t, page2.VMs[0].ID > page1.VMs[1].ID, "pages should be sorted by ID")
+
+	status = env.do(t, "GET", "/vms?status=stopped", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(list.VMs))
+	equals(t, stopped, list.VMs[0].ID)
+	equals(t, "", list.VMs[0].IPAddress)
+
+	status = env.do(t, "GET", "/vms?status=running&image_checksum="+env.image.Checksum, nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 2, len(list.VMs))
+
+	status = env.do(t, "GET", "/vms?image_checksum=deadbeef", nil, &list)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(list.VMs))
+
+	var appErr apperror.Error
+	status = env.do(t, "GET", "/vms?limit=0", nil, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrInvalidListLimit.Code, appErr.Code)
+
+	status = env.do(t, "GET", "/vms?cursor=%25%25", nil, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrInvalidCursor.Code, appErr.Code)
+}
+
+func TestRunVMAction(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	created := env.createVM(t, VMConfig{OSImage: env.image, Headless: true})
+	actionsPath := "/vms/" + created.ID + "/actions"
+
+	var tests = []struct {
+		params RunVMActionParams
+		status int
+		result string
+	}{
+		{RunVMActionParams{Action: ActionStart}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionSuspend}, http.StatusOK, StatusSuspended},
+		{RunVMActionParams{Action: ActionSuspend}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionStop}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionStart}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionResume}, http.StatusOK, StatusRunning},
+		{RunVMActionParams{Action: ActionResume}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionSuspend}, http.StatusOK, StatusSuspended},
+		{RunVMActionParams{Action: ActionResume}, http.StatusOK, StatusRunning},
+		{RunVMActionParams{Action: ActionRestart}, http.StatusOK, StatusRunning},
+		{RunVMActionParams{Action: ActionRestart, Hard: true}, http.StatusOK, StatusRunning},
+		{RunVMActionParams{Action: ActionStop}, http.StatusOK, StatusStopped},
+		{RunVMActionParams{Action: ActionStop, Hard: true}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionResume}, http.StatusConflict, ""},
+		{RunVMActionParams{Action: ActionStart}, http.StatusOK, StatusRunning},
+		{RunVMActionParams{Action: ActionStop, Hard: true}, http.StatusOK, StatusStopped},
+		{RunVMActionParams{Action: "hibernate"}, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		var vm VM
+		status := env.do(t, "POST", actionsPath, test.params, &vm)
+		assert(t, status == test.status, "%s: %d != %d", test.params.Action, status, test.status)
+		equals(t, test.result, vm.Status)
+		if status == http.StatusOK {
+			assert(t, vm.Headless, "the headless setting should be kept")
+		}
+	}
+
+	var appErr apperror.Error
+	status := env.do(t, "POST", "/vms/non-existent/actions", RunVMActionParams{Action: ActionStart}, &appErr)
+	equals(t, http.StatusNotFound, status)
+	equals(t, ErrVMNotFound.Code, appErr.Code)
+
+	status = env.do(t, "POST", "/vms/"+created.ID+"/snapshots", nil, &appErr)
+	equals(t, http.StatusNotFound, status)
+	equals(t, ErrNotFound.Code, appErr.Code)
+}
+
+func TestReconfigureVM(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	created := env.createVM(t, VMConfig{OSImage: env.image, CPUs: 1, Memory: 1024, Network: vmware.NetworkNAT})
+	vmPath := "/vms/" + created.ID
+
+	cpus, memory := 4, 2048
+	patch := ReconfigureVMParams{
+		VMConfigPatch: VMConfigPatch{
+			CPUs:   &cpus,
+			Memory: &memory,
+		},
+	}
+
+	var appErr apperror.Error
+	status := env.do(t, "PATCH", vmPath, patch, &appErr)
+	equals(t, http.StatusConflict, status)
+	equals(t, ErrInvalidTransition.Code, appErr.Code)
+
+	var vm VM
+	status = env.do(t, "GET", vmPath, nil, &vm)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, vm.CPUs)
+
+	var op operations.Operation
+	patch.Restart = true
+	status = env.do(t, "PATCH", vmPath, patch, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.TypeReconfigureVM, op.Type)
+	equals(t, operations.StatusSucceeded, env.waitOperation(t, op.ID).Status)
+
+	status = env.do(t, "GET", vmPath, nil, &vm)
+	equals(t, http.StatusOK, status)
+	equals(t, StatusRunning, vm.Status)
+	equals(t, 4, vm.CPUs)
+	equals(t, 2048, vm.Memory)
+	equals(t, vmware.NetworkNAT, vm.Network)
+
+	status = env.do(t, "POST", vmPath+"/actions", RunVMActionParams{Action: ActionStop}, &vm)
+	equals(t, http.StatusOK, status)
+
+	network := vmware.NetworkBridged
+	patch = ReconfigureVMParams{
+		VMConfigPatch: VMConfigPatch{
+			Network: &network,
+		},
+	}
+	status = env.do(t, "PATCH", vmPath, patch, &op)
+	equals(t, http.StatusAccepted, status)
+	equals(t, operations.StatusSucceeded, env.waitOperation(t, op.ID).Status)
+
+	status = env.do(t, "GET", vmPath, nil, &vm)
+	equals(t, http.StatusOK, status)
+	equals(t, StatusStopped, vm.Status)
+	equals(t, vmware.NetworkBridged, vm.Network)
+	equals(t, 4, vm.CPUs)
+
+	invalid := []VMConfigPatch{
+		{CPUs: new(int)},
+		{Memory: &cpus},
+		{Network: new(vmware.NetworkType)},
+	}
+	for _, p := range invalid {
+		status = env.do(t, "PATCH", vmPath, ReconfigureVMParams{VMConfigPatch: p}, &appErr)
+		equals(t, http.StatusBadRequest, status)
+		equals(t, ErrInvalidConfig.Code, appErr.Code)
+	}
+
+	env.host.Features.Headless = false
+	headless := true
+	status = env.do(t, "PATCH", vmPath, ReconfigureVMParams{VMConfigPatch: VMConfigPatch{Headless: &headless}}, &appErr)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, ErrHeadlessUnsupported.Code, appErr.Code)
+}